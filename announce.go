@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/kballard/goirc/irc"
+	"github.com/robfig/cron"
+)
+
+func init() {
+	RegisterModule("announce", func() Module {
+		return &AnnounceMod{}
+	})
+}
+
+// AnnounceMod posts messages to channels on a schedule. Each mod=announce
+// record is one announcement:
+//
+//	mod=announce
+//		name=standup
+//		schedule="45 9 * * mon-fri"
+//		tz=Europe/London
+//		channels="#glenda #dev"
+//		message="standup in 15 minutes ({{.Clock}} {{.Weekday}})"
+//
+// message is a text/template. Besides the variables in announcedata,
+// {{hook `fortune`}} is replaced with what the fortune hook would have
+// said in the channel.
+type AnnounceMod struct {
+	b *Bot
+
+	mu   sync.Mutex
+	cron *cron.Cron
+}
+
+type announcement struct {
+	name     string
+	channels []string
+	tmpl     *template.Template
+	loc      *time.Location
+}
+
+// what a message template can refer to
+type announcedata struct {
+	Time    time.Time
+	Date    string
+	Clock   string
+	Weekday string
+	Channel string
+	Network string
+}
+
+// tzschedule runs a cron schedule in a given time zone.
+type tzschedule struct {
+	cron.Schedule
+	loc *time.Location
+}
+
+func (s tzschedule) Next(t time.Time) time.Time {
+	return s.Schedule.Next(t.In(s.loc))
+}
+
+// replaced per channel when the announcement is sent
+var announcefuncs = template.FuncMap{
+	"hook": func(cmd string, args ...string) (string, error) {
+		return "", fmt.Errorf("hook called outside of an announcement")
+	},
+}
+
+func (m *AnnounceMod) Init(b *Bot, conn irc.SafeConn) error {
+	m.b = b
+
+	n, err := m.configure()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("announce module initialized with %d announcements", n)
+	return nil
+}
+
+func (m *AnnounceMod) Reload() error {
+	n, err := m.configure()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("announce module reloaded with %d announcements", n)
+	return nil
+}
+
+func (m *AnnounceMod) Call(args ...string) error {
+	return nil
+}
+
+// configure replaces the running schedule with the one in the config.
+func (m *AnnounceMod) configure() (int, error) {
+	c := cron.New()
+	n := 0
+
+	for i, rec := range m.b.Config.Search("mod", "announce") {
+		var spec, channels, message, tz, name string
+
+		for _, tup := range rec {
+			switch tup.Attr {
+			case "schedule":
+				spec = tup.Val
+			case "channels":
+				channels = tup.Val
+			case "message":
+				message = tup.Val
+			case "tz":
+				tz = tup.Val
+			case "name":
+				name = tup.Val
+			}
+		}
+
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		a := &announcement{
+			name:     name,
+			channels: strings.Fields(channels),
+			loc:      time.Local,
+		}
+
+		if len(a.channels) == 0 || message == "" {
+			log.Printf("announce %s skipped: channels and message are required", name)
+			continue
+		}
+
+		sched, err := schedule(spec)
+		if err != nil {
+			log.Printf("announce %s skipped: bad schedule %q: %s", name, spec, err)
+			continue
+		}
+
+		if tz != "" {
+			if a.loc, err = time.LoadLocation(tz); err != nil {
+				log.Printf("announce %s skipped: %s", name, err)
+				continue
+			}
+		}
+
+		if a.tmpl, err = template.New(name).Funcs(announcefuncs).Parse(message); err != nil {
+			log.Printf("announce %s skipped: %s", name, err)
+			continue
+		}
+
+		c.Schedule(tzschedule{sched, a.loc}, cron.FuncJob(func() {
+			m.announce(a)
+		}))
+
+		n++
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cron != nil {
+		m.cron.Stop()
+	}
+
+	m.cron = c
+	m.cron.Start()
+
+	return n, nil
+}
+
+func (m *AnnounceMod) announce(a *announcement) {
+	if !m.b.Connected() {
+		log.Printf("announce %s skipped: not connected", a.name)
+		return
+	}
+
+	now := m.b.Now().In(a.loc)
+
+	for _, ch := range a.channels {
+		msg, err := m.render(a, now, ch)
+		if err != nil {
+			log.Printf("announce %s failed for %s: %s", a.name, ch, err)
+			continue
+		}
+
+		for _, line := range strings.Split(msg, "\n") {
+			if strings.TrimSpace(line) != "" {
+				m.b.Conn.Privmsg(ch, line)
+			}
+		}
+	}
+}
+
+func (m *AnnounceMod) render(a *announcement, now time.Time, channel string) (string, error) {
+	t, err := a.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	t.Funcs(template.FuncMap{
+		"hook": func(cmd string, args ...string) (string, error) {
+			lines, err := m.b.Capture(channel, cmd, args...)
+			return strings.Join(lines, "\n"), err
+		},
+	})
+
+	data := announcedata{
+		Time:    now,
+		Date:    now.Format("2006-01-02"),
+		Clock:   now.Format("15:04"),
+		Weekday: now.Weekday().String(),
+		Channel: channel,
+		Network: m.b.Network,
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mischief/glenda/calc"
+
+	"github.com/kballard/goirc/irc"
+)
+
+func init() {
+	RegisterModule("calc", func() Module {
+		return &CalcMod{}
+	})
+}
+
+const (
+	calcUsage = "usage: calc expr [to hex|oct|bin] | calc name = expr"
+	convUsage = "usage: conv 10 mi to km"
+)
+
+type CalcMod struct {
+	mu sync.Mutex
+	// variables, by nick
+	envs map[string]calc.Env
+}
+
+func (m *CalcMod) Init(b *Bot, conn irc.SafeConn) error {
+	m.envs = make(map[string]calc.Env)
+
+	b.HookLine("calc", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		expr := strings.TrimSpace(strings.Join(args, " "))
+		if expr == "" {
+			return fmt.Errorf(calcUsage)
+		}
+
+		base := 10
+		if i := strings.LastIndex(expr, " to "); i > 0 {
+			switch strings.TrimSpace(expr[i+4:]) {
+			case "hex":
+				base = 16
+			case "oct":
+				base = 8
+			case "bin":
+				base = 2
+			case "dec":
+			default:
+				return fmt.Errorf(calcUsage)
+			}
+			expr = expr[:i]
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		nick := strings.ToLower(l.Src.Nick)
+		env, ok := m.envs[nick]
+		if !ok {
+			env = calc.Env{}
+			m.envs[nick] = env
+		}
+
+		v, err := calc.Eval(expr, env)
+		if err != nil {
+			return fmt.Errorf("calc: %s", err)
+		}
+
+		s, err := calc.Format(v, base)
+		if err != nil {
+			return fmt.Errorf("calc: %s", err)
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("%s: %s", l.Src.Nick, s))
+		return nil
+	})
+
+	b.HookLine("conv", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		amount, from, to, err := parseconv(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+
+		v, err := calc.Eval(amount, nil)
+		if err != nil {
+			return fmt.Errorf("conv: %s", err)
+		}
+
+		r, err := calc.Convert(v, from, to)
+		if err != nil {
+			return fmt.Errorf("conv: %s", err)
+		}
+
+		vs, _ := calc.Format(v, 10)
+		rs, _ := calc.Format(r, 10)
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("%s: %s %s = %s %s", l.Src.Nick, vs, from, rs, to))
+		return nil
+	})
+
+	log.Printf("calc module initialized")
+	return nil
+}
+
+func (m *CalcMod) Reload() error {
+	return nil
+}
+
+func (m *CalcMod) Call(args ...string) error {
+	return nil
+}
+
+// parseconv splits "10 mi to km" or "10mi in km" into its parts.
+func parseconv(s string) (amount, from, to string, err error) {
+	s = strings.TrimSpace(s)
+
+	i := strings.LastIndex(s, " to ")
+	if j := strings.LastIndex(s, " in "); j > i {
+		i = j
+	}
+
+	if i < 0 {
+		return "", "", "", fmt.Errorf(convUsage)
+	}
+
+	left, to := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+4:])
+
+	// the unit is the last word, or the letters at the end of 10km
+	if f := strings.Fields(left); len(f) > 1 {
+		from = f[len(f)-1]
+		amount = strings.Join(f[:len(f)-1], " ")
+	} else {
+		j := strings.LastIndexFunc(left, func(r rune) bool {
+			return !unicode.IsLetter(r) && r != '°'
+		})
+		amount, from = left[:j+1], left[j+1:]
+	}
+
+	if amount == "" || from == "" || to == "" {
+		return "", "", "", fmt.Errorf(convUsage)
+	}
+
+	return amount, from, to, nil
+}
@@ -0,0 +1,529 @@
+// Package calc evaluates arithmetic expressions with arbitrary precision
+// and converts between units.
+//
+// Numbers are exact rationals wherever possible. They may be written in
+// decimal (1.5, 2e10), hex (0xff), binary (0b101) or octal (0o17).
+// Operators, from lowest to highest precedence:
+//
+//	|          bitwise or
+//	&          bitwise and
+//	<< >>      shifts
+//	+ -        addition, subtraction
+//	* / %      multiplication, division, remainder
+//	- ~        negation, bitwise not
+//	^ **       exponentiation, right associative
+//	!          factorial
+//
+// Bitwise operators, shifts and factorials need integers. The functions in
+// funcs, and the constants pi and e, are available, and "name = expr"
+// assigns a variable. The result of each evaluation is kept in ans.
+// Irrational results, like sqrt(2), are computed with float64 precision.
+package calc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Env holds variables between evaluations.
+type Env map[string]*big.Rat
+
+// MaxVars is the most variables an Env may hold.
+const MaxVars = 50
+
+// limits on the size of numbers, so nobody asks for 9^9^9
+const (
+	maxBits     = 1 << 16
+	maxExponent = 1 << 16
+	maxFact     = 1000
+)
+
+// maxDigits is the longest result Format writes out in full. Longer ones
+// are shown in e notation, or refused in bases other than 10.
+const maxDigits = 400
+
+var constants = map[string]*big.Rat{
+	"pi": ratconst("3.14159265358979323846264338327950288"),
+	"e":  ratconst("2.71828182845904523536028747135266250"),
+}
+
+func ratconst(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		panic("calc: bad constant " + s)
+	}
+	return r
+}
+
+type fn struct {
+	nargs int
+	f     func(args []*big.Rat) (*big.Rat, error)
+}
+
+// float64 function of one argument
+func f1(f func(float64) float64) fn {
+	return fn{1, func(a []*big.Rat) (*big.Rat, error) {
+		x, _ := a[0].Float64()
+		return fromfloat(f(x))
+	}}
+}
+
+var funcs = map[string]fn{
+	"sqrt":  f1(math.Sqrt),
+	"cbrt":  f1(math.Cbrt),
+	"sin":   f1(math.Sin),
+	"cos":   f1(math.Cos),
+	"tan":   f1(math.Tan),
+	"asin":  f1(math.Asin),
+	"acos":  f1(math.Acos),
+	"atan":  f1(math.Atan),
+	"sinh":  f1(math.Sinh),
+	"cosh":  f1(math.Cosh),
+	"tanh":  f1(math.Tanh),
+	"exp":   f1(math.Exp),
+	"ln":    f1(math.Log),
+	"log":   f1(math.Log10),
+	"log2":  f1(math.Log2),
+	"abs":   {1, func(a []*big.Rat) (*big.Rat, error) { return new(big.Rat).Abs(a[0]), nil }},
+	"floor": {1, func(a []*big.Rat) (*big.Rat, error) { return new(big.Rat).SetInt(floor(a[0])), nil }},
+	"ceil": {1, func(a []*big.Rat) (*big.Rat, error) {
+		return new(big.Rat).Neg(new(big.Rat).SetInt(floor(new(big.Rat).Neg(a[0])))), nil
+	}},
+	// halves round away from zero
+	"round": {1, func(a []*big.Rat) (*big.Rat, error) {
+		half := big.NewRat(1, 2)
+		if a[0].Sign() < 0 {
+			r := floor(new(big.Rat).Add(new(big.Rat).Neg(a[0]), half))
+			return new(big.Rat).SetInt(r.Neg(r)), nil
+		}
+		return new(big.Rat).SetInt(floor(new(big.Rat).Add(a[0], half))), nil
+	}},
+	"min": {2, func(a []*big.Rat) (*big.Rat, error) {
+		if a[0].Cmp(a[1]) < 0 {
+			return a[0], nil
+		}
+		return a[1], nil
+	}},
+	"max": {2, func(a []*big.Rat) (*big.Rat, error) {
+		if a[0].Cmp(a[1]) > 0 {
+			return a[0], nil
+		}
+		return a[1], nil
+	}},
+	"xor": {2, func(a []*big.Rat) (*big.Rat, error) {
+		return bitwise(a[0], a[1], (*big.Int).Xor)
+	}},
+	"gcd": {2, func(a []*big.Rat) (*big.Rat, error) {
+		x, y, err := ints(a[0], a[1])
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Rat).SetInt(new(big.Int).GCD(nil, nil, x.Abs(x), y.Abs(y))), nil
+	}},
+}
+
+// Eval evaluates expr, which may assign a variable in env, and stores the
+// result in env["ans"]. env may be nil.
+func Eval(expr string, env Env) (*big.Rat, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &parser{toks: toks, env: env}
+
+	// name = expr
+	var assign string
+	if len(toks) > 2 && toks[0].kind == tident && toks[1].is("=") {
+		assign = toks[0].text
+		if _, ok := constants[assign]; ok || funcs[assign].f != nil || assign == "ans" {
+			return nil, fmt.Errorf("can't assign to %s", assign)
+		}
+		p.pos = 2
+	}
+
+	v, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+
+	if env != nil {
+		if _, ok := env[assign]; assign != "" && !ok && len(env) >= MaxVars {
+			return nil, fmt.Errorf("too many variables")
+		}
+
+		if assign != "" {
+			env[assign] = v
+		}
+
+		env["ans"] = v
+	}
+
+	return v, nil
+}
+
+// Format formats v in base 2, 8, 10 or 16. Only integers can be formatted
+// in bases other than 10. Results longer than maxDigits are shown in e
+// notation in base 10, and refused in the others.
+func Format(v *big.Rat, base int) (string, error) {
+	if base != 10 {
+		if !v.IsInt() {
+			return "", fmt.Errorf("only integers can be shown in base %d", base)
+		}
+
+		n := v.Num()
+		digits := new(big.Int).Abs(n).Text(base)
+		if len(digits) > maxDigits {
+			return "", fmt.Errorf("result is too long to show in base %d", base)
+		}
+
+		prefix := map[int]string{2: "0b", 8: "0o", 16: "0x"}[base]
+		if n.Sign() < 0 {
+			return "-" + prefix + digits, nil
+		}
+		return prefix + digits, nil
+	}
+
+	if v.IsInt() {
+		if s := v.Num().String(); len(s) <= maxDigits {
+			return s, nil
+		}
+		return new(big.Float).SetPrec(128).SetRat(v).Text('g', 30), nil
+	}
+
+	// exact fractions are shown to 30 places, very small ones in e notation
+	if abs := new(big.Rat).Abs(v); abs.Cmp(big.NewRat(1, 1000000)) < 0 {
+		f, _ := v.Float64()
+		return fmt.Sprintf("%g", f), nil
+	}
+
+	s := strings.TrimRight(v.FloatString(30), "0")
+	if len(s) > maxDigits {
+		return new(big.Float).SetPrec(128).SetRat(v).Text('g', 30), nil
+	}
+	return strings.TrimSuffix(s, "."), nil
+}
+
+func floatrat(f float64) *big.Rat {
+	return new(big.Rat).SetFloat64(f)
+}
+
+func fromfloat(f float64) (*big.Rat, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("result is undefined")
+	}
+
+	// float64 results are only good to about 15 places
+	r := floatrat(f)
+	s := new(big.Float).SetFloat64(f).Text('g', 15)
+	if q, ok := new(big.Rat).SetString(s); ok {
+		r = q
+	}
+
+	return r, nil
+}
+
+func floor(x *big.Rat) *big.Int {
+	// Div rounds towards -inf for positive divisors, and Denom is positive
+	return new(big.Int).Div(x.Num(), x.Denom())
+}
+
+func ints(a, b *big.Rat) (*big.Int, *big.Int, error) {
+	if !a.IsInt() || !b.IsInt() {
+		return nil, nil, fmt.Errorf("bitwise operations need integers")
+	}
+	return new(big.Int).Set(a.Num()), new(big.Int).Set(b.Num()), nil
+}
+
+func bitwise(a, b *big.Rat, op func(z, x, y *big.Int) *big.Int) (*big.Rat, error) {
+	x, y, err := ints(a, b)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Rat).SetInt(op(new(big.Int), x, y)), nil
+}
+
+func checksize(v *big.Rat) (*big.Rat, error) {
+	if v.Num().BitLen() > maxBits || v.Denom().BitLen() > maxBits {
+		return nil, fmt.Errorf("number too large")
+	}
+	return v, nil
+}
+
+func pow(x, y *big.Rat) (*big.Rat, error) {
+	if !y.IsInt() {
+		xf, _ := x.Float64()
+		yf, _ := y.Float64()
+		return fromfloat(math.Pow(xf, yf))
+	}
+
+	n := y.Num()
+	if n.BitLen() > 31 || n.Int64() > maxExponent || n.Int64() < -maxExponent {
+		return nil, fmt.Errorf("exponent too large")
+	}
+
+	e := n.Int64()
+	neg := e < 0
+	if neg {
+		e = -e
+	}
+
+	// don't build huge numbers only to throw them away
+	if bits := int64(x.Num().BitLen()+x.Denom().BitLen()) * e; bits > 2*maxBits {
+		return nil, fmt.Errorf("number too large")
+	}
+
+	num := new(big.Int).Exp(x.Num(), big.NewInt(e), nil)
+	den := new(big.Int).Exp(x.Denom(), big.NewInt(e), nil)
+
+	if neg {
+		if num.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		num, den = den, num
+	}
+
+	return checksize(new(big.Rat).SetFrac(num, den))
+}
+
+func factorial(x *big.Rat) (*big.Rat, error) {
+	if !x.IsInt() || x.Sign() < 0 {
+		return nil, fmt.Errorf("factorial needs a positive integer")
+	}
+
+	if x.Num().Cmp(big.NewInt(maxFact)) > 0 {
+		return nil, fmt.Errorf("factorial too large")
+	}
+
+	return new(big.Rat).SetInt(new(big.Int).MulRange(1, x.Num().Int64())), nil
+}
+
+// binary operators and their precedence
+var binops = map[string]int{
+	"|":  1,
+	"&":  2,
+	"<<": 3, ">>": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+	"^": 7, "**": 7,
+}
+
+// precedence of unary - and ~
+const unaryprec = 6
+
+type parser struct {
+	toks []token
+	pos  int
+	env  Env
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{kind: teof}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// expr parses operators of at least precedence min.
+func (p *parser) expr(min int) (*big.Rat, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		prec, ok := binops[t.text]
+		if t.kind != top || !ok || prec < min {
+			return x, nil
+		}
+
+		p.next()
+
+		// ^ is right associative
+		next := prec + 1
+		if prec == binops["^"] {
+			next = prec
+		}
+
+		y, err := p.expr(next)
+		if err != nil {
+			return nil, err
+		}
+
+		if x, err = binop(t.text, x, y); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func binop(op string, x, y *big.Rat) (*big.Rat, error) {
+	switch op {
+	case "+":
+		return checksize(new(big.Rat).Add(x, y))
+	case "-":
+		return checksize(new(big.Rat).Sub(x, y))
+	case "*":
+		return checksize(new(big.Rat).Mul(x, y))
+	case "/":
+		if y.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return checksize(new(big.Rat).Quo(x, y))
+	case "%":
+		if y.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		// x - y*trunc(x/y), like C
+		q := new(big.Rat).Quo(x, y)
+		t := new(big.Int).Quo(q.Num(), q.Denom())
+		return new(big.Rat).Sub(x, new(big.Rat).Mul(y, new(big.Rat).SetInt(t))), nil
+	case "^", "**":
+		return pow(x, y)
+	case "&":
+		return bitwise(x, y, (*big.Int).And)
+	case "|":
+		return bitwise(x, y, (*big.Int).Or)
+	case "<<", ">>":
+		a, b, err := ints(x, y)
+		if err != nil {
+			return nil, err
+		}
+		if b.BitLen() > 31 || b.Int64() > maxBits || b.Sign() < 0 {
+			return nil, fmt.Errorf("bad shift %s", b)
+		}
+		if op == "<<" {
+			return checksize(new(big.Rat).SetInt(a.Lsh(a, uint(b.Int64()))))
+		}
+		return new(big.Rat).SetInt(a.Rsh(a, uint(b.Int64()))), nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func (p *parser) unary() (*big.Rat, error) {
+	t := p.peek()
+
+	if t.is("-") || t.is("+") || t.is("~") {
+		p.next()
+
+		x, err := p.expr(unaryprec)
+		if err != nil {
+			return nil, err
+		}
+
+		switch t.text {
+		case "-":
+			return new(big.Rat).Neg(x), nil
+		case "~":
+			if !x.IsInt() {
+				return nil, fmt.Errorf("bitwise operations need integers")
+			}
+			return new(big.Rat).SetInt(new(big.Int).Not(x.Num())), nil
+		}
+
+		return x, nil
+	}
+
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("!") {
+		p.next()
+		if x, err = factorial(x); err != nil {
+			return nil, err
+		}
+	}
+
+	return x, nil
+}
+
+func (p *parser) primary() (*big.Rat, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tnum:
+		return t.val, nil
+	case tident:
+		if p.peek().is("(") {
+			return p.call(t.text)
+		}
+
+		if v, ok := p.env[t.text]; ok {
+			return v, nil
+		}
+
+		if v, ok := constants[t.text]; ok {
+			return v, nil
+		}
+
+		return nil, fmt.Errorf("unknown variable %s", t.text)
+	case top:
+		if t.text == "(" {
+			x, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+
+			if !p.next().is(")") {
+				return nil, fmt.Errorf("expected )")
+			}
+
+			return x, nil
+		}
+	case teof:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *parser) call(name string) (*big.Rat, error) {
+	f, ok := funcs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+
+	p.next()
+
+	var args []*big.Rat
+
+	for !p.peek().is(")") {
+		if len(args) > 0 && !p.next().is(",") {
+			return nil, fmt.Errorf("expected , or ) in call to %s", name)
+		}
+
+		x, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, x)
+	}
+
+	p.next()
+
+	if len(args) != f.nargs {
+		return nil, fmt.Errorf("%s takes %d arguments", name, f.nargs)
+	}
+
+	return f.f(args)
+}
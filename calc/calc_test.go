@@ -0,0 +1,191 @@
+package calc
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"1/3 + 1/6", "0.5"},
+		{"2^10", "1024"},
+		{"2**3**2", "512"},
+		{"-2^2", "-4"},
+		{"2^-2", "0.25"},
+		{"7 % 3", "1"},
+		{"-7 % 3", "-1"},
+		{"0x10 + 0b11 + 0o10", "27"},
+		{"0xff & 0x0f | 0x100", "271"},
+		{"1 << 70", "1180591620717411303424"},
+		{"~0", "-1"},
+		{"xor(5, 3)", "6"},
+		{"5!", "120"},
+		{"sqrt(16)", "4"},
+		{"sqrt(2)", "1.4142135623731"},
+		{"floor(-1.5)", "-2"},
+		{"ceil(-1.5)", "-1"},
+		{"round(2.5)", "3"},
+		{"round(-2.5)", "-3"},
+		{"max(1, min(5, 3))", "3"},
+		{"gcd(12, 18)", "6"},
+		{"1.5e3", "1500"},
+		{"2*e", "5.436563656918090470720574942705"},
+		{"0.1 + 0.2", "0.3"},
+		{"1/3", "0.333333333333333333333333333333"},
+		{"1/10000000", "1e-07"},
+	}
+
+	for _, tt := range tests {
+		v, err := Eval(tt.in, nil)
+		if err != nil {
+			t.Errorf("Eval(%q): %s", tt.in, err)
+			continue
+		}
+
+		got, err := Format(v, 10)
+		if err != nil {
+			t.Errorf("Format(%q): %s", tt.in, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Eval(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"1 +",
+		"(1",
+		"1)",
+		"1 / 0",
+		"1 % 0",
+		"0^-1",
+		"9^9^9",
+		"1e99999999",
+		"1 << 1000000",
+		"1.5 & 1",
+		"1.5!",
+		"5000!",
+		"sqrt(-1)",
+		"ln(0)",
+		"nope(1)",
+		"nope",
+		"min(1)",
+		"1 $ 2",
+		"pi = 3",
+	}
+
+	for _, s := range bad {
+		if v, err := Eval(s, Env{}); err == nil {
+			t.Errorf("Eval(%q) = %s, want error", s, v.RatString())
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	env := Env{}
+
+	steps := []struct {
+		in, want string
+	}{
+		{"x = 6", "6"},
+		{"y = x * 7", "42"},
+		{"ans + 1", "43"},
+		{"ans * 2", "86"},
+		{"X", "6"},
+	}
+
+	for _, s := range steps {
+		v, err := Eval(s.in, env)
+		if err != nil {
+			t.Fatalf("Eval(%q): %s", s.in, err)
+		}
+
+		if got, _ := Format(v, 10); got != s.want {
+			t.Errorf("Eval(%q) = %s, want %s", s.in, got, s.want)
+		}
+	}
+
+	for i := len(env); i < MaxVars; i++ {
+		env[string(rune('a'+i%26))+string(rune('a'+i/26))] = nil
+	}
+
+	if _, err := Eval("toomany = 1", env); err == nil {
+		t.Errorf("assigned more than %d variables", MaxVars)
+	}
+
+	if _, err := Eval("x = 1", env); err != nil {
+		t.Errorf("reassigning x: %s", err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		in   string
+		base int
+		want string
+	}{
+		{"255", 16, "0xff"},
+		{"-255", 16, "-0xff"},
+		{"5", 2, "0b101"},
+		{"8", 8, "0o10"},
+	}
+
+	for _, tt := range tests {
+		v, err := Eval(tt.in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := Format(v, tt.base); err != nil || got != tt.want {
+			t.Errorf("Format(%s, %d) = %s, %v, want %s", tt.in, tt.base, got, err, tt.want)
+		}
+	}
+
+	if _, err := Format(ratconst("1.5"), 16); err == nil {
+		t.Errorf("formatted 1.5 in hex")
+	}
+}
+
+func TestFormatLong(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"1000!", "4.02387260077093773543702433923e+2567"},
+		{"-(10^400)", "-1e+400"},
+		{"10^400/3", "3.33333333333333333333333333333e+399"},
+	}
+
+	for _, tt := range tests {
+		v, err := Eval(tt.in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := Format(v, 10); err != nil || got != tt.want {
+			t.Errorf("Format(%s) = %s, %v, want %s", tt.in, got, err, tt.want)
+		}
+	}
+
+	v, err := Eval("2^40000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := Format(v, 2); err == nil {
+		t.Errorf("formatted 2^40000 in binary as %d digits", len(s))
+	}
+
+	// the longest results are still written out
+	v, _ = Eval("10^399", nil)
+	if s, err := Format(v, 10); err != nil || len(s) != 400 {
+		t.Errorf("Format(10^399) = %d digits, %v, want 400", len(s), err)
+	}
+}
@@ -0,0 +1,151 @@
+package calc
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokkind int
+
+const (
+	teof tokkind = iota
+	tnum
+	tident
+	top
+)
+
+type token struct {
+	kind tokkind
+	text string
+	val  *big.Rat
+}
+
+func (t token) is(op string) bool {
+	return t.kind == top && t.text == op
+}
+
+// operators, longest first
+var ops = []string{"**", "<<", ">>", "+", "-", "*", "/", "%", "^", "&", "|", "~", "!", "(", ")", ",", "="}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			n, v, err := lexnum(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{kind: tnum, text: s[i : i+n], val: v})
+			i += n
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, token{kind: tident, text: strings.ToLower(s[i:j])})
+			i = j
+		default:
+			op := ""
+			for _, o := range ops {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", s[i])
+			}
+
+			toks = append(toks, token{kind: top, text: op})
+			i += len(op)
+		}
+	}
+
+	return toks, nil
+}
+
+// lexnum reads a number from the start of s, returning its length.
+func lexnum(s string) (int, *big.Rat, error) {
+	if len(s) > 2 && s[0] == '0' {
+		base := 0
+		switch s[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+
+		if base != 0 {
+			n := 2
+			for n < len(s) && digitval(s[n]) < base {
+				n++
+			}
+
+			v, ok := new(big.Int).SetString(s[2:n], base)
+			if !ok {
+				return 0, nil, fmt.Errorf("bad number %q", s[:n])
+			}
+
+			return n, new(big.Rat).SetInt(v), nil
+		}
+	}
+
+	n := 0
+	for n < len(s) && (s[n] >= '0' && s[n] <= '9' || s[n] == '.') {
+		n++
+	}
+
+	// an exponent, but not the constant e
+	if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+		j := n + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if k := j; j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+
+			if exp, err := strconv.Atoi(s[k:j]); err != nil || exp > maxExponent {
+				return 0, nil, fmt.Errorf("exponent too large")
+			}
+
+			n = j
+		}
+	}
+
+	if n > 400 {
+		return 0, nil, fmt.Errorf("number too long")
+	}
+
+	v, ok := new(big.Rat).SetString(s[:n])
+	if !ok {
+		return 0, nil, fmt.Errorf("bad number %q", s[:n])
+	}
+
+	return n, v, nil
+}
+
+func digitval(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return 99
+}
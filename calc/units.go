@@ -0,0 +1,150 @@
+package calc
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+type unit struct {
+	dim string
+	// base units per unit
+	scale *big.Rat
+	// added before scaling, for temperatures
+	offset *big.Rat
+}
+
+// base units are the metre, kilogram, kelvin, byte and second
+var unittable = []struct {
+	dim, names, scale, offset string
+}{
+	{"length", "m meter meters metre metres", "1", ""},
+	{"length", "km kilometer kilometers kilometre kilometres", "1000", ""},
+	{"length", "cm centimeter centimeters centimetre centimetres", "1/100", ""},
+	{"length", "mm millimeter millimeters millimetre millimetres", "1/1000", ""},
+	{"length", "um µm micron microns micrometer micrometers", "1/1000000", ""},
+	{"length", "nm nanometer nanometers", "1/1000000000", ""},
+	{"length", "in inch inches", "0.0254", ""},
+	{"length", "ft foot feet", "0.3048", ""},
+	{"length", "yd yard yards", "0.9144", ""},
+	{"length", "mi mile miles", "1609.344", ""},
+	{"length", "nmi nauticalmile nauticalmiles", "1852", ""},
+	{"length", "au", "149597870700", ""},
+	{"length", "ly lightyear lightyears", "9460730472580800", ""},
+	{"length", "pc parsec parsecs", "30856775814913673", ""},
+
+	{"mass", "kg kilogram kilograms kilo kilos", "1", ""},
+	{"mass", "g gram grams", "1/1000", ""},
+	{"mass", "mg milligram milligrams", "1/1000000", ""},
+	{"mass", "t tonne tonnes", "1000", ""},
+	{"mass", "lb lbs pound pounds", "0.45359237", ""},
+	{"mass", "oz ounce ounces", "0.028349523125", ""},
+	{"mass", "st stone stones", "6.35029318", ""},
+	{"mass", "ton tons shortton", "907.18474", ""},
+
+	{"temperature", "K kelvin", "1", ""},
+	{"temperature", "C °C degC celsius centigrade", "1", "273.15"},
+	{"temperature", "F °F degF fahrenheit", "5/9", "459.67"},
+	{"temperature", "R °R rankine", "5/9", ""},
+
+	{"data", "bit bits b", "1/8", ""},
+	{"data", "B byte bytes", "1", ""},
+	{"data", "kbit kb", "125", ""},
+	{"data", "Mbit Mb", "125000", ""},
+	{"data", "Gbit Gb", "125000000", ""},
+	{"data", "kB KB kilobyte kilobytes", "1000", ""},
+	{"data", "MB megabyte megabytes", "1000000", ""},
+	{"data", "GB gigabyte gigabytes", "1000000000", ""},
+	{"data", "TB terabyte terabytes", "1000000000000", ""},
+	{"data", "PB petabyte petabytes", "1000000000000000", ""},
+	{"data", "KiB kibibyte kibibytes", "1024", ""},
+	{"data", "MiB mebibyte mebibytes", "1048576", ""},
+	{"data", "GiB gibibyte gibibytes", "1073741824", ""},
+	{"data", "TiB tebibyte tebibytes", "1099511627776", ""},
+	{"data", "PiB pebibyte pebibytes", "1125899906842624", ""},
+
+	{"time", "s sec secs second seconds", "1", ""},
+	{"time", "ms millisecond milliseconds", "1/1000", ""},
+	{"time", "us µs microsecond microseconds", "1/1000000", ""},
+	{"time", "ns nanosecond nanoseconds", "1/1000000000", ""},
+	{"time", "min mins minute minutes", "60", ""},
+	{"time", "h hr hrs hour hours", "3600", ""},
+	{"time", "d day days", "86400", ""},
+	{"time", "wk week weeks", "604800", ""},
+	// average gregorian month and year
+	{"time", "mo month months", "2629746", ""},
+	{"time", "y yr yrs year years", "31556952", ""},
+	{"time", "decade decades", "315569520", ""},
+	{"time", "century centuries", "3155695200", ""},
+}
+
+var units = map[string]*unit{}
+
+func init() {
+	for _, u := range unittable {
+		un := &unit{
+			dim:    u.dim,
+			scale:  ratconst(u.scale),
+			offset: new(big.Rat),
+		}
+
+		if u.offset != "" {
+			un.offset = ratconst(u.offset)
+		}
+
+		for _, n := range strings.Fields(u.names) {
+			if _, ok := units[n]; ok {
+				panic("calc: duplicate unit " + n)
+			}
+			units[n] = un
+		}
+	}
+}
+
+// lookup finds a unit by name, ignoring case unless that's ambiguous,
+// as it is for b (bit) and B (byte).
+func lookup(name string) (*unit, error) {
+	if u, ok := units[name]; ok {
+		return u, nil
+	}
+
+	var found *unit
+
+	for n, u := range units {
+		if strings.EqualFold(n, name) {
+			if found != nil && found != u {
+				return nil, fmt.Errorf("%s is ambiguous", name)
+			}
+			found = u
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("unknown unit %s", name)
+	}
+
+	return found, nil
+}
+
+// Convert converts v from one unit to another of the same kind.
+func Convert(v *big.Rat, from, to string) (*big.Rat, error) {
+	f, err := lookup(from)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := lookup(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.dim != t.dim {
+		return nil, fmt.Errorf("can't convert %s (%s) to %s (%s)", from, f.dim, to, t.dim)
+	}
+
+	base := new(big.Rat).Add(v, f.offset)
+	base.Mul(base, f.scale)
+
+	r := new(big.Rat).Quo(base, t.scale)
+	return r.Sub(r, t.offset), nil
+}
@@ -0,0 +1,51 @@
+package calc
+
+import (
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		v, from, to, want string
+	}{
+		{"10", "mi", "km", "16.09344"},
+		{"1", "ft", "in", "12"},
+		{"100", "C", "F", "212"},
+		{"-40", "F", "C", "-40"},
+		{"0", "K", "C", "-273.15"},
+		{"1", "lb", "g", "453.59237"},
+		{"1", "GiB", "MiB", "1024"},
+		{"1", "B", "b", "8"},
+		{"100", "Mbit", "MB", "12.5"},
+		{"90", "min", "hours", "1.5"},
+		{"1", "week", "days", "7"},
+		{"2", "KM", "m", "2000"},
+	}
+
+	for _, tt := range tests {
+		r, err := Convert(ratconst(tt.v), tt.from, tt.to)
+		if err != nil {
+			t.Errorf("Convert(%s %s to %s): %s", tt.v, tt.from, tt.to, err)
+			continue
+		}
+
+		if got, _ := Format(r, 10); got != tt.want {
+			t.Errorf("Convert(%s %s to %s) = %s, want %s", tt.v, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	bad := [][2]string{
+		{"km", "kg"},
+		{"furlong", "m"},
+		{"m", "parsnips"},
+		{"mb", "kB"},
+	}
+
+	for _, b := range bad {
+		if _, err := Convert(ratconst("1"), b[0], b[1]); err == nil {
+			t.Errorf("Convert(%s to %s) succeeded, want error", b[0], b[1])
+		}
+	}
+}
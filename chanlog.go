@@ -0,0 +1,445 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kballard/goirc/irc"
+	"github.com/robfig/cron"
+)
+
+func init() {
+	RegisterModule("chanlog", func() Module {
+		return &ChanlogMod{}
+	})
+}
+
+// LogEvent is one line of a channel log.
+type LogEvent struct {
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	Channel string    `json:"channel"`
+	// message, action, notice, join, part, quit, nick, topic or kick
+	Type string `json:"type"`
+	Nick string `json:"nick"`
+	// user@host, if known
+	Mask string `json:"mask,omitempty"`
+	Text string `json:"text,omitempty"`
+	// new nick for nick, kicked nick for kick
+	Target string `json:"target,omitempty"`
+}
+
+// String formats the event like irssi does.
+func (e LogEvent) String() string {
+	ts := e.Time.Format("15:04")
+
+	switch e.Type {
+	case "message":
+		return fmt.Sprintf("%s <%s> %s", ts, e.Nick, e.Text)
+	case "action":
+		return fmt.Sprintf("%s  * %s %s", ts, e.Nick, e.Text)
+	case "notice":
+		return fmt.Sprintf("%s -%s- %s", ts, e.Nick, e.Text)
+	case "join":
+		return fmt.Sprintf("%s -!- %s [%s] has joined %s", ts, e.Nick, e.Mask, e.Channel)
+	case "part":
+		return fmt.Sprintf("%s -!- %s [%s] has left %s [%s]", ts, e.Nick, e.Mask, e.Channel, e.Text)
+	case "quit":
+		return fmt.Sprintf("%s -!- %s [%s] has quit [%s]", ts, e.Nick, e.Mask, e.Text)
+	case "nick":
+		return fmt.Sprintf("%s -!- %s is now known as %s", ts, e.Nick, e.Target)
+	case "topic":
+		return fmt.Sprintf("%s -!- %s changed the topic of %s to: %s", ts, e.Nick, e.Channel, e.Text)
+	case "kick":
+		return fmt.Sprintf("%s -!- %s was kicked from %s by %s [%s]", ts, e.Target, e.Channel, e.Nick, e.Text)
+	}
+
+	return fmt.Sprintf("%s -!- %s %s %s", ts, e.Type, e.Nick, e.Text)
+}
+
+type logfile struct {
+	day string
+	f   *os.File
+}
+
+// ChanlogMod writes daily logs for each channel under
+// dir/network/channel/yyyy-mm-dd.log (or .jsonl for the json format).
+type ChanlogMod struct {
+	b *Bot
+
+	mu       sync.Mutex
+	dir      string
+	format   string
+	channels map[string]bool
+	retain   time.Duration
+	compress time.Duration
+
+	files map[string]*logfile
+
+	// called with each event after it is logged
+	listeners []func(LogEvent)
+
+	cron *cron.Cron
+}
+
+func (m *ChanlogMod) Init(b *Bot, conn irc.SafeConn) error {
+	m.b = b
+	m.files = make(map[string]*logfile)
+
+	if err := m.configure(); err != nil {
+		return err
+	}
+
+	event := func(l irc.Line, typ, channel string) LogEvent {
+		return LogEvent{
+			Time:    b.Now(),
+			Network: b.Network,
+			Channel: channel,
+			Type:    typ,
+			Nick:    l.Src.Nick,
+			Mask:    l.Src.User + "@" + l.Src.Host,
+		}
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		e := event(l, "message", l.Args[0])
+		e.Text = l.Args[1]
+		m.log(e)
+	})
+
+	conn.AddHandler(irc.ACTION, func(c *irc.Conn, l irc.Line) {
+		e := event(l, "action", l.Dst)
+		e.Text = l.Args[0]
+		m.log(e)
+	})
+
+	conn.AddHandler("NOTICE", func(c *irc.Conn, l irc.Line) {
+		if len(l.Args) < 2 {
+			return
+		}
+		e := event(l, "notice", l.Args[0])
+		e.Text = l.Args[1]
+		m.log(e)
+	})
+
+	conn.AddHandler("JOIN", func(c *irc.Conn, l irc.Line) {
+		m.log(event(l, "join", l.Args[0]))
+	})
+
+	conn.AddHandler("PART", func(c *irc.Conn, l irc.Line) {
+		e := event(l, "part", l.Args[0])
+		if len(l.Args) > 1 {
+			e.Text = l.Args[1]
+		}
+		m.log(e)
+	})
+
+	conn.AddHandler("KICK", func(c *irc.Conn, l irc.Line) {
+		e := event(l, "kick", l.Args[0])
+		e.Target = l.Args[1]
+		if len(l.Args) > 2 {
+			e.Text = l.Args[2]
+		}
+		m.log(e)
+	})
+
+	// quits and nick changes belong to the channels the nick was in
+	b.OnLeave(func(l irc.Line, channels []string) {
+		for _, ch := range channels {
+			switch l.Command {
+			case "QUIT":
+				e := event(l, "quit", ch)
+				if len(l.Args) > 0 {
+					e.Text = l.Args[0]
+				}
+				m.log(e)
+			case "NICK":
+				e := event(l, "nick", ch)
+				e.Target = l.Args[0]
+				m.log(e)
+			}
+		}
+	})
+
+	conn.AddHandler("TOPIC", func(c *irc.Conn, l irc.Line) {
+		e := event(l, "topic", l.Args[0])
+		e.Text = l.Args[1]
+		m.log(e)
+	})
+
+	b.OnSent(func(cmd, dst, msg string) {
+		e := LogEvent{
+			Time:    b.Now(),
+			Network: b.Network,
+			Channel: dst,
+			Nick:    b.IrcConfig.Nick,
+			Text:    msg,
+		}
+
+		switch cmd {
+		case "PRIVMSG":
+			e.Type = "message"
+		case "NOTICE":
+			e.Type = "notice"
+		case irc.ACTION:
+			e.Type = "action"
+		default:
+			return
+		}
+
+		m.log(e)
+	})
+
+	m.cron = cron.New()
+	m.cron.AddFunc("@hourly", m.maintain)
+	m.cron.Start()
+
+	go m.maintain()
+
+	log.Printf("chanlog module initialized with dir %s", m.dir)
+	return nil
+}
+
+func (m *ChanlogMod) configure() error {
+	conf := m.b.Config.Search("mod", "chanlog")
+
+	dir := conf.Search("dir")
+	if dir == "" {
+		dir = filepath.Join(m.b.DataDir, "logs")
+	}
+
+	format := conf.Search("format")
+	switch format {
+	case "":
+		format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("chanlog: unknown format %q", format)
+	}
+
+	var channels map[string]bool
+	if chans := strings.Fields(conf.Search("channels")); len(chans) > 0 {
+		channels = make(map[string]bool)
+		for _, c := range chans {
+			channels[strings.ToLower(c)] = true
+		}
+	}
+
+	var (
+		retain, compress time.Duration
+		err              error
+	)
+
+	if s := conf.Search("retain"); s != "" {
+		if retain, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("chanlog: retain: %s", err)
+		}
+	}
+
+	if s := conf.Search("compress"); s != "" {
+		if compress, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("chanlog: compress: %s", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dir, m.format, m.channels = dir, format, channels
+	m.retain, m.compress = retain, compress
+
+	// reopen logs in case the format or directory changed
+	for k, lf := range m.files {
+		lf.f.Close()
+		delete(m.files, k)
+	}
+
+	return nil
+}
+
+func (m *ChanlogMod) Reload() error {
+	return m.configure()
+}
+
+func (m *ChanlogMod) Call(args ...string) error {
+	return nil
+}
+
+// Listen registers fn to be called with every event the module logs.
+func (m *ChanlogMod) Listen(fn func(LogEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.listeners = append(m.listeners, fn)
+}
+
+// logname makes a network or channel name safe to use as a file name.
+func logname(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+
+	return s
+}
+
+func (m *ChanlogMod) log(e LogEvent) {
+	if !IsChannel(e.Channel) {
+		return
+	}
+
+	m.mu.Lock()
+
+	if m.channels != nil && !m.channels[strings.ToLower(e.Channel)] {
+		m.mu.Unlock()
+		return
+	}
+
+	if err := m.write(e); err != nil {
+		log.Printf("chanlog: %s: %s", e.Channel, err)
+	}
+
+	listeners := m.listeners
+	m.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(e)
+	}
+}
+
+// write an event to its log file. m.mu must be held.
+func (m *ChanlogMod) write(e LogEvent) error {
+	day := e.Time.Format("2006-01-02")
+	key := logname(e.Network) + "/" + logname(e.Channel)
+
+	lf, ok := m.files[key]
+	if ok && lf.day != day {
+		lf.f.Close()
+		delete(m.files, key)
+		ok = false
+	}
+
+	if !ok {
+		ext := ".log"
+		if m.format == "json" {
+			ext = ".jsonl"
+		}
+
+		dir := filepath.Join(m.dir, logname(e.Network), logname(e.Channel))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, day+ext), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+
+		lf = &logfile{day: day, f: f}
+		m.files[key] = lf
+
+		if m.format == "text" {
+			fmt.Fprintf(f, "--- Log opened %s\n", e.Time.Format("Mon Jan 02 15:04:05 2006"))
+		}
+	}
+
+	if m.format == "json" {
+		return json.NewEncoder(lf.f).Encode(e)
+	}
+
+	_, err := fmt.Fprintln(lf.f, e)
+	return err
+}
+
+// maintain compresses and removes old logs according to the configured
+// compress= and retain= policies.
+func (m *ChanlogMod) maintain() {
+	m.mu.Lock()
+	dir, retain, compress := m.dir, m.retain, m.compress
+	m.mu.Unlock()
+
+	if retain <= 0 && compress <= 0 {
+		return
+	}
+
+	now := m.b.Now()
+	today := now.Format("2006-01-02")
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		name := fi.Name()
+		if len(name) < 10 {
+			return nil
+		}
+
+		day, err := time.ParseInLocation("2006-01-02", name[:10], now.Location())
+		if err != nil || name[:10] == today {
+			return nil
+		}
+
+		// age of the end of the day the log covers
+		age := now.Sub(day.AddDate(0, 0, 1))
+
+		switch {
+		case retain > 0 && age > retain:
+			if err := os.Remove(path); err != nil {
+				log.Printf("chanlog: %s", err)
+			}
+		case compress > 0 && age > compress && !strings.HasSuffix(name, ".gz"):
+			if err := gzipfile(path); err != nil {
+				log.Printf("chanlog: compress %s: %s", path, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// gzipfile replaces path with path.gz.
+func gzipfile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
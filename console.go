@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const consoleHelp = `Run glenda with its usual config and modules, connected to a local fake irc
+server driven from the terminal. Lines typed are sent to the bot as PRIVMSGs
+from the console user, and the bot's output is printed back.
+
+Commands:
+  /join #chan          join a channel and make it current
+  /part [reason]       leave the current channel
+  /nick newnick        change the console user's nick
+  /me text             send an action to the current channel
+  /msg target text     send a PRIVMSG to a nick or channel
+  /notice target text  send a NOTICE to a nick or channel
+  /topic text          set the topic of the current channel
+  /kick nick [reason]  kick someone from the current channel
+  /quit [reason]       quit the console user
+  /raw line            send a raw line to the bot
+  /exit                disconnect the bot and exit
+
+A line starting with // is sent as-is with the leading / removed.`
+
+var consoleCmd = &cobra.Command{
+	Use:   "console",
+	Short: "run glenda against a terminal instead of an irc server",
+	Long:  consoleHelp,
+	RunE:  runConsole,
+}
+
+var (
+	consoleNick    string
+	consoleUser    string
+	consoleHost    string
+	consoleChannel string
+	consoleRaw     bool
+)
+
+func init() {
+	nick := os.Getenv("USER")
+	if nick == "" {
+		nick = "user"
+	}
+
+	f := consoleCmd.Flags()
+	f.StringVar(&consoleNick, "nick", nick, "nick of the console user")
+	f.StringVar(&consoleUser, "user", nick, "username of the console user")
+	f.StringVar(&consoleHost, "host", "localhost", "hostname of the console user")
+	f.StringVar(&consoleChannel, "channel", "", "channel to talk in (default: first configured channel)")
+	f.BoolVar(&consoleRaw, "raw", false, "print raw lines the bot sends that the console doesn't understand")
+
+	root.AddCommand(consoleCmd)
+}
+
+type console struct {
+	srv *ircserver
+	out io.Writer
+
+	// the bot's nick
+	bot string
+
+	// the console user
+	nick, user, host string
+	channel          string
+	raw              bool
+}
+
+func runConsole(cmd *cobra.Command, args []string) error {
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	srv, err := newircserver("console.glenda")
+	if err != nil {
+		return err
+	}
+
+	defer srv.Close()
+
+	if err := srv.redirect(&bot.IrcConfig); err != nil {
+		return err
+	}
+
+	c := &console{
+		srv:     srv,
+		out:     os.Stdout,
+		nick:    consoleNick,
+		user:    consoleUser,
+		host:    consoleHost,
+		channel: consoleChannel,
+		raw:     consoleRaw,
+	}
+
+	if c.channel == "" {
+		c.channel = "#glenda"
+		if len(bot.Channels) > 0 && bot.Channels[0] != "" {
+			c.channel = bot.Channels[0]
+		}
+	}
+
+	go c.serve()
+	go c.input(os.Stdin)
+
+	return bot.Run()
+}
+
+// hostmask of the console user
+func (c *console) who() string {
+	return fmt.Sprintf("%s!%s@%s", c.nick, c.user, c.host)
+}
+
+func (c *console) printf(format string, args ...interface{}) {
+	fmt.Fprintf(c.out, format+"\n", args...)
+}
+
+// serve registers the bot and prints whatever it says.
+func (c *console) serve() {
+	if err := c.srv.accept(); err != nil {
+		c.printf("console: accept failed: %s", err)
+		return
+	}
+
+	registered := false
+	gotuser := false
+
+	for line := range c.srv.lines {
+		m := parseircmsg(line)
+
+		switch m.cmd {
+		case "NICK":
+			if registered {
+				c.srv.Sendf(":%s NICK :%s", c.botmask(), m.param(0))
+				c.printf("* %s is now known as %s", c.bot, m.param(0))
+			}
+			c.bot = m.param(0)
+		case "USER":
+			gotuser = true
+		case "PING":
+			c.srv.Sendf(":%s PONG %s :%s", c.srv.name, c.srv.name, m.param(0))
+		case "JOIN":
+			for _, ch := range strings.Split(m.param(0), ",") {
+				c.srv.Sendf(":%s JOIN %s", c.botmask(), ch)
+				c.printf("[%s] * %s has joined", ch, c.bot)
+			}
+		case "PART":
+			for _, ch := range strings.Split(m.param(0), ",") {
+				c.srv.Sendf(":%s PART %s :%s", c.botmask(), ch, m.param(1))
+				c.printf("[%s] * %s has left (%s)", ch, c.bot, m.param(1))
+			}
+		case "PRIVMSG":
+			text := m.param(1)
+			if strings.HasPrefix(text, "\x01ACTION ") {
+				text = strings.Trim(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+				c.printf("[%s] * %s %s", m.param(0), c.bot, Ansi(text))
+			} else {
+				c.printf("[%s] <%s> %s", m.param(0), c.bot, Ansi(text))
+			}
+		case "NOTICE":
+			c.printf("[%s] -%s- %s", m.param(0), c.bot, Ansi(m.param(1)))
+		case "QUIT":
+			c.printf("* %s has quit (%s)", c.bot, m.param(0))
+			c.srv.Close()
+		default:
+			if c.raw {
+				c.printf("-> %s", line)
+			}
+		}
+
+		if !registered && gotuser && c.bot != "" {
+			c.srv.Welcome(c.bot)
+			registered = true
+		}
+	}
+
+	c.printf("console: bot disconnected")
+}
+
+func (c *console) botmask() string {
+	return fmt.Sprintf("%s!%s@%s", c.bot, c.bot, c.srv.name)
+}
+
+// input turns terminal lines into irc traffic from the console user.
+func (c *console) input(r io.Reader) {
+	scan := bufio.NewScanner(r)
+
+	for scan.Scan() {
+		line := scan.Text()
+		if line == "" {
+			continue
+		}
+
+		if err := c.command(line); err != nil {
+			if err == io.EOF {
+				break
+			}
+			c.printf("console: %s", err)
+		}
+	}
+
+	c.srv.Close()
+}
+
+func (c *console) command(line string) error {
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		if strings.HasPrefix(line, "/") {
+			line = line[1:]
+		}
+		c.srv.Sendf(":%s PRIVMSG %s :%s", c.who(), c.channel, line)
+		return nil
+	}
+
+	args := strings.SplitN(line[1:], " ", 2)
+	cmd, rest := strings.ToLower(args[0]), ""
+	if len(args) == 2 {
+		rest = strings.TrimSpace(args[1])
+	}
+
+	// split off the first word of rest
+	word := func() (string, string) {
+		s := strings.SplitN(rest, " ", 2)
+		if len(s) == 2 {
+			return s[0], strings.TrimSpace(s[1])
+		}
+		return s[0], ""
+	}
+
+	switch cmd {
+	case "join":
+		if rest == "" {
+			return fmt.Errorf("usage: /join #chan")
+		}
+		ch, _ := word()
+		c.srv.Sendf(":%s JOIN %s", c.who(), ch)
+		c.channel = ch
+	case "part":
+		c.srv.Sendf(":%s PART %s :%s", c.who(), c.channel, rest)
+	case "nick":
+		if rest == "" {
+			return fmt.Errorf("usage: /nick newnick")
+		}
+		nick, _ := word()
+		c.srv.Sendf(":%s NICK :%s", c.who(), nick)
+		c.nick = nick
+	case "me":
+		c.srv.Sendf(":%s PRIVMSG %s :\x01ACTION %s\x01", c.who(), c.channel, rest)
+	case "msg", "notice":
+		to, text := word()
+		if to == "" || text == "" {
+			return fmt.Errorf("usage: /%s target text", cmd)
+		}
+		c.srv.Sendf(":%s %s %s :%s", c.who(), strings.ToUpper(cmd), to, text)
+	case "topic":
+		c.srv.Sendf(":%s TOPIC %s :%s", c.who(), c.channel, rest)
+	case "kick":
+		nick, reason := word()
+		if nick == "" {
+			return fmt.Errorf("usage: /kick nick [reason]")
+		}
+		if reason == "" {
+			reason = c.nick
+		}
+		c.srv.Sendf(":%s KICK %s %s :%s", c.who(), c.channel, nick, reason)
+	case "quit":
+		c.srv.Sendf(":%s QUIT :%s", c.who(), rest)
+	case "raw":
+		c.srv.Send(rest)
+	case "exit":
+		return io.EOF
+	case "help":
+		c.printf("%s", consoleHelp)
+	default:
+		return fmt.Errorf("unknown command /%s, try /help", cmd)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mischief/glenda/dice"
+
+	"github.com/kballard/goirc/irc"
+)
+
+func init() {
+	RegisterModule("dice", func() Module {
+		return &DiceMod{}
+	})
+}
+
+const diceUsage = "usage: roll [-v] 4d6kh3+2[, ...]"
+
+type DiceMod struct {
+	limits dice.Limits
+}
+
+func (m *DiceMod) Init(b *Bot, conn irc.SafeConn) error {
+	conf := b.Config.Search("mod", "dice")
+
+	m.limits = dice.Limits{
+		Dice:  confint(conf, "maxdice", dice.DefaultLimits.Dice),
+		Sides: confint(conf, "maxsides", dice.DefaultLimits.Sides),
+		Rolls: confint(conf, "maxrolls", dice.DefaultLimits.Rolls),
+	}
+
+	roll := func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		verbose := false
+		if len(args) > 0 && (args[0] == "-v" || args[0] == "--verbose") {
+			verbose, args = true, args[1:]
+		}
+
+		expr := strings.Join(args, " ")
+		if strings.TrimSpace(expr) == "" {
+			return fmt.Errorf(diceUsage)
+		}
+
+		r := &dice.Roller{Limits: m.limits}
+
+		res, err := r.Roll(expr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", cmd, err)
+		}
+
+		var out []string
+		for _, rs := range res {
+			out = append(out, diceresult(rs, verbose))
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("%s: %s", l.Src.Nick, strings.Join(out, "; ")))
+		return nil
+	}
+
+	b.HookLine("roll", roll)
+	b.HookLine("dice", roll)
+
+	log.Printf("dice module initialized")
+	return nil
+}
+
+func (m *DiceMod) Reload() error {
+	return nil
+}
+
+func (m *DiceMod) Call(args ...string) error {
+	return nil
+}
+
+func diceresult(rs *dice.Result, verbose bool) string {
+	total := strconv.Itoa(rs.Total)
+
+	// dice counted against a target give successes, not a sum
+	for _, g := range rs.Groups {
+		if g.Target {
+			total += " successes"
+			if rs.Total == 1 {
+				total = "1 success"
+			}
+			break
+		}
+	}
+
+	if !verbose {
+		return fmt.Sprintf("%s = %s", rs.Expr, total)
+	}
+
+	return fmt.Sprintf("%s: %s = %s", rs.Expr, rs.Verbose(diceface), total)
+}
+
+// diceface highlights crits and fumbles, and greys out dice that don't count.
+func diceface(g *dice.Group, d dice.Die) string {
+	s := strconv.Itoa(d.Value)
+	if g.Fudge {
+		s = [...]string{"-", "0", "+"}[d.Value+1]
+	}
+
+	if d.Exploded {
+		s = "!" + s
+	}
+
+	switch {
+	case d.Dropped || d.Rerolled:
+		return Colored(s, "grey")
+	case g.Target && d.Success:
+		return Colored(s, "green")
+	case g.Target && d.Failure:
+		return Colored(s, "red")
+	case !g.Target && g.Crit(d):
+		return Colored(s, "green")
+	case !g.Target && g.Fumble(d):
+		return Colored(s, "red")
+	}
+
+	return s
+}
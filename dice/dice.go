@@ -0,0 +1,829 @@
+// Package dice parses and rolls dice expressions like those used in
+// tabletop role playing games.
+//
+// An expression is made of numbers, dice, + - * / and parentheses. Dice are
+// written NdS, where N is the number of dice (default 1) and S is the number
+// of sides, % for 100 or F for fudge dice (-1, 0 or +1). Dice may be followed
+// by modifiers:
+//
+//	kh3 k3  keep the highest 3 dice
+//	kl3     keep the lowest 3 dice
+//	dh1     drop the highest die
+//	dl1 d1  drop the lowest die
+//	!  !>5  roll another die for each die that rolls the highest value, or >= 5
+//	r1 r<2  reroll dice that roll 1, or <= 2, until they don't
+//	ro1     reroll dice that roll 1, once
+//	>5 =6   count the dice that roll >= 5, or 6, instead of adding them up
+//	f1 f<2  with a target, subtract the dice that roll 1, or <= 2
+//
+// Several expressions may be rolled at once by separating them with commas.
+package dice
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits keeps people from rolling a million dice.
+type Limits struct {
+	// most dice rolled in total, counting explosions and rerolls
+	Dice int
+	// most sides a die can have
+	Sides int
+	// most comma separated expressions
+	Rolls int
+}
+
+var DefaultLimits = Limits{
+	Dice:  500,
+	Sides: 1000,
+	Rolls: 10,
+}
+
+// largest number an expression may contain or produce
+const maxValue = 1000000000
+
+// how many times a single die may explode or be rerolled
+const maxChain = 100
+
+// Roller rolls dice expressions.
+type Roller struct {
+	// returns a random number in [0, n); math/rand's if nil
+	Intn func(n int) int
+
+	Limits Limits
+
+	// dice left to roll in this call to Roll
+	budget int
+}
+
+// Roll parses and rolls each comma separated expression in s.
+func (r *Roller) Roll(s string) ([]*Result, error) {
+	lim := r.Limits
+	if lim == (Limits{}) {
+		lim = DefaultLimits
+	}
+
+	parts := strings.Split(s, ",")
+	if len(parts) > lim.Rolls {
+		return nil, fmt.Errorf("at most %d rolls at once", lim.Rolls)
+	}
+
+	r.budget = lim.Dice
+
+	var results []*Result
+
+	for _, p := range parts {
+		e, err := Parse(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := e.check(lim); err != nil {
+			return nil, err
+		}
+
+		res, err := r.eval(e)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+func (r *Roller) intn(n int) int {
+	if r.Intn != nil {
+		return r.Intn(n)
+	}
+
+	return rand.Intn(n)
+}
+
+// Result is a rolled expression.
+type Result struct {
+	Expr   *Expr
+	Total  int
+	Groups []*Group
+}
+
+// Group is the dice rolled for one NdS in an expression.
+type Group struct {
+	Sides int
+	Fudge bool
+	// whether the dice were counted against a target rather than added
+	Target bool
+	Dice   []Die
+}
+
+// Die is a single rolled die.
+type Die struct {
+	Value int
+	// not counted, because of keep/drop
+	Dropped bool
+	// replaced by the die after it
+	Rerolled bool
+	// rolled because the die before it exploded
+	Exploded bool
+	// met the target or failure number
+	Success, Failure bool
+}
+
+// Crit reports whether d rolled the highest value it could.
+func (g *Group) Crit(d Die) bool {
+	if g.Fudge {
+		return d.Value == 1
+	}
+	return d.Value == g.Sides
+}
+
+// Fumble reports whether d rolled the lowest value it could.
+func (g *Group) Fumble(d Die) bool {
+	if g.Fudge {
+		return d.Value == -1
+	}
+	return d.Value == 1
+}
+
+// Verbose returns the expression with each group of dice replaced by the
+// individual rolls, each formatted with die.
+func (res *Result) Verbose(die func(g *Group, d Die) string) string {
+	i := 0
+
+	var walk func(n node) string
+	walk = func(n node) string {
+		switch n := n.(type) {
+		case *binop:
+			return fmt.Sprintf("%s %c %s", walk(n.l), n.op, walk(n.r))
+		case *neg:
+			return "-" + walk(n.n)
+		case *paren:
+			return "(" + walk(n.n) + ")"
+		case *dice:
+			g := res.Groups[i]
+			i++
+
+			var ds []string
+			for _, d := range g.Dice {
+				ds = append(ds, die(g, d))
+			}
+
+			return "[" + strings.Join(ds, ", ") + "]"
+		}
+
+		return n.String()
+	}
+
+	return walk(res.Expr.n)
+}
+
+func (r *Roller) eval(e *Expr) (*Result, error) {
+	res := &Result{Expr: e}
+
+	var walk func(n node) (int, error)
+	walk = func(n node) (int, error) {
+		var v int
+
+		switch n := n.(type) {
+		case num:
+			v = int(n)
+		case *paren:
+			return walk(n.n)
+		case *neg:
+			x, err := walk(n.n)
+			if err != nil {
+				return 0, err
+			}
+			v = -x
+		case *binop:
+			a, err := walk(n.l)
+			if err != nil {
+				return 0, err
+			}
+
+			b, err := walk(n.r)
+			if err != nil {
+				return 0, err
+			}
+
+			switch n.op {
+			case '+':
+				v = a + b
+			case '-':
+				v = a - b
+			case '*':
+				if a != 0 && (b > maxValue/abs(a) || -b > maxValue/abs(a)) {
+					return 0, fmt.Errorf("number too large")
+				}
+				v = a * b
+			case '/':
+				if b == 0 {
+					return 0, fmt.Errorf("division by zero")
+				}
+				v = a / b
+			}
+		case *dice:
+			g, err := r.roll(n)
+			if err != nil {
+				return 0, err
+			}
+
+			res.Groups = append(res.Groups, g)
+
+			for _, d := range g.Dice {
+				switch {
+				case d.Dropped || d.Rerolled:
+				case g.Target && d.Success:
+					v++
+				case g.Target && d.Failure:
+					v--
+				case !g.Target:
+					v += d.Value
+				}
+			}
+		}
+
+		if v > maxValue || v < -maxValue {
+			return 0, fmt.Errorf("number too large")
+		}
+
+		return v, nil
+	}
+
+	total, err := walk(e.n)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Total = total
+	return res, nil
+}
+
+func (r *Roller) die(n *dice) (int, error) {
+	if r.budget <= 0 {
+		return 0, fmt.Errorf("too many dice")
+	}
+
+	r.budget--
+
+	if n.fudge {
+		return r.intn(3) - 1, nil
+	}
+
+	return r.intn(n.sides) + 1, nil
+}
+
+func (r *Roller) roll(n *dice) (*Group, error) {
+	g := &Group{
+		Sides:  n.sides,
+		Fudge:  n.fudge,
+		Target: n.success != nil,
+	}
+
+	for i := 0; i < n.count; i++ {
+		v, err := r.die(n)
+		if err != nil {
+			return nil, err
+		}
+
+		exploded := false
+
+		for chain := 0; ; chain++ {
+			if n.reroll != nil && n.reroll.match(v) && chain < maxChain {
+				g.Dice = append(g.Dice, Die{Value: v, Exploded: exploded, Rerolled: true})
+
+				if v, err = r.die(n); err != nil {
+					return nil, err
+				}
+
+				if n.rerollonce {
+					g.Dice = append(g.Dice, Die{Value: v, Exploded: exploded})
+					if !(n.explode != nil && n.explode.match(v)) {
+						break
+					}
+				} else {
+					continue
+				}
+			} else {
+				g.Dice = append(g.Dice, Die{Value: v, Exploded: exploded})
+			}
+
+			if n.explode == nil || !n.explode.match(v) || chain >= maxChain {
+				break
+			}
+
+			if v, err = r.die(n); err != nil {
+				return nil, err
+			}
+
+			exploded = true
+		}
+	}
+
+	// keep and drop apply to the dice that weren't rerolled
+	var live []int
+	for i, d := range g.Dice {
+		if !d.Rerolled {
+			live = append(live, i)
+		}
+	}
+
+	sort.Stable(byValue{g.Dice, live})
+
+	var drop []int
+
+	switch n.keep {
+	case "kh":
+		if n.keepn < len(live) {
+			drop = live[:len(live)-n.keepn]
+		}
+	case "kl":
+		if n.keepn < len(live) {
+			drop = live[n.keepn:]
+		}
+	case "dh":
+		drop = live[len(live)-min(n.keepn, len(live)):]
+	case "dl":
+		drop = live[:min(n.keepn, len(live))]
+	}
+
+	for _, i := range drop {
+		g.Dice[i].Dropped = true
+	}
+
+	if n.success != nil {
+		for i := range g.Dice {
+			d := &g.Dice[i]
+			if d.Dropped || d.Rerolled {
+				continue
+			}
+			d.Success = n.success.match(d.Value)
+			d.Failure = !d.Success && n.failure != nil && n.failure.match(d.Value)
+		}
+	}
+
+	return g, nil
+}
+
+// byValue sorts the indexes of dice by their value.
+type byValue struct {
+	dice []Die
+	idx  []int
+}
+
+func (s byValue) Len() int           { return len(s.idx) }
+func (s byValue) Swap(i, j int)      { s.idx[i], s.idx[j] = s.idx[j], s.idx[i] }
+func (s byValue) Less(i, j int) bool { return s.dice[s.idx[i]].Value < s.dice[s.idx[j]].Value }
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Expr is a parsed dice expression.
+type Expr struct {
+	n node
+}
+
+func (e *Expr) String() string {
+	return e.n.String()
+}
+
+// check that e stays within lim before rolling anything
+func (e *Expr) check(lim Limits) error {
+	var walk func(n node) error
+	walk = func(n node) error {
+		switch n := n.(type) {
+		case *binop:
+			if err := walk(n.l); err != nil {
+				return err
+			}
+			return walk(n.r)
+		case *neg:
+			return walk(n.n)
+		case *paren:
+			return walk(n.n)
+		case *dice:
+			if n.count > lim.Dice {
+				return fmt.Errorf("at most %d dice", lim.Dice)
+			}
+			if n.sides > lim.Sides {
+				return fmt.Errorf("at most %d sides", lim.Sides)
+			}
+		}
+		return nil
+	}
+
+	return walk(e.n)
+}
+
+type node interface {
+	String() string
+}
+
+type num int
+
+func (n num) String() string { return strconv.Itoa(int(n)) }
+
+type binop struct {
+	op   byte
+	l, r node
+}
+
+func (b *binop) String() string { return fmt.Sprintf("%s%c%s", b.l, b.op, b.r) }
+
+type neg struct {
+	n node
+}
+
+func (n *neg) String() string { return "-" + n.n.String() }
+
+type paren struct {
+	n node
+}
+
+func (p *paren) String() string { return "(" + p.n.String() + ")" }
+
+// cmp is a comparison against a die, for explode, reroll and targets.
+type cmp struct {
+	// '>' for >=, '<' for <= or '='
+	op byte
+	n  int
+}
+
+func (c *cmp) match(v int) bool {
+	switch c.op {
+	case '>':
+		return v >= c.n
+	case '<':
+		return v <= c.n
+	}
+	return v == c.n
+}
+
+func (c *cmp) String() string {
+	if c.op == '=' {
+		return strconv.Itoa(c.n)
+	}
+	return fmt.Sprintf("%c%d", c.op, c.n)
+}
+
+type dice struct {
+	count, sides int
+	fudge        bool
+
+	// kh, kl, dh or dl
+	keep  string
+	keepn int
+
+	explode    *cmp
+	reroll     *cmp
+	rerollonce bool
+	success    *cmp
+	failure    *cmp
+}
+
+func (d *dice) String() string {
+	s := fmt.Sprintf("%dd%d", d.count, d.sides)
+	if d.fudge {
+		s = fmt.Sprintf("%ddF", d.count)
+	}
+
+	if d.keep != "" {
+		s += fmt.Sprintf("%s%d", d.keep, d.keepn)
+	}
+
+	if d.explode != nil {
+		s += "!"
+		if *d.explode != d.explodedefault() {
+			s += d.explode.String()
+		}
+	}
+
+	if d.reroll != nil {
+		s += "r"
+		if d.rerollonce {
+			s += "o"
+		}
+		s += d.reroll.String()
+	}
+
+	if d.success != nil {
+		if d.success.op == '=' {
+			s += "="
+		}
+		s += d.success.String()
+	}
+
+	if d.failure != nil {
+		s += "f" + d.failure.String()
+	}
+
+	return s
+}
+
+// dice explode on their highest face unless told otherwise
+func (d *dice) explodedefault() cmp {
+	if d.fudge {
+		return cmp{'=', 1}
+	}
+	return cmp{'=', d.sides}
+}
+
+// Parse parses a single dice expression.
+func Parse(s string) (*Expr, error) {
+	p := &parser{s: strings.Replace(s, " ", "", -1)}
+
+	if p.s == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+
+	return &Expr{n}, nil
+}
+
+type parser struct {
+	s   string
+	pos int
+	// nesting depth, to keep ((((((...)))))) from blowing the stack
+	depth int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at column %d", fmt.Sprintf(format, args...), p.pos+1)
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) accept(prefix string) bool {
+	if strings.HasPrefix(strings.ToLower(p.s[p.pos:]), prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func isdigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *parser) number() (int, error) {
+	start := p.pos
+	for isdigit(p.peek()) {
+		p.pos++
+	}
+
+	if start == p.pos {
+		return 0, p.errorf("expected a number")
+	}
+
+	n, err := strconv.Atoi(p.s[start:p.pos])
+	if err != nil || n > maxValue {
+		return 0, p.errorf("number too large")
+	}
+
+	return n, nil
+}
+
+// expr := term (('+'|'-') term)*
+func (p *parser) expr() (node, error) {
+	n, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for c := p.peek(); c == '+' || c == '-'; c = p.peek() {
+		p.pos++
+
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+
+		n = &binop{c, n, r}
+	}
+
+	return n, nil
+}
+
+// term := factor (('*'|'/') factor)*
+func (p *parser) term() (node, error) {
+	n, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+
+	for c := p.peek(); c == '*' || c == '/'; c = p.peek() {
+		p.pos++
+
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+
+		n = &binop{c, n, r}
+	}
+
+	return n, nil
+}
+
+// factor := '-' factor | '(' expr ')' | number | [number] dice
+func (p *parser) factor() (node, error) {
+	c := p.peek()
+
+	switch {
+	case c == '-':
+		p.pos++
+		n, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &neg{n}, nil
+	case c == '(':
+		p.pos++
+		p.depth++
+		if p.depth > 20 {
+			return nil, p.errorf("too many parentheses")
+		}
+
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+
+		p.pos++
+		p.depth--
+		return &paren{n}, nil
+	case isdigit(c):
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+
+		if c := p.peek(); c == 'd' || c == 'D' {
+			return p.dice(n)
+		}
+
+		return num(n), nil
+	case c == 'd' || c == 'D':
+		return p.dice(1)
+	case c == 0:
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	return nil, p.errorf("unexpected %q", c)
+}
+
+// dice := 'd' (number | '%' | 'F') modifier*
+func (p *parser) dice(count int) (node, error) {
+	p.pos++
+
+	d := &dice{count: count}
+
+	switch c := p.peek(); {
+	case c == '%':
+		p.pos++
+		d.sides = 100
+	case c == 'F' || c == 'f':
+		p.pos++
+		d.fudge = true
+		d.sides = 3
+	default:
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		d.sides = n
+	}
+
+	if d.count < 1 || d.sides < 1 {
+		return nil, p.errorf("dice need at least one side")
+	}
+
+	for {
+		var err error
+
+		switch {
+		case p.accept("kh"), p.accept("kl"), p.accept("dh"), p.accept("dl"):
+			if d.keep != "" {
+				return nil, p.errorf("only one keep or drop allowed")
+			}
+			d.keep = strings.ToLower(p.s[p.pos-2 : p.pos])
+			d.keepn, err = p.count()
+		case p.peek() == 'k' || p.peek() == 'K':
+			p.pos++
+			if d.keep != "" {
+				return nil, p.errorf("only one keep or drop allowed")
+			}
+			d.keep = "kh"
+			d.keepn, err = p.count()
+		case (p.peek() == 'd' || p.peek() == 'D') && p.pos+1 < len(p.s) && isdigit(p.s[p.pos+1]):
+			p.pos++
+			if d.keep != "" {
+				return nil, p.errorf("only one keep or drop allowed")
+			}
+			d.keep = "dl"
+			d.keepn, err = p.count()
+		case p.accept("!"):
+			if d.explode != nil {
+				return nil, p.errorf("only one explode allowed")
+			}
+			def := d.explodedefault()
+			d.explode = &def
+			if c := p.peek(); isdigit(c) || c == '>' || c == '<' || c == '=' {
+				if d.explode, err = p.cmp(); err != nil {
+					return nil, err
+				}
+			}
+			if d.explode.op == '<' || (!d.fudge && d.explode.op == '>' && d.explode.n <= 1) {
+				return nil, p.errorf("dice would explode forever")
+			}
+		case p.accept("r"):
+			if d.reroll != nil {
+				return nil, p.errorf("only one reroll allowed")
+			}
+			d.rerollonce = p.accept("o")
+			d.reroll, err = p.cmp()
+		case p.peek() == '>' || p.peek() == '<' || p.peek() == '=':
+			if d.success != nil {
+				return nil, p.errorf("only one target allowed")
+			}
+			d.success, err = p.cmp()
+		case d.success != nil && d.failure == nil && p.accept("f"):
+			d.failure, err = p.cmp()
+		default:
+			return d, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// count is the number after keep or drop, 1 if there isn't one.
+func (p *parser) count() (int, error) {
+	if !isdigit(p.peek()) {
+		return 1, nil
+	}
+	return p.number()
+}
+
+func (p *parser) cmp() (*cmp, error) {
+	c := &cmp{op: '='}
+
+	switch p.peek() {
+	case '>', '<', '=':
+		c.op = p.peek()
+		p.pos++
+	}
+
+	neg := false
+	if p.peek() == '-' {
+		neg = true
+		p.pos++
+	}
+
+	n, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+
+	if neg {
+		n = -n
+	}
+
+	c.n = n
+	return c, nil
+}
@@ -0,0 +1,191 @@
+package dice
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// rolls returns an Intn which gives back the die faces in order. Fudge
+// dice are rolled as d3, so 1, 2, 3 mean -1, 0, +1.
+func rolls(faces ...int) func(int) int {
+	return func(n int) int {
+		if len(faces) == 0 {
+			panic("out of rolls")
+		}
+		f := faces[0]
+		faces = faces[1:]
+		return f - 1
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"d20", "1d20"},
+		{"4d6kh3+2", "4d6kh3+2"},
+		{"4d6k3", "4d6kh3"},
+		{"4d6d1", "4d6dl1"},
+		{"2d20kl1 - 1", "2d20kl1-1"},
+		{"d%", "1d100"},
+		{"4dF", "4dF"},
+		{"3d6!", "3d6!"},
+		{"3d6!6", "3d6!"},
+		{"5d10!>9", "5d10!>9"},
+		{"2d6r1", "2d6r1"},
+		{"2d6ro<2", "2d6ro<2"},
+		{"6d10>8f1", "6d10>8f1"},
+		{"6d6=6", "6d6=6"},
+		{"(1d4+1)*2", "(1d4+1)*2"},
+		{"-d6", "-1d6"},
+	}
+
+	for _, tt := range tests {
+		e, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tt.in, err)
+			continue
+		}
+
+		if got := e.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"d",
+		"0d6",
+		"2d0",
+		"1d6+",
+		"(1d6",
+		"1d6)",
+		"4d6kh3kl1",
+		"1d6!<3",
+		"1d6!>1",
+		"1d6 x",
+		"99999999999d6",
+		strings.Repeat("(", 30) + "1" + strings.Repeat(")", 30),
+	}
+
+	for _, s := range bad {
+		if e, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) = %s, want error", s, e)
+		}
+	}
+}
+
+func TestRoll(t *testing.T) {
+	tests := []struct {
+		expr  string
+		faces []int
+		total int
+	}{
+		{"1d20", []int{17}, 17},
+		{"4d6kh3+2", []int{6, 1, 5, 3}, 16},
+		{"4d6kl1", []int{6, 1, 5, 3}, 1},
+		{"4d6dh1", []int{6, 1, 5, 3}, 9},
+		{"4d6d1", []int{6, 1, 5, 3}, 14},
+		{"3d6!", []int{6, 6, 2, 3, 4}, 21},
+		{"2d6r1", []int{1, 1, 4, 5}, 9},
+		{"2d6ro1", []int{1, 1, 5}, 6},
+		{"6d10>8f1", []int{10, 9, 1, 5, 8, 1}, 1},
+		{"4dF", []int{1, 2, 3, 3}, 1},
+		{"(1d4+1)*2", []int{3}, 8},
+		{"10/3", nil, 3},
+		{"-1d6+1", []int{4}, -3},
+	}
+
+	for _, tt := range tests {
+		r := &Roller{Intn: rolls(tt.faces...)}
+
+		res, err := r.Roll(tt.expr)
+		if err != nil {
+			t.Errorf("Roll(%q): %s", tt.expr, err)
+			continue
+		}
+
+		if res[0].Total != tt.total {
+			t.Errorf("Roll(%q) = %d, want %d", tt.expr, res[0].Total, tt.total)
+		}
+	}
+}
+
+func TestRollMany(t *testing.T) {
+	r := &Roller{Intn: rolls(1, 2, 3)}
+
+	res, err := r.Roll("d6, d6 ,d6")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 3 {
+		t.Fatalf("got %d results, want 3", len(res))
+	}
+
+	for i, want := range []int{1, 2, 3} {
+		if res[i].Total != want {
+			t.Errorf("roll %d = %d, want %d", i, res[i].Total, want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	r := &Roller{Limits: Limits{Dice: 10, Sides: 100, Rolls: 2}}
+
+	bad := []string{
+		"11d6",
+		"1d101",
+		"d6,d6,d6",
+		"6d6+6d6",
+		"1d6*1000000000*1000000000",
+		"1d2!>2r1",
+		"1/0",
+	}
+
+	for _, s := range bad {
+		if _, err := r.Roll(s); err == nil {
+			t.Errorf("Roll(%q) succeeded, want error", s)
+		}
+	}
+
+	// exploding forever runs out of dice instead of hanging
+	r = &Roller{Intn: func(n int) int { return n - 1 }, Limits: Limits{Dice: 50, Sides: 6, Rolls: 1}}
+	if _, err := r.Roll("1d6!"); err == nil {
+		t.Errorf("endless explosion succeeded, want error")
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	r := &Roller{Intn: rolls(6, 1, 5, 3, 2)}
+
+	res, err := r.Roll("4d6kh3 + 1d4 * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := res[0].Verbose(func(g *Group, d Die) string {
+		s := fmt.Sprint(d.Value)
+		switch {
+		case d.Dropped:
+			s = "~" + s
+		case g.Crit(d):
+			s += "!"
+		case g.Fumble(d):
+			s += "?"
+		}
+		return s
+	})
+
+	want := "[6!, ~1, 5, 3] + [2] * 2"
+	if got != want {
+		t.Errorf("Verbose = %q, want %q", got, want)
+	}
+
+	if res[0].Total != 18 {
+		t.Errorf("Total = %d, want 18", res[0].Total)
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kballard/goirc/irc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterModule("factoid", func() Module {
+		return &FactoidMod{}
+	})
+}
+
+var (
+	factoidtables = []string{
+		`CREATE TABLE IF NOT EXISTS
+			Factoid (
+				id INTEGER PRIMARY KEY autoincrement,
+				channel TEXT COLLATE NOCASE,
+				key     TEXT COLLATE NOCASE,
+				value   TEXT,
+				author  TEXT,
+				time    INTEGER
+			)`,
+
+		`CREATE INDEX IF NOT EXISTS
+			FactoidKey
+		ON
+			Factoid (channel, key, id)`,
+
+		`CREATE TABLE IF NOT EXISTS
+			FactoidHistory (
+				id INTEGER PRIMARY KEY autoincrement,
+				channel TEXT COLLATE NOCASE,
+				key     TEXT COLLATE NOCASE,
+				action  TEXT,
+				value   TEXT,
+				author  TEXT,
+				mask    TEXT,
+				time    INTEGER
+			)`,
+
+		`CREATE INDEX IF NOT EXISTS
+			FactoidHistoryKey
+		ON
+			FactoidHistory (channel, key, id)`,
+
+		`CREATE TABLE IF NOT EXISTS
+			FactoidLock (
+				channel TEXT COLLATE NOCASE,
+				key     TEXT COLLATE NOCASE,
+				PRIMARY KEY (channel, key)
+			)`,
+	}
+)
+
+// how many recent speakers per channel $random picks from
+const factoidSpeakers = 50
+
+// most history entries shown by .factoid history
+const factoidHistory = 5
+
+// FactoidMod remembers things people teach it. Factoids learned in a
+// channel belong to that channel; ones learned in private or with
+// --global are seen everywhere, unless a channel has its own.
+type FactoidMod struct {
+	db *sql.DB
+	b  *Bot
+
+	mu       sync.Mutex
+	speakers map[string][]string
+}
+
+type factoid struct {
+	channel string
+	key     string
+	value   string
+	author  string
+	time    time.Time
+}
+
+// render expands the variables in f's value and returns what to say, and
+// whether to say it as an action.
+func (f factoid) render(nick, channel string, speakers []string) (string, bool) {
+	random := nick
+	if len(speakers) > 0 {
+		random = speakers[rand.Intn(len(speakers))]
+	}
+
+	v := strings.NewReplacer("$nick", nick, "$channel", channel, "$random", random).Replace(f.value)
+
+	switch {
+	case strings.HasPrefix(v, "<reply>"):
+		return strings.TrimSpace(v[len("<reply>"):]), false
+	case strings.HasPrefix(v, "<action>"):
+		return strings.TrimSpace(v[len("<action>"):]), true
+	}
+
+	return fmt.Sprintf("%s is %s", f.key, v), false
+}
+
+func (m *FactoidMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "factoid")
+	m.b = b
+	m.speakers = make(map[string][]string)
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "factoid.db")
+	}
+
+	m.db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("factoid module failed to open %q: %s\n", path, err)
+		return
+	}
+
+	for _, t := range factoidtables {
+		if _, err = m.db.Exec(t); err != nil {
+			log.Printf("factoid module failed to create table: %s\n%q\n", err, t)
+			return
+		}
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		sender := l.Args[0]
+		if !IsChannel(sender) {
+			sender = l.Src.Nick
+		} else {
+			m.spoke(sender, l.Src.Nick)
+		}
+
+		if !strings.HasPrefix(l.Args[1], "??") {
+			return
+		}
+
+		key := strings.TrimSpace(l.Args[1][2:])
+		if key == "" {
+			return
+		}
+
+		if err := m.recall(l, sender, key); err != nil {
+			b.Conn.Privmsg(sender, err.Error())
+		}
+	})
+
+	b.HookLine("learn", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		ns := namespace(sender)
+		if len(args) > 0 && args[0] == "--global" {
+			ns, args = "", args[1:]
+		}
+
+		kv := strings.SplitN(strings.Join(args, " "), " is ", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return fmt.Errorf("usage: learn [--global] key is value")
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		if err := m.learn(l.Src, ns, key, value); err != nil {
+			return fmt.Errorf("learn: %s", err)
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("okay, %s", l.Src.Nick))
+		return nil
+	})
+
+	b.HookLine("forget", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		ns := namespace(sender)
+		if len(args) > 0 && args[0] == "--global" {
+			ns, args = "", args[1:]
+		}
+
+		n := 0
+		if len(args) > 1 && strings.HasPrefix(args[len(args)-1], "#") {
+			var err error
+			if n, err = strconv.Atoi(args[len(args)-1][1:]); err != nil || n < 1 {
+				return fmt.Errorf("usage: forget [--global] key [#n]")
+			}
+			args = args[:len(args)-1]
+		}
+
+		key := strings.TrimSpace(strings.Join(args, " "))
+		if key == "" {
+			return fmt.Errorf("usage: forget [--global] key [#n]")
+		}
+
+		if err := m.forget(l.Src, ns, key, n); err != nil {
+			return fmt.Errorf("forget: %s", err)
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("okay, %s", l.Src.Nick))
+		return nil
+	})
+
+	lock := func(locked bool) LineHookFn {
+		return func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+			if !b.IsAdmin(l.Src) {
+				return fmt.Errorf("%s: only admins can %s factoids", cmd, cmd)
+			}
+
+			ns := namespace(sender)
+			if len(args) > 0 && args[0] == "--global" {
+				ns, args = "", args[1:]
+			}
+
+			key := strings.TrimSpace(strings.Join(args, " "))
+			if key == "" {
+				return fmt.Errorf("usage: %s [--global] key", cmd)
+			}
+
+			if err := m.lock(l.Src, ns, key, locked); err != nil {
+				return fmt.Errorf("%s: %s", cmd, err)
+			}
+
+			b.Conn.Privmsg(sender, fmt.Sprintf("okay, %s", l.Src.Nick))
+			return nil
+		}
+	}
+
+	b.HookLine("lock", lock(true))
+	b.HookLine("unlock", lock(false))
+
+	b.Hook("factoid", func(b *Bot, sender, cmd string, args ...string) error {
+		usage := fmt.Errorf("usage: factoid key | history key")
+
+		if len(args) == 0 || args[0] == "" {
+			return usage
+		}
+
+		var (
+			out []string
+			err error
+		)
+
+		if args[0] == "history" && len(args) > 1 {
+			out, err = m.history(namespace(sender), strings.Join(args[1:], " "))
+		} else {
+			out, err = m.info(namespace(sender), strings.Join(args, " "))
+		}
+
+		if err != nil {
+			return fmt.Errorf("factoid failed: %s", err)
+		}
+
+		for _, s := range out {
+			b.Conn.Privmsg(sender, s)
+		}
+
+		return nil
+	})
+
+	log.Printf("factoid module initialized with db %s", path)
+	return nil
+}
+
+func (m *FactoidMod) Reload() error {
+	return nil
+}
+
+func (m *FactoidMod) Call(args ...string) error {
+	return nil
+}
+
+// namespace returns the namespace factoids learned in sender go in.
+func namespace(sender string) string {
+	if IsChannel(sender) {
+		return sender
+	}
+
+	return ""
+}
+
+func (m *FactoidMod) spoke(channel, nick string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var nicks []string
+	for _, n := range m.speakers[channel] {
+		if n != nick {
+			nicks = append(nicks, n)
+		}
+	}
+
+	nicks = append(nicks, nick)
+	if len(nicks) > factoidSpeakers {
+		nicks = nicks[len(nicks)-factoidSpeakers:]
+	}
+
+	m.speakers[channel] = nicks
+}
+
+func (m *FactoidMod) recall(l irc.Line, sender, key string) error {
+	n := 0
+	if i := strings.LastIndex(key, " #"); i > 0 {
+		if v, err := strconv.Atoi(key[i+2:]); err == nil && v > 0 {
+			key, n = strings.TrimSpace(key[:i]), v
+		}
+	}
+
+	facts, err := m.lookup(namespace(sender), key)
+	if err != nil {
+		return fmt.Errorf("factoid lookup failed: %s", err)
+	}
+
+	if len(facts) == 0 {
+		return fmt.Errorf("i don't know about %s", key)
+	}
+
+	if n > len(facts) {
+		return fmt.Errorf("%s only has %d values", key, len(facts))
+	}
+
+	f := facts[rand.Intn(len(facts))]
+	if n > 0 {
+		f = facts[n-1]
+	}
+
+	m.mu.Lock()
+	speakers := append([]string(nil), m.speakers[sender]...)
+	m.mu.Unlock()
+
+	msg, action := f.render(l.Src.Nick, sender, speakers)
+	if action {
+		m.b.Conn.Action(sender, msg)
+	} else {
+		m.b.Conn.Privmsg(sender, msg)
+	}
+
+	return nil
+}
+
+// lookup returns the values of key in the channel's namespace, or the
+// global ones if the channel has none.
+func (m *FactoidMod) lookup(channel, key string) ([]factoid, error) {
+	for _, ns := range []string{channel, ""} {
+		facts, err := m.values(ns, key)
+		if err != nil || len(facts) > 0 || ns == "" {
+			return facts, err
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *FactoidMod) values(ns, key string) ([]factoid, error) {
+	rows, err := m.db.Query(`
+		SELECT
+			channel, key, value, author, time
+		FROM
+			Factoid
+		WHERE
+			channel = ? AND key = ?
+		ORDER BY
+			id`,
+		ns, key,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var facts []factoid
+
+	for rows.Next() {
+		var (
+			f factoid
+			t int64
+		)
+
+		if err := rows.Scan(&f.channel, &f.key, &f.value, &f.author, &t); err != nil {
+			return nil, err
+		}
+
+		f.time = time.Unix(t, 0)
+		facts = append(facts, f)
+	}
+
+	return facts, rows.Err()
+}
+
+func (m *FactoidMod) locked(ns, key string) (bool, error) {
+	var n int
+
+	err := m.db.QueryRow(`
+		SELECT
+			COUNT(*)
+		FROM
+			FactoidLock
+		WHERE
+			channel = ? AND key = ?`,
+		ns, key,
+	).Scan(&n)
+
+	return n > 0, err
+}
+
+// checklock returns an error if key is locked and u isn't an admin.
+func (m *FactoidMod) checklock(u irc.User, ns, key string) error {
+	locked, err := m.locked(ns, key)
+	if err != nil {
+		return err
+	}
+
+	if locked && !m.b.IsAdmin(u) {
+		return fmt.Errorf("%s is locked", key)
+	}
+
+	return nil
+}
+
+func (m *FactoidMod) logedit(tx *sql.Tx, u irc.User, ns, key, action, value string) error {
+	_, err := tx.Exec(`
+		INSERT INTO
+			FactoidHistory (channel, key, action, value, author, mask, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ns, key, action, value, u.Nick, u.User+"@"+u.Host, m.b.Now().Unix(),
+	)
+
+	return err
+}
+
+func (m *FactoidMod) learn(u irc.User, ns, key, value string) error {
+	if err := m.checklock(u, ns, key); err != nil {
+		return err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO
+			Factoid (channel, key, value, author, time)
+		VALUES (?, ?, ?, ?, ?)`,
+		ns, key, value, u.Nick, m.b.Now().Unix(),
+	)
+
+	if err == nil {
+		err = m.logedit(tx, u, ns, key, "learn", value)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// forget removes the nth value of key, or all of them if n is 0.
+func (m *FactoidMod) forget(u irc.User, ns, key string, n int) error {
+	if err := m.checklock(u, ns, key); err != nil {
+		return err
+	}
+
+	facts, err := m.values(ns, key)
+	if err != nil {
+		return err
+	}
+
+	if len(facts) == 0 {
+		return fmt.Errorf("i don't know about %s", key)
+	}
+
+	if n > len(facts) {
+		return fmt.Errorf("%s only has %d values", key, len(facts))
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		_, err = tx.Exec(`
+			DELETE FROM
+				Factoid
+			WHERE
+				channel = ? AND key = ?`,
+			ns, key,
+		)
+
+		for _, f := range facts {
+			if err != nil {
+				break
+			}
+			err = m.logedit(tx, u, ns, key, "forget", f.value)
+		}
+	} else {
+		_, err = tx.Exec(`
+			DELETE FROM
+				Factoid
+			WHERE
+				id = (SELECT id FROM Factoid WHERE channel = ? AND key = ? ORDER BY id LIMIT 1 OFFSET ?)`,
+			ns, key, n-1,
+		)
+
+		if err == nil {
+			err = m.logedit(tx, u, ns, key, "forget", facts[n-1].value)
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *FactoidMod) lock(u irc.User, ns, key string, locked bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	action := "lock"
+
+	if locked {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO FactoidLock (channel, key) VALUES (?, ?)`, ns, key)
+	} else {
+		action = "unlock"
+		_, err = tx.Exec(`DELETE FROM FactoidLock WHERE channel = ? AND key = ?`, ns, key)
+	}
+
+	if err == nil {
+		err = m.logedit(tx, u, ns, key, action, "")
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *FactoidMod) info(channel, key string) ([]string, error) {
+	facts, err := m.lookup(channel, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(facts) == 0 {
+		return []string{fmt.Sprintf("i don't know about %s", key)}, nil
+	}
+
+	scope := "global"
+	if facts[0].channel != "" {
+		scope = facts[0].channel
+	}
+
+	locked, err := m.locked(facts[0].channel, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if locked {
+		scope += ", locked"
+	}
+
+	values := "values"
+	if len(facts) == 1 {
+		values = "value"
+	}
+
+	out := []string{fmt.Sprintf("%s (%s) has %d %s:", key, scope, len(facts), values)}
+
+	now := m.b.Now()
+	for i, f := range facts {
+		out = append(out, fmt.Sprintf("#%d %s (%s, %s ago)", i+1, f.value, f.author, Ago(now.Sub(f.time))))
+	}
+
+	return out, nil
+}
+
+func (m *FactoidMod) history(channel, key string) ([]string, error) {
+	rows, err := m.db.Query(`
+		SELECT
+			channel, action, value, author, time
+		FROM
+			FactoidHistory
+		WHERE
+			channel IN (?, '') AND key = ?
+		ORDER BY
+			id DESC
+		LIMIT ?`,
+		channel, key, factoidHistory,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	now := m.b.Now()
+
+	var out []string
+
+	for rows.Next() {
+		var (
+			ns, action, value, author string
+			t                         int64
+		)
+
+		if err := rows.Scan(&ns, &action, &value, &author, &t); err != nil {
+			return nil, err
+		}
+
+		if ns == "" {
+			ns = "global"
+		}
+
+		s := fmt.Sprintf("%s ago %s %s %s in %s", Ago(now.Sub(time.Unix(t, 0))), author, action, key, ns)
+		if value != "" {
+			s += ": " + value
+		}
+
+		out = append(out, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return []string{fmt.Sprintf("no history for %s", key)}, nil
+	}
+
+	return out, nil
+}
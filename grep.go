@@ -0,0 +1,577 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kballard/goirc/irc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterModule("grep", func() Module {
+		return &GrepMod{}
+	})
+}
+
+var (
+	historytables = []string{
+		`CREATE TABLE IF NOT EXISTS
+			History (
+				id INTEGER PRIMARY KEY autoincrement,
+				time    INTEGER,
+				network TEXT,
+				channel TEXT,
+				nick    TEXT,
+				type    TEXT,
+				text    TEXT
+			)`,
+
+		`CREATE INDEX IF NOT EXISTS
+			HistoryChannel
+		ON
+			History (channel, id)`,
+
+		`CREATE VIRTUAL TABLE IF NOT EXISTS
+			HistoryText
+		USING
+			fts4(text)`,
+
+		`CREATE TRIGGER IF NOT EXISTS
+			HistoryIndex
+		AFTER INSERT ON
+			History
+		BEGIN
+			INSERT INTO
+				HistoryText (docid, text)
+			VALUES
+				(new.id, new.text);
+		END`,
+	}
+)
+
+// most rows scanned for a regular expression search
+const grepScanLimit = 50000
+
+// GrepMod keeps an indexed copy of what the chanlog module logs and
+// searches it with .grep.
+type GrepMod struct {
+	b  *Bot
+	db *sql.DB
+
+	mu sync.Mutex
+
+	// results per page
+	pagesize int
+	// most lines to send to a channel before replying privately
+	public int
+	// most context lines around each result
+	maxcontext int
+}
+
+func (m *GrepMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	m.b = b
+	conf := b.Config.Search("mod", "grep")
+
+	chanlog, ok := GetModule("chanlog").(*ChanlogMod)
+	if !ok {
+		return fmt.Errorf("grep module requires the chanlog module")
+	}
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "history.db")
+	}
+
+	m.db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("grep module failed to open %q: %s\n", path, err)
+		return
+	}
+
+	for _, t := range historytables {
+		if _, err = m.db.Exec(t); err != nil {
+			log.Printf("grep module failed to create table: %s\n%q\n", err, t)
+			return
+		}
+	}
+
+	if err = m.configure(); err != nil {
+		return
+	}
+
+	chanlog.Listen(func(e LogEvent) {
+		if e.Type != "message" && e.Type != "action" {
+			return
+		}
+
+		// don't index searches, or what the bot said, which would
+		// index the results of searches
+		if strings.HasPrefix(e.Text, b.Magic+"grep ") || strings.EqualFold(e.Nick, b.IrcConfig.Nick) {
+			return
+		}
+
+		if err := m.insert(e); err != nil {
+			log.Printf("grep: insert failed: %s", err)
+		}
+	})
+
+	b.HookLine("grep", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		q, err := m.parse(b.Now(), args)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case q.channel == "" && IsChannel(sender):
+			q.channel = sender
+		case q.channel != "":
+			if !strings.EqualFold(q.channel, sender) && !b.CanRead(l.Src, q.channel) {
+				return fmt.Errorf("grep: you aren't in %s", q.channel)
+			}
+		case !b.IsAdmin(l.Src):
+			// only the channels they can read
+			if q.channels = b.ChannelsOf(l.Src.Nick); len(q.channels) == 0 {
+				return fmt.Errorf("grep: you aren't in any of my channels")
+			}
+		}
+
+		return m.grep(b, l, sender, q)
+	})
+
+	log.Printf("grep module initialized with db %s", path)
+	return nil
+}
+
+func (m *GrepMod) Reload() error {
+	return m.configure()
+}
+
+func (m *GrepMod) configure() error {
+	conf := m.b.Config.Search("mod", "grep")
+
+	pagesize := confint(conf, "pagesize", 3)
+	if pagesize < 1 {
+		return fmt.Errorf("grep: pagesize must be at least 1")
+	}
+
+	maxcontext := confint(conf, "context", 3)
+	if maxcontext < 0 {
+		return fmt.Errorf("grep: context can't be negative")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pagesize = pagesize
+	m.public = confint(conf, "public", 6)
+	m.maxcontext = maxcontext
+	return nil
+}
+
+// settings returns the page size, most public lines and most context.
+func (m *GrepMod) settings() (pagesize, public, maxcontext int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pagesize, m.public, m.maxcontext
+}
+
+func (m *GrepMod) Call(args ...string) error {
+	return nil
+}
+
+type historyline struct {
+	id      int64
+	time    time.Time
+	channel string
+	nick    string
+	typ     string
+	text    string
+}
+
+func (h historyline) String() string {
+	ts := h.time.Format("01/02 15:04")
+
+	if h.typ == "action" {
+		return fmt.Sprintf("[%s %s] * %s %s", h.channel, ts, h.nick, h.text)
+	}
+
+	return fmt.Sprintf("[%s %s] <%s> %s", h.channel, ts, h.nick, h.text)
+}
+
+type grepquery struct {
+	pattern string
+	re      *regexp.Regexp
+	channel string
+	// channels to search when there's no channel, all if empty
+	channels []string
+	nick     string
+	since    time.Time
+	page     int
+	context  int
+	private  bool
+}
+
+const grepUsage = "usage: grep pattern|/regexp/ [#channel] [--nick=x] [--since=2d] [--context=n] [--page=n] [--private]"
+
+func (m *GrepMod) parse(now time.Time, args []string) (*grepquery, error) {
+	q := &grepquery{page: 1}
+
+	_, _, maxcontext := m.settings()
+
+	var words []string
+
+	for _, a := range args {
+		switch {
+		case a == "":
+		case strings.HasPrefix(a, "--"):
+			kv := strings.SplitN(a[2:], "=", 2)
+			if len(kv) == 1 {
+				kv = append(kv, "")
+			}
+
+			var err error
+
+			switch kv[0] {
+			case "nick":
+				q.nick = kv[1]
+			case "since":
+				var d time.Duration
+				if d, err = ParseDuration(kv[1]); err == nil {
+					q.since = now.Add(-d)
+				} else if t, terr := time.ParseInLocation("2006-01-02", kv[1], now.Location()); terr == nil {
+					q.since, err = t, nil
+				}
+			case "page":
+				q.page, err = strconv.Atoi(kv[1])
+				if err == nil && q.page < 1 {
+					err = fmt.Errorf("page must be at least 1")
+				}
+			case "context":
+				q.context, err = strconv.Atoi(kv[1])
+				if q.context < 0 || q.context > maxcontext {
+					err = fmt.Errorf("context must be between 0 and %d", maxcontext)
+				}
+			case "private":
+				q.private = true
+			default:
+				err = fmt.Errorf(grepUsage)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("grep: --%s: %s", kv[0], err)
+			}
+		case IsChannel(a) && q.channel == "":
+			q.channel = a
+		default:
+			words = append(words, a)
+		}
+	}
+
+	q.pattern = strings.Join(words, " ")
+	if q.pattern == "" {
+		return nil, fmt.Errorf(grepUsage)
+	}
+
+	if len(q.pattern) > 2 && strings.HasPrefix(q.pattern, "/") && strings.HasSuffix(q.pattern, "/") {
+		re, err := regexp.Compile(q.pattern[1 : len(q.pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("grep: %s", err)
+		}
+		q.re = re
+	}
+
+	return q, nil
+}
+
+func (m *GrepMod) insert(e LogEvent) error {
+	_, err := m.db.Exec(`
+		INSERT INTO
+			History (time, network, channel, nick, type, text)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		e.Time.Unix(), e.Network, e.Channel, e.Nick, e.Type, e.Text,
+	)
+
+	return err
+}
+
+func scanhistory(rows *sql.Rows) ([]historyline, error) {
+	defer rows.Close()
+
+	var out []historyline
+
+	for rows.Next() {
+		var (
+			h historyline
+			t int64
+		)
+
+		if err := rows.Scan(&h.id, &t, &h.channel, &h.nick, &h.typ, &h.text); err != nil {
+			return nil, err
+		}
+
+		h.time = time.Unix(t, 0)
+		out = append(out, h)
+	}
+
+	return out, rows.Err()
+}
+
+// search returns a page of matches, newest first, and the total number of
+// matches. A regular expression only searches the latest grepScanLimit
+// lines; capped is set if there were more.
+func (m *GrepMod) search(q *grepquery, pagesize int) (hits []historyline, total int, capped bool, err error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+
+	if q.channel != "" {
+		where = append(where, "h.channel = ? COLLATE NOCASE")
+		args = append(args, q.channel)
+	} else if len(q.channels) > 0 {
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(q.channels)), ", ")
+		where = append(where, "lower(h.channel) IN ("+marks+")")
+		for _, c := range q.channels {
+			args = append(args, strings.ToLower(c))
+		}
+	}
+
+	if q.nick != "" {
+		where = append(where, "h.nick = ? COLLATE NOCASE")
+		args = append(args, q.nick)
+	}
+
+	if !q.since.IsZero() {
+		where = append(where, "h.time >= ?")
+		args = append(args, q.since.Unix())
+	}
+
+	offset := (q.page - 1) * pagesize
+
+	if q.re != nil {
+		cond := ""
+		if len(where) > 0 {
+			cond = "WHERE " + strings.Join(where, " AND ")
+		}
+
+		rows, err := m.db.Query(`
+			SELECT
+				h.id, h.time, h.channel, h.nick, h.type, h.text
+			FROM
+				History h
+			`+cond+`
+			ORDER BY
+				h.id DESC
+			LIMIT ?`,
+			append(args, grepScanLimit)...,
+		)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		lines, err := scanhistory(rows)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		capped = len(lines) == grepScanLimit
+
+		for _, h := range lines {
+			if q.re.MatchString(h.text) {
+				hits = append(hits, h)
+			}
+		}
+
+		total = len(hits)
+		if offset >= total {
+			return nil, total, capped, nil
+		}
+
+		hits = hits[offset:]
+		if len(hits) > pagesize {
+			hits = hits[:pagesize]
+		}
+
+		return hits, total, capped, nil
+	}
+
+	match := ftsquery(q.pattern)
+	if match == "" {
+		return nil, 0, false, fmt.Errorf("nothing to search for in %q; try a /regexp/", q.pattern)
+	}
+
+	where = append([]string{"HistoryText MATCH ?"}, where...)
+	args = append([]interface{}{match}, args...)
+	cond := "WHERE " + strings.Join(where, " AND ")
+
+	err = m.db.QueryRow(`
+		SELECT
+			COUNT(*)
+		FROM
+			HistoryText JOIN History h ON h.id = HistoryText.docid
+		`+cond,
+		args...,
+	).Scan(&total)
+
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	rows, err := m.db.Query(`
+		SELECT
+			h.id, h.time, h.channel, h.nick, h.type, h.text
+		FROM
+			HistoryText JOIN History h ON h.id = HistoryText.docid
+		`+cond+`
+		ORDER BY
+			h.id DESC
+		LIMIT ? OFFSET ?`,
+		append(args, pagesize, offset)...,
+	)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	hits, err = scanhistory(rows)
+	return hits, total, false, err
+}
+
+// ftsquery makes a full text query matching the words of pattern as they
+// are, with none of the query syntax: each word is quoted as a phrase of
+// the tokens in it.
+func ftsquery(pattern string) string {
+	var terms []string
+
+	for _, w := range strings.Fields(pattern) {
+		// the simple tokenizer splits on ascii punctuation
+		toks := strings.FieldsFunc(w, func(r rune) bool {
+			return r < utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		if len(toks) > 0 {
+			terms = append(terms, `"`+strings.Join(toks, " ")+`"`)
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// context returns up to n lines either side of h in its channel.
+func (m *GrepMod) context(h historyline, n int) (before, after []historyline, err error) {
+	rows, err := m.db.Query(`
+		SELECT
+			id, time, channel, nick, type, text
+		FROM
+			History
+		WHERE
+			channel = ? COLLATE NOCASE AND id < ?
+		ORDER BY
+			id DESC
+		LIMIT ?`,
+		h.channel, h.id, n,
+	)
+	if err != nil {
+		return
+	}
+
+	if before, err = scanhistory(rows); err != nil {
+		return
+	}
+
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	rows, err = m.db.Query(`
+		SELECT
+			id, time, channel, nick, type, text
+		FROM
+			History
+		WHERE
+			channel = ? COLLATE NOCASE AND id > ?
+		ORDER BY
+			id ASC
+		LIMIT ?`,
+		h.channel, h.id, n,
+	)
+	if err != nil {
+		return
+	}
+
+	after, err = scanhistory(rows)
+	return
+}
+
+func (m *GrepMod) grep(b *Bot, l irc.Line, sender string, q *grepquery) error {
+	pagesize, public, _ := m.settings()
+
+	hits, total, capped, err := m.search(q, pagesize)
+	if err != nil {
+		return fmt.Errorf("grep failed: %s", err)
+	}
+
+	// regular expressions only look so far back
+	within := ""
+	if capped {
+		within = fmt.Sprintf(" in the last %d lines", grepScanLimit)
+	}
+
+	if total == 0 {
+		b.Conn.Privmsg(sender, fmt.Sprintf("grep: no matches for %q%s", q.pattern, within))
+		return nil
+	}
+
+	pages := (total + pagesize - 1) / pagesize
+	if len(hits) == 0 {
+		return fmt.Errorf("grep: only %d pages of results", pages)
+	}
+
+	out := []string{fmt.Sprintf("grep: %d matches for %q%s, page %d/%d", total, q.pattern, within, q.page, pages)}
+
+	for _, h := range hits {
+		if q.context == 0 {
+			out = append(out, h.String())
+			continue
+		}
+
+		before, after, err := m.context(h, q.context)
+		if err != nil {
+			return fmt.Errorf("grep failed: %s", err)
+		}
+
+		for _, c := range before {
+			out = append(out, "  "+c.String())
+		}
+		out = append(out, "> "+h.String())
+		for _, c := range after {
+			out = append(out, "  "+c.String())
+		}
+	}
+
+	if q.page < pages {
+		out = append(out, fmt.Sprintf("grep: use --page=%d for more", q.page+1))
+	}
+
+	to := sender
+	if IsChannel(sender) && (q.private || len(out) > public) {
+		to = l.Src.Nick
+		b.Conn.Privmsg(sender, fmt.Sprintf("%s: %d lines of results sent privately", l.Src.Nick, len(out)))
+	}
+
+	for _, s := range out {
+		b.Conn.Privmsg(to, s)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kballard/goirc/irc"
+)
+
+// ircserver is a tiny single-client irc server listening on the loopback
+// interface. it speaks just enough of the protocol to let the bot connect to
+// it, and leaves the conversation itself to its user (see console.go).
+type ircserver struct {
+	ln   net.Listener
+	name string
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	// lines sent by the client, closed when the client goes away
+	lines chan string
+}
+
+func newircserver(name string) (*ircserver, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ircserver{
+		ln:    ln,
+		name:  name,
+		lines: make(chan string, 64),
+	}
+
+	return s, nil
+}
+
+// point an irc config at the server
+func (s *ircserver) redirect(conf *irc.Config) error {
+	return redirect(conf, s.ln.Addr())
+}
+
+// accept waits for the bot to connect and starts reading from it.
+func (s *ircserver) accept() error {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return err
+	}
+
+	s.ln.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	go func() {
+		defer close(s.lines)
+
+		scan := bufio.NewScanner(conn)
+		for scan.Scan() {
+			s.lines <- strings.TrimRight(scan.Text(), "\r")
+		}
+	}()
+
+	return nil
+}
+
+// Send writes a raw line to the client.
+func (s *ircserver) Send(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+
+	if _, err := fmt.Fprintf(s.conn, "%s\r\n", line); err != nil {
+		log.Printf("ircserver: write failed: %s", err)
+	}
+}
+
+// Sendf is Send with formatting.
+func (s *ircserver) Sendf(format string, args ...interface{}) {
+	s.Send(fmt.Sprintf(format, args...))
+}
+
+// Welcome completes client registration.
+func (s *ircserver) Welcome(nick string) {
+	s.Sendf(":%s 001 %s :Welcome to %s, %s", s.name, nick, s.name, nick)
+	s.Sendf(":%s 376 %s :End of /MOTD command.", s.name, nick)
+}
+
+func (s *ircserver) Close() {
+	s.ln.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// redirect points an irc config at a local plaintext listener.
+func redirect(conf *irc.Config, addr net.Addr) error {
+	host, ports, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(ports)
+	if err != nil {
+		return err
+	}
+
+	conf.Host = host
+	conf.Port = uint(port)
+	conf.SSL = false
+	return nil
+}
+
+// ircmsg is a parsed irc protocol line.
+type ircmsg struct {
+	prefix string
+	cmd    string
+	params []string
+}
+
+// nick returns the nick part of the prefix.
+func (m ircmsg) nick() string {
+	if i := strings.IndexByte(m.prefix, '!'); i >= 0 {
+		return m.prefix[:i]
+	}
+
+	return m.prefix
+}
+
+func (m ircmsg) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+
+	return ""
+}
+
+func parseircmsg(line string) ircmsg {
+	var m ircmsg
+
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			m.prefix, line = line[1:i], line[i+1:]
+		} else {
+			m.prefix, line = line[1:], ""
+		}
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			m.params = append(m.params, line)
+			break
+		}
+
+		m.params = append(m.params, line[:i])
+		line = line[i+1:]
+	}
+
+	if len(m.params) > 0 {
+		m.cmd = strings.ToUpper(m.params[0])
+		m.params = m.params[1:]
+	}
+
+	return m
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kballard/goirc/irc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterModule("karma", func() Module {
+		return &KarmaMod{}
+	})
+}
+
+var (
+	karmatables = []string{
+		`CREATE TABLE IF NOT EXISTS
+			Karma (
+				id INTEGER PRIMARY KEY autoincrement,
+				thing   TEXT COLLATE NOCASE,
+				delta   INTEGER,
+				reason  TEXT,
+				nick    TEXT,
+				mask    TEXT,
+				channel TEXT,
+				time    INTEGER
+			)`,
+
+		`CREATE INDEX IF NOT EXISTS
+			KarmaThing
+		ON
+			Karma (thing, time)`,
+
+		`CREATE INDEX IF NOT EXISTS
+			KarmaMask
+		ON
+			Karma (mask, thing, time)`,
+	}
+
+	// thing++, thing--, (some thing)++
+	karmare = regexp.MustCompile(`(?:\(([^()]+)\)|([^\s()]+?))(\+\+|--)(?:$|[\s,;:.!?])`)
+	// thing++ # because
+	karmareason = regexp.MustCompile(`\s#\s+(.+)$`)
+)
+
+const karmaUsage = "usage: karma thing | top [n] | bottom [n] | why thing"
+
+// most entries shown by .karma top and .karma why
+const karmaList = 5
+
+type KarmaMod struct {
+	db *sql.DB
+	b  *Bot
+
+	// how long a hostmask must wait to vote for the same thing again
+	cooldown time.Duration
+}
+
+type karmavote struct {
+	thing  string
+	delta  int
+	reason string
+}
+
+// parsekarma finds the votes in a line of chat.
+func parsekarma(text string) []karmavote {
+	var reason string
+	if m := karmareason.FindStringSubmatchIndex(text); m != nil {
+		reason = strings.TrimSpace(text[m[2]:m[3]])
+		text = text[:m[0]]
+	}
+
+	var votes []karmavote
+	seen := map[string]bool{}
+
+	for _, m := range karmare.FindAllStringSubmatch(text, -1) {
+		thing := strings.TrimSpace(m[1] + m[2])
+		if thing == "" || seen[strings.ToLower(thing)] {
+			continue
+		}
+
+		seen[strings.ToLower(thing)] = true
+
+		v := karmavote{thing: thing, delta: 1, reason: reason}
+		if m[3] == "--" {
+			v.delta = -1
+		}
+
+		votes = append(votes, v)
+	}
+
+	return votes
+}
+
+func (m *KarmaMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "karma")
+	m.b = b
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "karma.db")
+	}
+
+	m.cooldown = 5 * time.Minute
+	if cd := conf.Search("cooldown"); cd != "" {
+		if m.cooldown, err = ParseDuration(cd); err != nil {
+			return fmt.Errorf("karma: bad cooldown %q: %s", cd, err)
+		}
+	}
+
+	m.db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("karma module failed to open %q: %s\n", path, err)
+		return
+	}
+
+	for _, t := range karmatables {
+		if _, err = m.db.Exec(t); err != nil {
+			log.Printf("karma module failed to create table: %s\n%q\n", err, t)
+			return
+		}
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		if !IsChannel(l.Args[0]) || strings.HasPrefix(l.Args[1], b.Magic) {
+			return
+		}
+
+		for _, v := range parsekarma(l.Args[1]) {
+			m.vote(l, v)
+		}
+	})
+
+	b.Hook("karma", func(b *Bot, sender, cmd string, args ...string) error {
+		if len(args) == 0 || args[0] == "" {
+			return fmt.Errorf(karmaUsage)
+		}
+
+		var (
+			out []string
+			err error
+		)
+
+		switch args[0] {
+		case "top", "bottom":
+			n := karmaList
+			if len(args) > 1 {
+				if n, err = strconv.Atoi(args[1]); err != nil || n < 1 || n > 20 {
+					return fmt.Errorf("karma: %s wants a number between 1 and 20", args[0])
+				}
+			}
+			out, err = m.leaders(args[0] == "top", n)
+		case "why":
+			if len(args) < 2 {
+				return fmt.Errorf(karmaUsage)
+			}
+			out, err = m.why(strings.Join(args[1:], " "))
+		default:
+			out, err = m.score(strings.Join(args, " "))
+		}
+
+		if err != nil {
+			return fmt.Errorf("karma failed: %s", err)
+		}
+
+		for _, s := range out {
+			b.Conn.Privmsg(sender, s)
+		}
+
+		return nil
+	})
+
+	log.Printf("karma module initialized with db %s", path)
+	return nil
+}
+
+func (m *KarmaMod) Reload() error {
+	return nil
+}
+
+func (m *KarmaMod) Call(args ...string) error {
+	return nil
+}
+
+func (m *KarmaMod) vote(l irc.Line, v karmavote) {
+	now := m.b.Now()
+	channel := l.Args[0]
+	mask := l.Src.User + "@" + l.Src.Host
+
+	if strings.EqualFold(v.thing, l.Src.Nick) || nickbase(v.thing) == nickbase(l.Src.Nick) {
+		if v.delta > 0 {
+			m.b.Conn.Privmsg(channel, fmt.Sprintf("%s: nice try.", l.Src.Nick))
+		}
+		return
+	}
+
+	var last sql.NullInt64
+
+	err := m.db.QueryRow(`
+		SELECT
+			MAX(time)
+		FROM
+			Karma
+		WHERE
+			mask = ? AND thing = ?`,
+		mask, v.thing,
+	).Scan(&last)
+
+	if err != nil {
+		log.Printf("karma: vote lookup failed: %s", err)
+		return
+	}
+
+	if last.Valid {
+		if wait := time.Unix(last.Int64, 0).Add(m.cooldown).Sub(now); wait > 0 {
+			m.b.Conn.Notice(l.Src.Nick, fmt.Sprintf("you can vote for %s again in %s", v.thing, Ago(wait)))
+			return
+		}
+	}
+
+	_, err = m.db.Exec(`
+		INSERT INTO
+			Karma (thing, delta, reason, nick, mask, channel, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		v.thing, v.delta, v.reason, l.Src.Nick, mask, channel, now.Unix(),
+	)
+
+	if err != nil {
+		log.Printf("karma: vote for %q failed: %s", v.thing, err)
+		return
+	}
+
+	total, _, _, err := m.total(v.thing)
+	if err != nil {
+		log.Printf("karma: total for %q failed: %s", v.thing, err)
+		return
+	}
+
+	m.b.Conn.Privmsg(channel, fmt.Sprintf("%s now has %d karma", v.thing, total))
+}
+
+func (m *KarmaMod) total(thing string) (total, up, down int, err error) {
+	err = m.db.QueryRow(`
+		SELECT
+			IFNULL(SUM(delta), 0),
+			IFNULL(SUM(delta > 0), 0),
+			IFNULL(SUM(delta < 0), 0)
+		FROM
+			Karma
+		WHERE
+			thing = ?`,
+		thing,
+	).Scan(&total, &up, &down)
+
+	return
+}
+
+func (m *KarmaMod) score(thing string) ([]string, error) {
+	total, up, down, err := m.total(thing)
+	if err != nil {
+		return nil, err
+	}
+
+	if up+down == 0 {
+		return []string{fmt.Sprintf("%s has no karma", thing)}, nil
+	}
+
+	return []string{fmt.Sprintf("%s has %d karma (+%d/-%d)", thing, total, up, down)}, nil
+}
+
+func (m *KarmaMod) leaders(top bool, n int) ([]string, error) {
+	order := "DESC"
+	if !top {
+		order = "ASC"
+	}
+
+	rows, err := m.db.Query(`
+		SELECT
+			thing, SUM(delta) AS score
+		FROM
+			Karma
+		GROUP BY
+			thing
+		ORDER BY
+			score `+order+`, MAX(time) DESC
+		LIMIT ?`,
+		n,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var board []string
+
+	for rows.Next() {
+		var (
+			thing string
+			score int
+		)
+
+		if err := rows.Scan(&thing, &score); err != nil {
+			return nil, err
+		}
+
+		board = append(board, fmt.Sprintf("%s (%d)", thing, score))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(board) == 0 {
+		return []string{"nobody has any karma yet"}, nil
+	}
+
+	return []string{strings.Join(board, ", ")}, nil
+}
+
+func (m *KarmaMod) why(thing string) ([]string, error) {
+	rows, err := m.db.Query(`
+		SELECT
+			delta, reason, nick, time
+		FROM
+			Karma
+		WHERE
+			thing = ? AND reason != ''
+		ORDER BY
+			time DESC
+		LIMIT ?`,
+		thing, karmaList,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	now := m.b.Now()
+
+	var out []string
+
+	for rows.Next() {
+		var (
+			delta  int
+			reason string
+			nick   string
+			t      int64
+		)
+
+		if err := rows.Scan(&delta, &reason, &nick, &t); err != nil {
+			return nil, err
+		}
+
+		sign := "++"
+		if delta < 0 {
+			sign = "--"
+		}
+
+		out = append(out, fmt.Sprintf("%s%s %s ago by %s: %s", thing, sign, Ago(now.Sub(time.Unix(t, 0))), nick, reason))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return []string{fmt.Sprintf("nobody has said why %s has karma", thing)}, nil
+	}
+
+	return out, nil
+}
@@ -7,8 +7,12 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/time/rate"
@@ -28,14 +32,28 @@ func init() {
 
 type HookFn func(b *Bot, sender, cmd string, args ...string) error
 
+// LineHookFn is a HookFn which also gets the line that invoked it, for
+// hooks that need to know who is asking.
+type LineHookFn func(b *Bot, l irc.Line, sender, cmd string, args ...string) error
+
+// SentFn is called with each PRIVMSG, NOTICE or ACTION the bot sends.
+type SentFn func(cmd, dst, msg string)
+
 type Bot struct {
 	Channels  []string
+	Network   string
 	Config    *ndb.Ndb
 	Conn      irc.SafeConn
 	IrcConfig irc.Config
 	Mods      map[string]Module
 	Magic     string
 	DataDir   string
+	// path to record irc traffic to, if any
+	Record string
+	// source of the current time, swapped out when replaying
+	Clock func() time.Time
+	// nick!user@host patterns of people allowed to run admin commands
+	Admins []string
 
 	LoginFn   func(conn *irc.Conn, line irc.Line)
 	PrivmsgFn func(conn *irc.Conn, line irc.Line)
@@ -43,7 +61,20 @@ type Bot struct {
 
 	ratelimit map[string]*rate.Limiter
 
-	hooks map[string]HookFn
+	hooks map[string]LineHookFn
+
+	// held for writing while reloading, and for reading by irc handlers,
+	// so they never see the config or modules half reloaded
+	mu sync.RWMutex
+
+	// who is in the bot's channels
+	members *members
+
+	sentmu sync.Mutex
+	sent   []SentFn
+
+	// set while registered with the server
+	connected int32
 
 	quit chan bool
 }
@@ -52,8 +83,10 @@ func NewBot(conf string) (*Bot, error) {
 	var err error
 
 	bot := &Bot{
-		Mods: make(map[string]Module),
-		quit: make(chan bool, 1),
+		Mods:    make(map[string]Module),
+		Clock:   time.Now,
+		members: newmembers(),
+		quit:    make(chan bool, 1),
 	}
 
 	bot.LoginFn = func(conn *irc.Conn, line irc.Line) {
@@ -106,7 +139,7 @@ func NewBot(conf string) (*Bot, error) {
 			}
 		}
 
-		if err := hk(bot, sender, cmd, args...); err != nil {
+		if err := hk(bot, l, sender, cmd, args...); err != nil {
 			bot.Conn.Privmsg(sender, err.Error())
 		}
 	}
@@ -115,7 +148,7 @@ func NewBot(conf string) (*Bot, error) {
 		log.Printf("[%s] %s %s\n", line.Dst, line.Src, line.Args[0])
 	}
 
-	bot.hooks = make(map[string]HookFn)
+	bot.hooks = make(map[string]LineHookFn)
 
 	config, err := ndb.Open(conf)
 	if err != nil {
@@ -149,43 +182,117 @@ func NewBot(conf string) (*Bot, error) {
 
 	bot.IrcConfig.Init = func(hr irc.HandlerRegistry) {
 		log.Println("initializing...")
+		hr.AddHandler(irc.CONNECTED, func(*irc.Conn, irc.Line) {
+			atomic.StoreInt32(&bot.connected, 1)
+		})
 		hr.AddHandler(irc.CONNECTED, bot.LoginFn)
 		hr.AddHandler(irc.DISCONNECTED, func(*irc.Conn, irc.Line) {
+			atomic.StoreInt32(&bot.connected, 0)
 			fmt.Println("disconnected")
 			bot.quit <- true
 		})
-		hr.AddHandler("PRIVMSG", bot.PrivmsgFn)
-		hr.AddHandler(irc.ACTION, bot.ActionFn)
+		hr.AddHandler("PRIVMSG", bot.locked(bot.PrivmsgFn))
+		hr.AddHandler(irc.ACTION, bot.locked(bot.ActionFn))
+		bot.members.track(hr)
 	}
 
 	return bot, err
 }
 
 func (b *Bot) Run() (err error) {
+	if b.Record != "" {
+		rec, err := newrecorder(b.Record, b.Now)
+		if err != nil {
+			return err
+		}
+
+		if err := b.record(rec); err != nil {
+			rec.Close()
+			return err
+		}
+
+		log.Printf("recording to %s", b.Record)
+	}
+
 	log.Println("connecting...")
-	if b.Conn, err = irc.Connect(b.IrcConfig); err != nil {
+	conn, err := irc.Connect(b.IrcConfig)
+	if err != nil {
 		close(b.quit)
 		return err
 	}
 
+	b.Conn = &sentConn{SafeConn: conn, b: b}
+
 	for _, m := range b.Mods {
 		if err = m.Init(b, b.Conn); err != nil {
 			return
 		}
 	}
 
+	if len(reloadSignals) > 0 {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, reloadSignals...)
+		defer signal.Stop(sig)
+
+		go func() {
+			for range sig {
+				log.Println("reloading config...")
+				if err := b.Reload(); err != nil {
+					log.Printf("reload failed: %s", err)
+				}
+			}
+		}()
+	}
+
 	<-b.quit
 	log.Println("goodbye.")
 
 	return
 }
 
+// locked wraps an irc handler so it doesn't run while the bot reloads.
+func (b *Bot) locked(f func(*irc.Conn, irc.Line)) func(*irc.Conn, irc.Line) {
+	return func(c *irc.Conn, l irc.Line) {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+
+		f(c, l)
+	}
+}
+
+// Now returns the bot's idea of the current time.
+func (b *Bot) Now() time.Time {
+	return b.Clock()
+}
+
+// IsAdmin reports whether u matches one of the admins in the config.
+// Patterns are nick!user@host masks with * and ? wildcards.
+func (b *Bot) IsAdmin(u irc.User) bool {
+	mask := u.String()
+
+	for _, a := range b.Admins {
+		if MaskMatch(a, mask) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Connected reports whether the bot is registered with the irc server.
+func (b *Bot) Connected() bool {
+	return atomic.LoadInt32(&b.connected) == 1
+}
+
 func (b *Bot) Conf() *ndb.Ndb {
 	return b.Config
 }
 
 // Reload config and reconfigure bot
 func (b *Bot) Reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	if err := b.Config.Reopen(); err != nil {
 		return err
 	}
@@ -206,6 +313,7 @@ func (b *Bot) parseconfig(c ndb.RecordSet) (irc.Config, error) {
 	var burst int64
 
 	hosts := c.Search("host")
+	networks := c.Search("network")
 	ports := c.Search("port")
 	ssls := c.Search("ssl")
 	nicks := c.Search("nick")
@@ -216,6 +324,8 @@ func (b *Bot) parseconfig(c ndb.RecordSet) (irc.Config, error) {
 	moduless := c.Search("modules")
 	magics := c.Search("magic")
 	datadirs := c.Search("datadir")
+	records := c.Search("record")
+	adminss := c.Search("admins")
 
 	conf := irc.Config{
 		Host:      hosts,
@@ -245,6 +355,12 @@ func (b *Bot) parseconfig(c ndb.RecordSet) (irc.Config, error) {
 
 	b.Channels = strings.Split(channelss, " ")
 
+	if networks != "" {
+		b.Network = networks
+	} else {
+		b.Network = hosts
+	}
+
 	b.ratelimit = make(map[string]*rate.Limiter)
 	limits = c.Search("ratelimit_rate")
 	if limits == "" {
@@ -290,6 +406,16 @@ func (b *Bot) parseconfig(c ndb.RecordSet) (irc.Config, error) {
 		b.DataDir = os.ExpandEnv("${HOME}/.glenda")
 	}
 
+	b.Admins = strings.Fields(adminss)
+
+	switch records {
+	case "", "false":
+	case "true":
+		b.Record = filepath.Join(b.DataDir, "record", time.Now().Format("20060102-150405")+".log")
+	default:
+		b.Record = filepath.Join(b.DataDir, "record", records)
+	}
+
 	return conf, nil
 badconf:
 
@@ -297,6 +423,12 @@ badconf:
 }
 
 func (b *Bot) Hook(cmd string, hook HookFn) error {
+	return b.HookLine(cmd, func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		return hook(b, sender, cmd, args...)
+	})
+}
+
+func (b *Bot) HookLine(cmd string, hook LineHookFn) error {
 	if _, ok := b.hooks[cmd]; ok {
 		return fmt.Errorf("hook for %q already exists", cmd)
 	}
@@ -305,6 +437,114 @@ func (b *Bot) Hook(cmd string, hook HookFn) error {
 	return nil
 }
 
+// OnSent registers a function to be called for each message the bot sends
+// through b.Conn.
+func (b *Bot) OnSent(fn SentFn) {
+	b.sentmu.Lock()
+	defer b.sentmu.Unlock()
+
+	b.sent = append(b.sent, fn)
+}
+
+func (b *Bot) sentmsg(cmd, dst, msg string) {
+	b.sentmu.Lock()
+	fns := b.sent
+	b.sentmu.Unlock()
+
+	for _, fn := range fns {
+		fn(cmd, dst, msg)
+	}
+}
+
+// Capture runs the hook for cmd as if it had been invoked in channel,
+// returning what it would have said instead of sending it.
+func (b *Bot) Capture(channel, cmd string, args ...string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	hk, ok := b.hooks[cmd]
+	if !ok {
+		return nil, fmt.Errorf("no such hook %q", cmd)
+	}
+
+	cc := &captureConn{SafeConn: b.Conn}
+
+	cb := &Bot{
+		Channels:  b.Channels,
+		Network:   b.Network,
+		Config:    b.Config,
+		Conn:      cc,
+		IrcConfig: b.IrcConfig,
+		Mods:      b.Mods,
+		Magic:     b.Magic,
+		DataDir:   b.DataDir,
+		Clock:     b.Clock,
+		Admins:    b.Admins,
+		hooks:     b.hooks,
+		members:   b.members,
+		connected: atomic.LoadInt32(&b.connected),
+	}
+
+	l := irc.Line{
+		Src:  irc.User{Nick: b.IrcConfig.Nick, User: b.IrcConfig.User},
+		Args: []string{channel, strings.Join(append([]string{b.Magic + cmd}, args...), " ")},
+	}
+
+	err := hk(cb, l, channel, cmd, args...)
+	return cc.lines, err
+}
+
+// captureConn collects messages instead of sending them.
+type captureConn struct {
+	irc.SafeConn
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *captureConn) Privmsg(dst, msg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, msg)
+}
+
+func (c *captureConn) Notice(dst, msg string) {
+	c.Privmsg(dst, msg)
+}
+
+func (c *captureConn) Action(dst, msg string) {
+	c.Privmsg(dst, "* "+msg)
+}
+
+// sentConn lets the bot see its own messages, and keeps the handlers
+// modules add from running while it reloads.
+type sentConn struct {
+	irc.SafeConn
+	b *Bot
+}
+
+func (c *sentConn) AddHandler(event string, f func(*irc.Conn, irc.Line)) irc.CallbackIdentifier {
+	return c.SafeConn.AddHandler(event, c.b.locked(f))
+}
+
+func (c *sentConn) Privmsg(dst, msg string) {
+	c.SafeConn.Privmsg(dst, msg)
+	c.b.sentmsg("PRIVMSG", dst, msg)
+}
+
+func (c *sentConn) Notice(dst, msg string) {
+	c.SafeConn.Notice(dst, msg)
+	c.b.sentmsg("NOTICE", dst, msg)
+}
+
+func (c *sentConn) Action(dst, msg string) {
+	c.SafeConn.Action(dst, msg)
+	c.b.sentmsg(irc.ACTION, dst, msg)
+}
+
+// signals which make the bot reload its config
+var reloadSignals []os.Signal
+
 var (
 	configfile = flag.String("conf", "config/main", "path to ndb(6)-format config file")
 )
@@ -319,9 +559,36 @@ func runGlenda(cmd *cobra.Command, args []string) error {
 	return bot.Run()
 }
 
+// goflagargs rewrites the go flags spelled with one dash, like -conf, to
+// the two pflag wants, so the old command lines keep working.
+func goflagargs(args []string) []string {
+	out := make([]string, 0, len(args))
+
+	for i, a := range args {
+		if a == "--" {
+			return append(out, args[i:]...)
+		}
+
+		if strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "--") {
+			name := strings.SplitN(a[1:], "=", 2)[0]
+			if len(name) > 1 && flag.CommandLine.Lookup(name) != nil {
+				a = "-" + a
+			}
+		}
+
+		out = append(out, a)
+	}
+
+	return out
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// let -conf and friends apply to every subcommand
+	root.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	root.SetArgs(goflagargs(os.Args[1:]))
+
 	if err := root.Execute(); err != nil {
 		log.Fatal(err)
 	}
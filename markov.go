@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mischief/glenda/markov"
 
 	"github.com/kballard/goirc/irc"
+	"github.com/mischief/ndb"
+	"github.com/robfig/cron"
 )
 
 func init() {
@@ -19,63 +31,754 @@ func init() {
 }
 
 type MarkovMod struct {
+	b     *Bot
 	chain *markov.Chain
+
+	mu sync.Mutex
+	// channels to learn from; all of them if empty
+	channels map[string]bool
+	// channels which also learn into the default chain
+	public map[string]bool
+	// the chain each channel sharing one learns into
+	shared map[string]string
+	// whether to keep a chain for each nick in each channel
+	nicks bool
+	// nicks and channels never learned from
+	ignore map[string]bool
+	// how long what's said is remembered; forever if 0
+	retention time.Duration
+
+	cron *cron.Cron
+}
+
+// markovoptions reads the markov config: path (default datadir/markov),
+// order and nword.
+func markovoptions(b *Bot) markov.Options {
+	conf := b.Config.Search("mod", "markov")
+
+	opts := markov.Options{
+		Path:  conf.Search("path"),
+		Order: confint(conf, "order", 0),
+		NWord: confint(conf, "nword", markov.DefaultNWord),
+	}
+
+	if opts.Path == "" {
+		opts.Path = filepath.Join(b.DataDir, "markov")
+	}
+
+	return opts
+}
+
+// markovopen opens the chain in the config. It refuses one built at
+// another order than the configured one, saying how to fix it.
+func markovopen(b *Bot) (*markov.Chain, error) {
+	c, err := markov.NewChain(markovoptions(b))
+
+	if oe, ok := err.(*markov.OrderError); ok {
+		if oe.Text {
+			return nil, fmt.Errorf("%s; run glenda markov rebuild --order %d to change it", err, oe.Want)
+		}
+		return nil, fmt.Errorf("%s, and kept no text to rebuild it from; remove order= from the config to use it as it is", err)
+	}
+
+	return c, err
 }
 
 func (m *MarkovMod) Init(b *Bot, conn irc.SafeConn) error {
-	//conf := b.Config.Search("mod", "markov")
+	m.b = b
+	m.configure()
 
-	c, err := markov.NewChain(filepath.Join(b.DataDir, "markov"))
+	c, err := markovopen(b)
 	if err != nil {
 		return fmt.Errorf("error opening db: %s", err)
 	}
 
 	m.chain = c
 
-	generate := func() string {
-		return m.chain.Generate(rand.Intn(10) + 10)
+	// learn the corpus in the background; ImportOnce skips what's known
+	if corpus := strings.Fields(b.Config.Search("mod", "markov").Search("corpus")); len(corpus) > 0 {
+		go func() {
+			report := func(file string, p markov.Progress, err error) {
+				log.Printf("markov: corpus %s", markovreport(file, p, err))
+			}
+
+			for _, path := range corpus {
+				if err := markovimport(c, path, "", b.Magic, markovskip(b), 0, report); err != nil {
+					log.Printf("markov: corpus %s: %s", path, err)
+				}
+			}
+		}()
 	}
 
-	b.Hook("markov", func(b *Bot, sender, cmd string, args ...string) error {
-		b.Conn.Privmsg(sender, generate())
+	b.HookLine("markov", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if len(args) > 0 {
+			switch args[0] {
+			case "forget":
+				return m.forget(b, l, sender, args[1:])
+			case "stats":
+				return m.stats(b, l, sender, args[1:])
+			case "next":
+				return m.next(b, l, sender, args[1:])
+			case "optout", "optin":
+				who := nickbase(l.Src.Nick)
+				if err := m.chain.OptOut(who, args[0] == "optout"); err != nil {
+					return fmt.Errorf("markov: %s", err)
+				}
+
+				if args[0] == "optout" {
+					b.Conn.Privmsg(sender, fmt.Sprintf("%s: i won't learn from you any more; .markov forget me to forget what i have", l.Src.Nick))
+				} else {
+					b.Conn.Privmsg(sender, fmt.Sprintf("%s: i'll learn from you again", l.Src.Nick))
+				}
+				return nil
+			}
+		}
+
+		c, args, err := m.chainarg(b, l, sender, args)
+		if err != nil {
+			return err
+		}
+
+		b.Conn.Privmsg(sender, markovgenerate(c, strings.Join(args, " ")))
 		return nil
 	})
 
 	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
-		if strings.HasPrefix(l.Args[0], b.Magic) {
+		if strings.HasPrefix(l.Args[1], b.Magic) {
 			return
 		}
 
-		getAddressee := func(line string) string {
-			if s := strings.SplitN(line, " ", 2); len(s) == 2 {
+		if addressee, text := markovaddressee(l.Args[1]); addressee != "" {
+			if strings.EqualFold(addressee, c.Me().Nick) {
+				b.Conn.Privmsg(l.Args[0], markovgenerate(m.replychain(l.Args[0]), text))
+			}
+		} else {
+			m.learn(l)
+		}
+	})
+
+	m.cron = cron.New()
+	m.cron.AddFunc("@hourly", m.prune)
+	m.cron.Start()
 
-				t := rune(s[0][len(s[0])-1])
+	go m.prune()
 
-				if strings.ContainsRune(":,", t) {
-					return s[0][:len(s[0])-1]
-				}
-			}
+	log.Printf("markov module initialized with order %d", c.Order())
+	return nil
+}
+
+// chainarg returns the chain named by a leading #chan, @nick or both in
+// args, or the default chain, and the rest of args. @nick is the nick's
+// chain in #chan, or in the channel asked in. Only admins may use a
+// channel's chains without being in it.
+func (m *MarkovMod) chainarg(b *Bot, l irc.Line, sender string, args []string) (*markov.Chain, []string, error) {
+	name, who := "", "anything"
 
-			return ""
+	var channel string
+	if len(args) > 0 && IsChannel(args[0]) {
+		channel, who, args = args[0], args[0], args[1:]
+
+		if !strings.EqualFold(channel, sender) && !b.CanRead(l.Src, channel) {
+			return nil, nil, fmt.Errorf("you aren't in %s", channel)
 		}
 
-		if addressee := getAddressee(l.Args[1]); addressee != "" {
-			if addressee == c.Me().String() {
-				c.Privmsg(l.Args[0], generate())
+		name = m.chainof(channel)
+	}
+
+	if len(args) > 0 && len(args[0]) > 1 && strings.HasPrefix(args[0], "@") {
+		if channel == "" {
+			if !IsChannel(sender) {
+				return nil, nil, fmt.Errorf("which channel? markov #chan %s", args[0])
 			}
-		} else {
-			m.chain.Build(strings.NewReader(l.Args[1]))
+			channel = sender
 		}
-	})
 
-	log.Printf("markov module initialized")
+		who, args = args[0], args[1:]
+		name = m.nickchain(channel, who[1:])
+	}
+
+	c, err := m.chain.Namespace(name, false)
+	if err == nil && c.Empty() {
+		err = markov.ErrNoChain
+	}
+
+	if err == markov.ErrNoChain {
+		return nil, nil, fmt.Errorf("i don't know %s well enough yet", who)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("markov: %s", err)
+	}
+
+	return c, args, nil
+}
+
+// stats handles .markov stats [#chan] [@nick].
+func (m *MarkovMod) stats(b *Bot, l irc.Line, sender string, args []string) error {
+	c, args, err := m.chainarg(b, l, sender, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 0 {
+		return fmt.Errorf("usage: markov stats [#chan] [@nick]")
+	}
+
+	st, err := c.Stats(5)
+	if err != nil {
+		return fmt.Errorf("markov: %s", err)
+	}
+
+	var top []string
+	for _, wc := range st.Top {
+		top = append(top, fmt.Sprintf("%s (%d)", wc.Word, wc.Count))
+	}
+
+	msg := fmt.Sprintf("order %d, %d starts, %d prefixes, %d n-grams, %d words, %d sentences, db %s",
+		st.Order, st.Starts, st.Prefixes, st.NGrams, st.Words, st.Sentences, markovsize(st.Size))
+
+	if len(top) > 0 {
+		msg += "; top words: " + strings.Join(top, ", ")
+	}
+
+	b.Conn.Privmsg(sender, msg)
+	return nil
+}
+
+// next handles .markov next [#chan] [@nick] words.
+func (m *MarkovMod) next(b *Bot, l irc.Line, sender string, args []string) error {
+	c, args, err := m.chainarg(b, l, sender, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: markov next [#chan] [@nick] words")
+	}
+
+	next, pre := c.Next(strings.Join(args, " "))
+	if pre == nil {
+		return fmt.Errorf("that's fewer than the %d words i look at", c.Order())
+	}
+
+	if len(next) == 0 {
+		b.Conn.Privmsg(sender, fmt.Sprintf("nothing ever came after %q", markov.Join(pre)))
+		return nil
+	}
+
+	var total uint64
+	for _, wc := range next {
+		total += wc.Count
+	}
+
+	if len(next) > 10 {
+		next = next[:10]
+	}
+
+	var cand []string
+	for _, wc := range next {
+		cand = append(cand, fmt.Sprintf("%s %.0f%%", wc.Word, 100*float64(wc.Count)/float64(total)))
+	}
+
+	b.Conn.Privmsg(sender, fmt.Sprintf("after %q: %s", markov.Join(pre), strings.Join(cand, ", ")))
 	return nil
 }
 
+// markovsize formats a number of bytes for people.
+func markovsize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+
+	return fmt.Sprintf("%dB", n)
+}
+
+// forget handles .markov forget me, or for admins, .markov forget nick.
+func (m *MarkovMod) forget(b *Bot, l irc.Line, sender string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: markov forget me")
+	}
+
+	who := args[0]
+	if who == "me" {
+		who = l.Src.Nick
+	} else if !b.IsAdmin(l.Src) {
+		return fmt.Errorf("only admins can make me forget someone else")
+	}
+
+	n, err := m.chain.Forget(nickbase(who))
+	if err != nil {
+		return fmt.Errorf("markov: %s", err)
+	}
+
+	if n == 0 {
+		b.Conn.Privmsg(sender, fmt.Sprintf("%s: i don't remember %s saying anything", l.Src.Nick, who))
+	} else {
+		b.Conn.Privmsg(sender, fmt.Sprintf("%s: forgot what %s said", l.Src.Nick, who))
+	}
+	return nil
+}
+
+// prune forgets what was said longer ago than the retention.
+func (m *MarkovMod) prune() {
+	m.mu.Lock()
+	retention := m.retention
+	m.mu.Unlock()
+
+	if retention <= 0 {
+		return
+	}
+
+	n, err := m.chain.Prune(m.b.Now().Add(-retention))
+	if err != nil {
+		log.Printf("markov: pruning: %s", err)
+		return
+	}
+
+	if n > 0 {
+		log.Printf("markov: pruned %d sentences older than %s", n, retention)
+	}
+}
+
+// configure reads which channels learn, and which share a chain:
+//
+//	channels="#a #b #c"	learn only from these channels
+//	public="#a"		#a also learns into the default chain
+//	share="#a,#b"		#a and #b learn into one chain, named #a
+//	nicks=false		don't keep a chain for each nick
+//	ignore="bot #secret"	never learn from these nicks or channels
+//	retention=90d		forget what was said longer ago than this
+func (m *MarkovMod) configure() {
+	conf := m.b.Config.Search("mod", "markov")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.channels = make(map[string]bool)
+	for _, c := range strings.Fields(conf.Search("channels")) {
+		m.channels[strings.ToLower(c)] = true
+	}
+
+	m.public = make(map[string]bool)
+	for _, c := range strings.Fields(conf.Search("public")) {
+		m.public[strings.ToLower(c)] = true
+	}
+
+	m.shared = make(map[string]string)
+	for _, group := range strings.Fields(conf.Search("share")) {
+		chans := strings.Split(strings.ToLower(group), ",")
+		for _, c := range chans {
+			m.shared[c] = chans[0]
+		}
+	}
+
+	m.nicks = conf.Search("nicks") != "false"
+
+	m.ignore = markovignore(conf)
+
+	m.retention = 0
+	if s := conf.Search("retention"); s != "" {
+		if d, err := ParseDuration(s); err != nil {
+			log.Printf("markov: bad retention: %s", err)
+		} else {
+			m.retention = d
+		}
+	}
+}
+
+// markovignore reads the nicks and channels never learned from.
+func markovignore(conf ndb.RecordSet) map[string]bool {
+	ignore := make(map[string]bool)
+	for _, name := range strings.Fields(conf.Search("ignore")) {
+		if !IsChannel(name) {
+			name = nickbase(name)
+		}
+		ignore[strings.ToLower(name)] = true
+	}
+
+	return ignore
+}
+
+// chainof returns the name of the chain a channel learns into.
+func (m *MarkovMod) chainof(channel string) string {
+	channel = strings.ToLower(channel)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if name, ok := m.shared[channel]; ok {
+		return name
+	}
+
+	return channel
+}
+
+// nickchain returns the name of nick's chain in channel, which only
+// learns what nick says there.
+func (m *MarkovMod) nickchain(channel, nick string) string {
+	return m.chainof(channel) + "@" + nickbase(nick)
+}
+
+// replychain is the channel's chain, if it knows enough to talk, or the
+// default one.
+func (m *MarkovMod) replychain(channel string) *markov.Chain {
+	if IsChannel(channel) {
+		if c, err := m.chain.Namespace(m.chainof(channel), false); err == nil && !c.Empty() {
+			return c
+		}
+	}
+
+	return m.chain
+}
+
+// learn teaches a line said in a channel to the channel's chain, to the
+// nick's chain in it, and, if the channel is public, to the default chain,
+// unless the channel or nick is ignored or opted out. What's said in
+// private isn't learned, so it can't be repeated anywhere.
+func (m *MarkovMod) learn(l irc.Line) {
+	channel := strings.ToLower(l.Args[0])
+	who := nickbase(l.Src.Nick)
+
+	if !IsChannel(channel) {
+		return
+	}
+
+	m.mu.Lock()
+	learn := (len(m.channels) == 0 || m.channels[channel]) && !m.ignore[channel] && !m.ignore[who]
+	public := m.public[channel]
+	nicks := m.nicks
+	m.mu.Unlock()
+
+	if !learn || m.chain.OptedOut(who) {
+		return
+	}
+
+	names := []string{m.chainof(channel)}
+
+	if public {
+		names = append(names, "")
+	}
+
+	if nicks {
+		names = append(names, m.nickchain(channel, who))
+	}
+
+	for _, name := range names {
+		c, err := m.chain.Namespace(name, true)
+		if err != nil {
+			log.Printf("markov: chain %q: %s", name, err)
+			continue
+		}
+
+		if err := c.BuildFrom(who, strings.NewReader(l.Args[1])); err != nil {
+			log.Printf("markov: learning into %q: %s", name, err)
+		}
+	}
+}
+
+// markovgenerate replies about something in text, if the chain knows any
+// of it.
+func markovgenerate(c *markov.Chain, text string) string {
+	if s := c.GenerateFrom(strings.Fields(text), 0); s != "" {
+		return s
+	}
+
+	return c.Generate(0)
+}
+
+// markovaddressee splits "nick: text" or "nick, text" into its parts.
+func markovaddressee(line string) (nick, text string) {
+	if s := strings.SplitN(line, " ", 2); len(s) == 2 && s[0] != "" {
+		if t := s[0][len(s[0])-1]; t == ':' || t == ',' {
+			return s[0][:len(s[0])-1], s[1]
+		}
+	}
+
+	return "", line
+}
+
 func (m *MarkovMod) Reload() error {
+	m.configure()
 	return nil
 }
 
 func (m *MarkovMod) Call(args ...string) error {
 	return nil
 }
+
+// formats of text the markov chain can be taught from
+const (
+	markovText = "text"
+	// irc logs as written by chanlog, irssi, weechat, znc and the like
+	markovLog = "log"
+	// chanlog's json logs
+	markovJSON = "json"
+)
+
+var (
+	// [12:34], 12:34:56, 2017-01-02 12:34:56, Jan 02 12:34:56
+	markovStamp = `(?:\[[^\]]*\d\d:\d\d[^\]]*\]|(?:\d{4}-\d\d-\d\d[ T])?\d\d:\d\d(?::\d\d)?|[A-Z][a-z]{2} +\d+ \d\d:\d\d:\d\d)`
+
+	markovLogRes = []*regexp.Regexp{
+		// 12:34 <@nick> text
+		regexp.MustCompile(`^(` + markovStamp + `)\s+<[~&@%+ ]?([^>\s]+)>\s(.*)$`),
+		// weechat's 2017-01-02 12:34:56<tab>@nick<tab>text
+		regexp.MustCompile(`^(` + markovStamp + `)\t[~&@%+]?([^\t]+)\t(.*)$`),
+	}
+
+	// weechat's prefixes for joins, parts, actions and so on
+	markovLogNotNicks = map[string]bool{
+		"-->": true, "<--": true, "--": true, "-!-": true, "=!=": true,
+		"*": true, " *": true, "***": true,
+	}
+)
+
+// markovlogline returns who said the message in a line of an irc log,
+// when, and what, if it is one. Stamps without a date are taken to be on
+// day.
+func markovlogline(line string, day time.Time) (markov.Message, bool) {
+	for _, re := range markovLogRes {
+		if m := re.FindStringSubmatch(line); m != nil && !markovLogNotNicks[m[2]] {
+			return markov.Message{Who: m[2], Time: markovlogtime(m[1], day), Text: m[3]}, true
+		}
+	}
+
+	return markov.Message{}, false
+}
+
+// markovlogtime reads a log's time stamp, or returns day if it can't.
+func markovlogtime(stamp string, day time.Time) time.Time {
+	stamp = strings.Trim(stamp, "[]")
+	loc := day.Location()
+
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, stamp, loc); err == nil {
+			return t
+		}
+	}
+
+	if t, err := time.ParseInLocation("Jan _2 15:04:05", stamp, loc); err == nil {
+		return time.Date(day.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+	}
+
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, stamp, loc); err == nil {
+			return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+		}
+	}
+
+	return day
+}
+
+var markovDate = regexp.MustCompile(`\d{4}-\d\d-\d\d`)
+
+// markovday returns the day a log covers, from a yyyy-mm-dd in its name,
+// as chanlog, znc and others write, or else the day it was last written.
+func markovday(path string, fi os.FileInfo) time.Time {
+	if d := markovDate.FindString(filepath.Base(path)); d != "" {
+		if t, err := time.ParseInLocation("2006-01-02", d, time.Local); err == nil {
+			return t
+		}
+	}
+
+	y, m, d := fi.ModTime().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// markovformat guesses the format of a file from its name.
+func markovformat(path string) string {
+	path = strings.TrimSuffix(path, ".gz")
+
+	switch filepath.Ext(path) {
+	case ".log":
+		return markovLog
+	case ".jsonl":
+		return markovJSON
+	}
+
+	return markovText
+}
+
+// markovsentence ends a line with a full stop if it has no other ending,
+// so that lines of chat are learned as separate sentences.
+func markovsentence(s string) string {
+	s = strings.TrimSpace(s)
+	if s != "" && !strings.ContainsAny(s[len(s)-1:], ".?!") {
+		s += "."
+	}
+	return s
+}
+
+// markovread reads a file in format, ungzipping it if need be, and returns
+// the text in it to learn and, for logs, the messages it holds. Lines of
+// logs starting with magic are commands, and are skipped, as are messages
+// skip says to leave out, though their text is still returned.
+func markovread(path, format, magic string, skip func(nick, channel string) bool) ([]byte, []markov.Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var r io.Reader = f
+
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		defer zr.Close()
+		r = zr
+	}
+
+	if format == markovText {
+		text, err := ioutil.ReadAll(r)
+		if err == nil && bytes.IndexByte(text, 0) >= 0 {
+			err = fmt.Errorf("not a text file")
+		}
+		return text, nil, err
+	}
+
+	var (
+		buf  bytes.Buffer
+		msgs []markov.Message
+	)
+
+	day := markovday(path, fi)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	for s.Scan() {
+		var (
+			msg     markov.Message
+			channel string
+		)
+
+		switch format {
+		case markovLog:
+			var ok bool
+			if msg, ok = markovlogline(s.Text(), day); !ok {
+				continue
+			}
+		case markovJSON:
+			var e LogEvent
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil || e.Type != "message" {
+				continue
+			}
+			msg = markov.Message{Who: e.Nick, Time: e.Time, Text: e.Text}
+			channel = e.Channel
+		default:
+			return nil, nil, fmt.Errorf("unknown format %q", format)
+		}
+
+		if msg.Text = markovsentence(msg.Text); msg.Text == "" || (magic != "" && strings.HasPrefix(msg.Text, magic)) {
+			continue
+		}
+
+		buf.WriteString(msg.Text)
+		buf.WriteByte('\n')
+
+		if skip == nil || !skip(msg.Who, channel) {
+			msg.Who = nickbase(msg.Who)
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), msgs, nil
+}
+
+// markovimport teaches a chain the files in path, which may be a file or a
+// directory of them. Files it has already learned are skipped. Messages in
+// logs are learned as said by their nick at their time, unless skip says
+// to leave them out. report is called with the outcome for each file, or
+// its progress while importing.
+func markovimport(c *markov.Chain, path, format, magic string, skip func(nick, channel string) bool, batch int, report func(file string, p markov.Progress, err error)) error {
+	return filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(fi.Name(), ".") && file != path {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f := format
+		if f == "" {
+			f = markovformat(file)
+		}
+
+		text, msgs, err := markovread(file, f, magic, skip)
+		if err != nil {
+			report(file, markov.Progress{}, err)
+			return nil
+		}
+
+		// hash what's learned, not the file, so a log gzipped by
+		// chanlog is still the same log
+		sum := sha256.Sum256(text)
+
+		progress := func(p markov.Progress) {
+			report(file, p, nil)
+		}
+
+		var pr markov.Progress
+		if f == markovText {
+			pr, err = c.ImportOnce(sum[:], file, bytes.NewReader(text), batch, progress)
+		} else {
+			pr, err = c.ImportChatOnce(sum[:], file, msgs, batch, progress)
+		}
+
+		if err != nil || pr.Sentences == 0 {
+			report(file, pr, err)
+		}
+
+		return nil
+	})
+}
+
+// markovskip returns what imports leave out: what the bot said, and what
+// nicks or channels in ignore did.
+func markovskip(b *Bot) func(nick, channel string) bool {
+	ignore := markovignore(b.Config.Search("mod", "markov"))
+
+	return func(nick, channel string) bool {
+		return strings.EqualFold(nick, b.IrcConfig.Nick) || ignore[nickbase(nick)] || ignore[strings.ToLower(channel)]
+	}
+}
+
+func markovreport(file string, p markov.Progress, err error) string {
+	switch {
+	case err == markov.ErrImported:
+		return fmt.Sprintf("%s: already imported", file)
+	case err != nil:
+		return fmt.Sprintf("%s: %s", file, err)
+	case p.Sentences == 0:
+		return fmt.Sprintf("%s: nothing to learn", file)
+	}
+
+	return fmt.Sprintf("%s: %s", file, p)
+}
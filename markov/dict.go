@@ -0,0 +1,134 @@
+package markov
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// words are interned as ids shared by every chain in a database, so
+// suffixes can store a varint rather than the word.
+var (
+	// word to uvarint id
+	wordidBucket = []byte("wordid")
+	// big endian id to word
+	idwordBucket = []byte("idword")
+)
+
+var errReadOnly = errors.New("markov: interning a word in a read only transaction")
+
+// dict is the in-memory copy of a database's word ids, guarded by the
+// store's mu.
+type dict struct {
+	ids   map[string]uint64
+	words map[uint64]string
+}
+
+func newdict() *dict {
+	return &dict{
+		ids:   make(map[string]uint64),
+		words: make(map[uint64]string),
+	}
+}
+
+func loaddict(tx Tx) (*dict, error) {
+	d := newdict()
+
+	err := tx.Bucket(idwordBucket).ForEach(func(k, v []byte) error {
+		if len(k) != 8 {
+			return errors.New("markov: bad word id")
+		}
+
+		d.add(binary.BigEndian.Uint64(k), string(v))
+		return nil
+	})
+
+	return d, err
+}
+
+func (d *dict) add(id uint64, word string) {
+	d.ids[word] = id
+	d.words[id] = word
+}
+
+// in returns the dict for use in tx.
+func (d *dict) in(tx Tx) *dicttx {
+	return &dicttx{dict: d, tx: tx}
+}
+
+// dicttx is a dict within a transaction. Words it interns are only added
+// to the dict by commit, once the transaction has succeeded.
+type dicttx struct {
+	*dict
+	tx    Tx
+	added *dict
+}
+
+// id returns the id of word, interning it if it has none.
+func (d *dicttx) id(word string) (uint64, error) {
+	if id, ok := d.ids[word]; ok {
+		return id, nil
+	}
+
+	if d.added != nil {
+		if id, ok := d.added.ids[word]; ok {
+			return id, nil
+		}
+	}
+
+	if !d.tx.Writable() {
+		return 0, errReadOnly
+	}
+
+	bu := d.tx.Bucket(wordidBucket)
+
+	id, err := bu.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	v := make([]byte, binary.MaxVarintLen64)
+	if err := bu.Put([]byte(word), v[:binary.PutUvarint(v, id)]); err != nil {
+		return 0, err
+	}
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+
+	if err := d.tx.Bucket(idwordBucket).Put(k, []byte(word)); err != nil {
+		return 0, err
+	}
+
+	if d.added == nil {
+		d.added = newdict()
+	}
+
+	d.added.add(id, word)
+	return id, nil
+}
+
+// word returns the word with id.
+func (d *dicttx) word(id uint64) (string, bool) {
+	if w, ok := d.words[id]; ok {
+		return w, true
+	}
+
+	if d.added != nil {
+		w, ok := d.added.words[id]
+		return w, ok
+	}
+
+	return "", false
+}
+
+// commit adds the words interned in the transaction to the dict.
+func (d *dicttx) commit() {
+	if d.added == nil {
+		return
+	}
+
+	for id, w := range d.added.words {
+		d.dict.add(id, w)
+	}
+
+	d.added = nil
+}
@@ -0,0 +1,281 @@
+package markov
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// kinds of exported records
+const (
+	exportOrder  = "order"
+	exportSource = "source"
+	exportStart  = "start"
+	exportGram   = "gram"
+	exportBack   = "back"
+	exportWord   = "word"
+	exportOptOut = "optout"
+)
+
+// exported is a line of a chain written by Export.
+type exported struct {
+	Type string `json:"type"`
+	// namespace, "" for the default chain
+	Chain string `json:"chain,omitempty"`
+
+	// order
+	Order int `json:"order,omitempty"`
+
+	// source
+	Source *source `json:"source,omitempty"`
+
+	// start, gram and back; words are separated by spaces
+	Prefix string            `json:"prefix,omitempty"`
+	Next   map[string]uint32 `json:"next,omitempty"`
+
+	// word
+	Word  string `json:"word,omitempty"`
+	Count uint64 `json:"count,omitempty"`
+	Form  string `json:"form,omitempty"`
+	NForm uint64 `json:"nform,omitempty"`
+
+	// optout
+	Who string `json:"who,omitempty"`
+}
+
+// Export writes the chain, and every other chain in its database, to w as
+// lines of JSON which Load can read into another database. Who opted out
+// goes with them.
+func (c *Chain) Export(w io.Writer) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names, err := c.Namespaces()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(exported{Type: exportOrder, Order: c.order}); err != nil {
+		return err
+	}
+
+	err = c.db.View(func(tx Tx) error {
+		d := c.dict.in(tx)
+
+		err := tx.Bucket(optoutBucket).ForEach(func(k, v []byte) error {
+			return enc.Encode(exported{Type: exportOptOut, Who: string(k)})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, name := range append([]string{""}, names...) {
+			nc := &Chain{store: c.store}
+			if name != "" {
+				nc.ns = []byte(name)
+			}
+
+			err := nc.bkt(tx, sourceBucket).ForEach(func(k, v []byte) error {
+				src := decodesource(v)
+				return enc.Encode(exported{Type: exportSource, Chain: name, Source: &src})
+			})
+
+			if err != nil {
+				return err
+			}
+
+			err = nc.bkt(tx, prefixBucket).ForEach(func(k, v []byte) error {
+				return enc.Encode(exported{Type: exportStart, Chain: name, Prefix: string(v)})
+			})
+
+			if err != nil {
+				return err
+			}
+
+			for _, g := range []struct {
+				typ    string
+				bucket []byte
+			}{{exportGram, gramsBucket}, {exportBack, reverseBucket}} {
+				err := nc.bkt(tx, g.bucket).ForEach(func(k, v []byte) error {
+					suf := NewSuffix()
+					if err := suf.decode(d, v); err != nil {
+						return fmt.Errorf("%q: %s", k, err)
+					}
+
+					return enc.Encode(exported{Type: g.typ, Chain: name, Prefix: string(k), Next: suf.M})
+				})
+
+				if err != nil {
+					return err
+				}
+			}
+
+			err = nc.bkt(tx, wordsBucket).ForEach(func(k, v []byte) error {
+				wi := parseword(v)
+				return enc.Encode(exported{Type: exportWord, Chain: name, Word: string(k), Count: wi.count, Form: wi.form, NForm: wi.nform})
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Load reads chains written by Export into c's database, adding to what
+// it already knows. If they were exported at the same order as c's, their
+// n-grams are merged in; otherwise they're learned again from the text
+// they kept. It returns the number of lines read.
+func (c *Chain) Load(r io.Reader) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16*1024*1024)
+
+	var (
+		lines   int
+		order   int
+		sources int
+		// pending changes, by chain
+		batches = make(map[string]*batch)
+		pending int
+	)
+
+	flush := func() error {
+		for name, b := range batches {
+			nc, err := c.namespace(name, true)
+			if err != nil {
+				return err
+			}
+
+			if err := nc.flush(b); err != nil {
+				return err
+			}
+		}
+
+		batches = make(map[string]*batch)
+		pending = 0
+		return nil
+	}
+
+	for s.Scan() {
+		lines++
+
+		var e exported
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return lines, fmt.Errorf("markov: line %d: %s", lines, err)
+		}
+
+		if lines == 1 {
+			if e.Type != exportOrder || e.Order < 1 {
+				return lines, errors.New("markov: not an exported chain")
+			}
+
+			order = e.Order
+			continue
+		}
+
+		b := batches[e.Chain]
+		if b == nil {
+			b = newbatch()
+			batches[e.Chain] = b
+		}
+
+		// at another order only the text is any use
+		if order != c.order && e.Type != exportSource && e.Type != exportOptOut {
+			continue
+		}
+
+		switch e.Type {
+		case exportOptOut:
+			if err := c.OptOut(e.Who, true); err != nil {
+				return lines, err
+			}
+		case exportSource:
+			if e.Source == nil {
+				return lines, fmt.Errorf("markov: line %d: no source", lines)
+			}
+
+			sources++
+			b.source = append(b.source, *e.Source)
+
+			if order != c.order {
+				nc, err := c.namespace(e.Chain, true)
+				if err != nil {
+					return lines, err
+				}
+
+				nc.relearn(b, *e.Source)
+			}
+		case exportStart:
+			if len(strings.Fields(e.Prefix)) != order {
+				return lines, fmt.Errorf("markov: line %d: bad start %q", lines, e.Prefix)
+			}
+
+			b.starts[e.Prefix] = true
+		case exportGram, exportBack:
+			g := b.grams
+			if e.Type == exportBack {
+				g = b.back
+			}
+
+			for w, n := range e.Next {
+				suf, ok := g[e.Prefix]
+				if !ok {
+					suf = NewSuffix()
+					g[e.Prefix] = suf
+				}
+
+				suf.M[w] += n
+			}
+		case exportWord:
+			b.counts[e.Word] += e.Count
+
+			if e.NForm > 0 {
+				if b.forms[e.Word] == nil {
+					b.forms[e.Word] = make(map[string]uint64)
+				}
+
+				b.forms[e.Word][e.Form] += e.NForm
+			}
+		default:
+			return lines, fmt.Errorf("markov: line %d: unknown type %q", lines, e.Type)
+		}
+
+		if pending++; pending >= DefaultBatch {
+			if err := flush(); err != nil {
+				return lines, err
+			}
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return lines, err
+	}
+
+	if lines == 0 {
+		return 0, errors.New("markov: not an exported chain")
+	}
+
+	if order != c.order && sources == 0 {
+		return lines, fmt.Errorf("markov: chain exported at order %d kept no text to learn at order %d", order, c.order)
+	}
+
+	return lines, flush()
+}
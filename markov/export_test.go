@@ -0,0 +1,99 @@
+package markov
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChainExport(t *testing.T) {
+	c := memchain(t, Options{Order: 2}, 1)
+	defer c.Close()
+
+	if err := c.BuildFrom("bob", strings.NewReader("Bob likes the cat. the cat sat on the mat.")); err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := c.Namespace("#chan", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nc.Build(strings.NewReader("the dog ate the rat.")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.OptOut("eve", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same chain exports the same way each time
+	for i := 0; i < 5; i++ {
+		var again bytes.Buffer
+		if err := c.Export(&again); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+			t.Fatalf("export %d differs:\n%s\nfrom:\n%s", i, again.Bytes(), buf.Bytes())
+		}
+	}
+
+	same := memchain(t, Options{Order: 2}, 1)
+	defer same.Close()
+
+	if _, err := same.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "#chan"} {
+		from, _ := c.Namespace(name, false)
+		to, err := same.Namespace(name, false)
+		if err != nil {
+			t.Fatalf("%q: %s", name, err)
+		}
+
+		want, _ := from.Stats(10)
+		got, _ := to.Stats(10)
+		want.Size, got.Size = 0, 0
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: stats %+v want %+v", name, got, want)
+		}
+
+		if g, w := to.Generate(20), from.Generate(20); g != w {
+			t.Errorf("%q: generated %q want %q", name, g, w)
+		}
+	}
+
+	if !same.OptedOut("eve") {
+		t.Error("opt out not loaded")
+	}
+
+	if n, err := same.Forget("bob"); err != nil || n != 2 {
+		t.Errorf("forgot %d sentences: %v", n, err)
+	}
+
+	// another order relearns the text
+	other := memchain(t, Options{Order: 1}, 1)
+	defer other.Close()
+
+	if _, err := other.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WordCount{{"cat", 2}, {"mat", 1}}
+	if next, _ := other.Next("the"); !reflect.DeepEqual(next, want) {
+		t.Errorf("next after the %v want %v", next, want)
+	}
+
+	if _, err := other.Load(strings.NewReader("hello\n")); err == nil {
+		t.Error("loaded garbage")
+	}
+}
@@ -1,247 +1,1834 @@
 package markov
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/boltdb/bolt"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-// order 3 markov chain stored in boltdb.
+// markov chain stored in boltdb, or any other Storage.
 
 const (
-	markovOrder = 3
+	// DefaultOrder is the order of new chains, and of chains made
+	// before the order was recorded.
+	DefaultOrder = 3
+
+	// DefaultNWord is the most words Generate returns by default.
+	DefaultNWord = 30
+)
+
+var (
+	gramsBucket    = []byte("markov")
+	prefixBucket   = []byte("prefix")
+	metaBucket     = []byte("meta")
+	sourceBucket   = []byte("source")
+	importedBucket = []byte("imported")
+	// n-grams of sentences read backward
+	reverseBucket = []byte("reverse")
+	// how often each word was seen
+	wordsBucket = []byte("words")
+	// namespaced chains, each a bucket of the buckets above but meta
+	nsBucket = []byte("ns")
+	// speakers who don't want to be learned from
+	optoutBucket = []byte("optout")
+
+	// the buckets every chain has
+	chainBuckets = [][]byte{gramsBucket, prefixBucket, sourceBucket, importedBucket, reverseBucket, wordsBucket}
+	// those of them keyed by putseq
+	seqBuckets = [][]byte{prefixBucket, sourceBucket}
+	// source keys by time, for those that expire
+	timeBucket = []byte("time")
+
+	orderKey = []byte("order")
+
+	// ErrImported is returned by ImportOnce and ImportChatOnce for text
+	// already learned.
+	ErrImported = errors.New("markov: already imported")
 )
 
+// Options configures a Chain.
+type Options struct {
+	// Path is the bolt database holding the chain.
+	Path string
+
+	// Storage holds the chain instead of the bolt database in Path.
+	Storage Storage
+
+	// Order is the number of words in a prefix. A chain's order is fixed
+	// when it is created; 0 means whatever the database already has, or
+	// DefaultOrder for a new one.
+	Order int
+
+	// NWord is the most words Generate returns when asked for 0.
+	NWord int
+
+	// Rand is the source of the choices made generating text; nil means
+	// math/rand's. Seed one for repeatable output.
+	Rand rand.Source
+}
+
+// store is the database a chain and its namespaces are kept in.
+type store struct {
+	db   Storage
+	path string
+
+	nword int
+	rnd   *rand.Rand
+
+	mu    sync.RWMutex
+	order int
+	dict  *dict
+	// chains opened, by namespace; "" is the default chain
+	chains map[string]*Chain
+}
+
 // Chain contains a map ("chain") of prefixes to a list of suffixes.
-// A prefix is a string of prefixLen words joined with spaces.
+// A prefix is a string of order words joined with spaces.
 // A suffix is a single word. A prefix can have multiple suffixes.
+//
+// A database holds a default chain, and any number of others in
+// namespaces (see Namespace) which share its order.
 type Chain struct {
-	db *bolt.DB
+	*store
 
-	// markov bucket name
-	bucket []byte
-	// prefix bucket name
-	prefix []byte
+	// namespace, nil for the default chain
+	ns []byte
 
-	// in-memory prefix store
+	// in-memory prefix store, guarded by mu
 	prefixes map[string]bool
+	// the same in the order they were learned, to pick from
+	starts []string
 }
 
-// NewChain returns a new Chain with prefixes of prefixLen words.
-func NewChain(dbpath string) (*Chain, error) {
-	c := &Chain{}
+// OrderError is returned by NewChain for a chain built with a different
+// order than the one asked for.
+type OrderError struct {
+	Path        string
+	Order, Want int
 
-	db, err := bolt.Open(dbpath, 0600, nil)
-	if err != nil {
-		return nil, err
+	// Text is set if the chains in the database kept text they can be
+	// rebuilt from at another order.
+	Text bool
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("markov: %s has order %d, not %d", e.Path, e.Order, e.Want)
+}
+
+// NewChain opens the chain in opts.Storage, or the bolt database in
+// opts.Path, creating it if need be. It fails with an *OrderError if the
+// chain was built with a different order than opts.Order.
+func NewChain(opts Options) (*Chain, error) {
+	if opts.Order < 0 {
+		return nil, fmt.Errorf("markov: bad order %d", opts.Order)
+	}
+
+	c := &Chain{
+		store: &store{
+			path:   opts.Path,
+			nword:  opts.NWord,
+			chains: make(map[string]*Chain),
+		},
+	}
+
+	if c.nword <= 0 {
+		c.nword = DefaultNWord
+	}
+
+	if opts.Rand != nil {
+		c.rnd = rand.New(&lockedSource{src: opts.Rand})
+	}
+
+	c.chains[""] = c
+
+	db := opts.Storage
+	if db == nil {
+		var err error
+		if db, err = openbolt(opts.Path); err != nil {
+			return nil, err
+		}
 	}
 
 	c.db = db
 
-	c.bucket = []byte("markov")
-	c.prefix = []byte("prefix")
+	err := db.Update(func(tx Tx) error {
+		for _, name := range [][]byte{metaBucket, nsBucket, optoutBucket, wordidBucket, idwordBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(c.bucket)
-		if err != nil {
+		if err := initchain(tx); err != nil {
 			return err
 		}
 
-		_, err = tx.CreateBucketIfNotExists(c.prefix)
-		if err != nil {
-			return err
+		meta := tx.Bucket(metaBucket)
+
+		if v := meta.Get(orderKey); v != nil {
+			order, err := strconv.Atoi(string(v))
+			if err != nil || order < 1 {
+				return fmt.Errorf("markov: %s has a bad order %q", opts.Path, v)
+			}
+
+			c.order = order
+		} else {
+			// chains from before the order was recorded were all order 3
+			c.order = DefaultOrder
+
+			if k, _ := tx.Bucket(gramsBucket).Cursor().First(); k == nil && opts.Order != 0 {
+				c.order = opts.Order
+			}
+
+			if err := meta.Put(orderKey, []byte(strconv.Itoa(c.order))); err != nil {
+				return err
+			}
 		}
 
-		return nil
-	})
+		if opts.Order != 0 && opts.Order != c.order {
+			return &OrderError{Path: opts.Path, Order: c.order, Want: opts.Order, Text: hastext(tx)}
+		}
 
-	c.prefixes, _ = c.getprefixes()
+		var err error
+		c.dict, err = loaddict(tx)
+		return err
+	})
 
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
 
+	if err = c.loadprefixes(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return c, nil
 }
 
-func (c *Chain) upgram(pre Prefix, suf *Suffix) error {
-	k := pre.Key()
-	v := suf.Value()
+// hastext reports whether any chain in the database kept text it learned.
+func hastext(tx Tx) bool {
+	if k, _ := tx.Bucket(sourceBucket).Cursor().First(); k != nil {
+		return true
+	}
 
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket(c.bucket).Put(k, v)
-		return err
+	ns := tx.Bucket(nsBucket)
+	found := false
+
+	ns.ForEach(func(name, v []byte) error {
+		if bu := ns.Bucket(name).Bucket(sourceBucket); bu != nil {
+			if k, _ := bu.Cursor().First(); k != nil {
+				found = true
+			}
+		}
+		return nil
 	})
 
-	return err
+	return found
 }
 
-func (c *Chain) getgram(pre Prefix) *Suffix {
-	k := pre.Key()
-	s := NewSuffix()
+// all returns the default chain and every namespace; c.mu is held.
+func (c *Chain) all() ([]*Chain, error) {
+	names, err := c.Namespaces()
+	if err != nil {
+		return nil, err
+	}
 
-	c.db.View(func(tx *bolt.Tx) error {
-		v := tx.Bucket(c.bucket).Get(k)
-		if v != nil {
-			if err := json.Unmarshal(v, &s); err != nil {
-				return err
-			}
+	chains := []*Chain{c.chains[""]}
+
+	for _, name := range names {
+		nc, err := c.namespace(name, false)
+		if err != nil {
+			return nil, err
 		}
+		chains = append(chains, nc)
+	}
 
-		return nil
-	})
+	return chains, nil
+}
 
-	return s
+// Close closes the chain's database, and so all its namespaces.
+func (c *Chain) Close() error {
+	return c.db.Close()
+}
+
+// ErrNoChain is returned by Namespace for a chain that doesn't exist.
+var ErrNoChain = errors.New("markov: no such chain")
+
+// Namespace returns the chain called name in the same database as c, or
+// the default chain if name is "". If there is no such chain, it is made
+// if create is set, and otherwise ErrNoChain is returned.
+func (c *Chain) Namespace(name string, create bool) (*Chain, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.namespace(name, create)
 }
 
-// write a sentence prefix into the db
-func (c *Chain) putprefix(pre Prefix) error {
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		bu := tx.Bucket(c.prefix)
-		seq, err := bu.NextSequence()
+// namespace is Namespace with c.mu held.
+func (c *Chain) namespace(name string, create bool) (*Chain, error) {
+	if nc, ok := c.chains[name]; ok {
+		return nc, nil
+	}
+
+	nc := &Chain{store: c.store, ns: []byte(name)}
+
+	err := c.db.Update(func(tx Tx) error {
+		ns := tx.Bucket(nsBucket)
+
+		if ns.Bucket(nc.ns) == nil && !create {
+			return ErrNoChain
+		}
+
+		bu, err := ns.CreateBucketIfNotExists(nc.ns)
 		if err != nil {
 			return err
 		}
 
-		k := []byte(fmt.Sprintf("%d", seq))
-		v := pre.Key()
-		return tx.Bucket(c.prefix).Put(k, v)
+		return initchain(bu)
 	})
 
-	return err
-}
+	if err != nil {
+		return nil, err
+	}
 
-func (c *Chain) getprefixes() (map[string]bool, error) {
-	r := make(map[string]bool)
+	if err = nc.loadprefixes(); err != nil {
+		return nil, err
+	}
+
+	c.chains[name] = nc
+	return nc, nil
+}
 
-	err := c.db.View(func(tx *bolt.Tx) error {
-		bu := tx.Bucket(c.prefix)
+// Namespaces lists the names of the chains in c's database, other than
+// the default one.
+func (c *Chain) Namespaces() ([]string, error) {
+	var names []string
 
-		return bu.ForEach(func(k, v []byte) error {
-			r[string(v)] = true
+	err := c.db.View(func(tx Tx) error {
+		return tx.Bucket(nsBucket).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
 			return nil
 		})
 	})
 
-	return r, err
+	return names, err
 }
 
-func scanSentence(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+// Name returns the chain's namespace, "" for the default chain.
+func (c *Chain) Name() string {
+	return string(c.ns)
+}
+
+// Empty reports whether the chain has learned anything.
+func (c *Chain) Empty() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.prefixes) == 0
+}
+
+// holder is a Tx or a Bucket, which both hold buckets.
+type holder interface {
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+}
+
+// initchain makes the buckets of a chain in h, bringing those made by
+// older versions up to date.
+func initchain(h holder) error {
+	for _, name := range chainBuckets {
+		if _, err := h.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
 	}
 
-	if i := bytes.IndexAny(data, ".?!"); i >= 0 {
-		return i + 1, data[0:i], nil
+	for _, name := range seqBuckets {
+		if err := reseq(h.Bucket(name)); err != nil {
+			return err
+		}
+	}
+
+	if h.Bucket(timeBucket) != nil {
+		return nil
 	}
 
-	if atEOF {
-		return len(data), data, nil
+	idx, err := h.CreateBucketIfNotExists(timeBucket)
+	if err != nil {
+		return err
 	}
 
-	return 0, nil, nil
+	return h.Bucket(sourceBucket).ForEach(func(k, v []byte) error {
+		if s := decodesource(v); s.expires() {
+			return idx.Put(timekey(s.Time, k), []byte{})
+		}
+		return nil
+	})
 }
 
-// Build reads text from the provided Reader and
-// parses it into prefixes and suffixes that are stored in Chain.
-func (c *Chain) Build(r io.Reader) error {
-	scans := bufio.NewScanner(r)
-	scans.Split(scanSentence)
+// holder returns what holds the chain's buckets.
+func (c *Chain) holder(tx Tx) holder {
+	if c.ns == nil {
+		return tx
+	}
 
-	for scans.Scan() {
-		sent := strings.ToLower(scans.Text())
-		sentr := strings.NewReader(sent)
+	return tx.Bucket(nsBucket).Bucket(c.ns)
+}
 
-		scw := bufio.NewScanner(sentr)
-		scw.Split(bufio.ScanWords)
+// bkt returns one of the chain's buckets.
+func (c *Chain) bkt(tx Tx, name []byte) Bucket {
+	if c.ns == nil {
+		return tx.Bucket(name)
+	}
 
-		words := 0
-		first := true
+	return tx.Bucket(nsBucket).Bucket(c.ns).Bucket(name)
+}
 
-		p := make(Prefix, markovOrder)
+// Order returns the number of words in the chain's prefixes.
+func (c *Chain) Order() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.order
+}
 
-		for scw.Scan() {
-			word := scw.Text()
-			words++
-			if words < markovOrder+1 {
-				p.Shift(word)
-				continue
-			}
+func (c *Chain) getgram(pre Prefix) *Suffix {
+	s := NewSuffix()
 
-			if first {
-				c.prefixes[p.String()] = true
-				c.putprefix(p)
-				first = false
-			}
+	c.db.View(func(tx Tx) error {
+		return getsuffix(c.dict.in(tx), c.bkt(tx, gramsBucket), pre.Key(), s)
+	})
 
-			suf := c.getgram(p)
-			suf.Insert(word)
-			c.upgram(p, suf)
+	return s
+}
 
-			p.Shift(word)
-		}
+func getsuffix(in interner, bu Bucket, k []byte, s *Suffix) error {
+	if v := bu.Get(k); v != nil {
+		return s.decode(in, v)
 	}
 
 	return nil
 }
 
-// Generate returns a string of at most n words generated from Chain.
-func (c *Chain) Generate(n int) string {
-	nprefix := len(c.prefixes)
-	if nprefix == 0 {
-		return ""
+func putsuffix(in interner, bu Bucket, k []byte, s *Suffix) error {
+	v, err := s.encode(in)
+	if err != nil {
+		return err
 	}
 
-	if n < markovOrder {
-		return ""
+	return bu.Put(k, v)
+}
+
+// update runs fn in a write transaction with the dict, keeping the words
+// fn interns if it succeeds; c.mu is held.
+func (c *Chain) update(fn func(tx Tx, d *dicttx) error) error {
+	var d *dicttx
+
+	err := c.db.Update(func(tx Tx) error {
+		d = c.dict.in(tx)
+		return fn(tx, d)
+	})
+
+	if err == nil {
+		d.commit()
+	}
+
+	return err
+}
+
+// loadprefixes reads the chain's sentence starts from the db.
+func (c *Chain) loadprefixes() error {
+	c.prefixes = make(map[string]bool)
+	c.starts = nil
+
+	return c.db.View(func(tx Tx) error {
+		return c.bkt(tx, prefixBucket).ForEach(func(k, v []byte) error {
+			c.addstart(string(v))
+			return nil
+		})
+	})
+}
+
+// addstart remembers a sentence start; c.mu is held.
+func (c *Chain) addstart(k string) {
+	if !c.prefixes[k] {
+		c.prefixes[k] = true
+		c.starts = append(c.starts, k)
 	}
+}
 
-	var p Prefix
+// intn returns a random number in [0,n) from the chain's source.
+func (c *Chain) intn(n int) int {
+	if c.rnd == nil {
+		return rand.Intn(n)
+	}
 
-	rnd := rand.Intn(nprefix)
-	i := 0
-	for k, _ := range c.prefixes {
-		if i == rnd {
-			p = Prefix(strings.Split(k, " "))
-			break
+	return c.rnd.Intn(n)
+}
+
+// lockedSource makes a rand.Source safe for the readers of a chain, who
+// only share a read lock.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// DefaultBatch is how many sentences Build learns per transaction.
+const DefaultBatch = 1000
+
+// Progress reports how far an Import has got.
+type Progress struct {
+	Sentences int
+	Words     int
+	Elapsed   time.Duration
+}
+
+// Rate returns the words learned per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(p.Words) / p.Elapsed.Seconds()
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("%d sentences, %d words in %s (%.0f words/s)", p.Sentences, p.Words, p.Elapsed, p.Rate())
+}
+
+// grams are suffix counts by prefix key.
+type grams map[string]*Suffix
+
+func (g grams) insert(k, word string) {
+	suf, ok := g[k]
+	if !ok {
+		suf = NewSuffix()
+		g[k] = suf
+	}
+
+	suf.Insert(word)
+}
+
+// merge adds the counts in g to those in a bucket.
+func (g grams) merge(in interner, bu Bucket) error {
+	for k, delta := range g {
+		suf := NewSuffix()
+		if err := getsuffix(in, bu, []byte(k), suf); err != nil {
+			return err
+		}
+
+		suf.Merge(delta)
+
+		if err := putsuffix(in, bu, []byte(k), suf); err != nil {
+			return err
 		}
-		i++
 	}
 
-	var words []string
+	return nil
+}
 
-	words = append(words, p...)
+// subtract takes the counts in g from those in a bucket, deleting
+// prefixes left with no suffixes.
+func (g grams) subtract(in interner, bu Bucket) error {
+	for k, delta := range g {
+		suf := NewSuffix()
+		if err := getsuffix(in, bu, []byte(k), suf); err != nil {
+			return err
+		}
 
-	for {
-		suf := c.getgram(p)
+		suf.Subtract(delta)
+
+		var err error
 		if len(suf.M) == 0 {
-			break
+			err = bu.Delete([]byte(k))
+		} else {
+			err = putsuffix(in, bu, []byte(k), suf)
 		}
 
-		word := suf.Pick()
+		if err != nil {
+			return err
+		}
+	}
 
-		words = append(words, word)
+	return nil
+}
 
-		if strings.Contains(word, ".?!") {
-			break
-		}
-		p.Shift(word)
+// source is a sentence as it was learned, kept so the chain can be
+// rebuilt, or the sentence forgotten.
+type source struct {
+	// who said it, if anyone
+	Who string `json:"w,omitempty"`
+	// when it was learned, in unix seconds
+	Time int64  `json:"t,omitempty"`
+	Text string `json:"s"`
+	// how Text is kept: as it was said, or sourceTokens
+	V int `json:"v,omitempty"`
+}
+
+// sourceTokens is the version of sources whose text is the tokens they
+// were learned as, joined by spaces, since tokenizing the joined text
+// again can split it differently.
+const sourceTokens = 1
+
+// relearn adds the n-grams of a source to a batch; c.mu is held.
+func (c *Chain) relearn(b *batch, s source) {
+	if s.V >= sourceTokens {
+		c.learntokens(b, strings.Split(s.Text, " "))
+		return
+	}
+
+	c.learn(b, s.Text)
+}
+
+func (s source) value() []byte {
+	v, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// expires reports whether the source can be pruned: only what someone
+// said, at a known time, is.
+func (s source) expires() bool {
+	return s.Who != "" && s.Time > 0
+}
+
+// timekey is the key of a source in the time bucket: when it was said,
+// then its key in the source bucket.
+func timekey(t int64, k []byte) []byte {
+	return append(seqkey(uint64(t)), k...)
+}
+
+// decodesource reads a source record, or the bare text kept before
+// records had speakers and times.
+func decodesource(v []byte) source {
+	var s source
+	if len(v) > 0 && v[0] == '{' && json.Unmarshal(v, &s) == nil && s.Text != "" {
+		return s
+	}
+
+	return source{Text: string(v)}
+}
+
+// batch is learned n-grams not yet written to the db.
+type batch struct {
+	// suffix counts to add, by prefix key
+	grams grams
+	// the same for the sentences reversed, for walking backward
+	back grams
+	// times each word was seen, by its folded form
+	counts map[string]uint64
+	// and how often in each casing, "" being lower case
+	forms map[string]map[string]uint64
+	// sentence prefixes
+	starts map[string]bool
+	// text learned, for Rebuild
+	source []source
+	words  int
+}
+
+func newbatch() *batch {
+	return &batch{
+		grams:  make(grams),
+		back:   make(grams),
+		counts: make(map[string]uint64),
+		forms:  make(map[string]map[string]uint64),
+		starts: make(map[string]bool),
 	}
+}
 
-	return strings.Join(words, " ")
+// Build reads text from the provided Reader and
+// parses it into prefixes and suffixes that are stored in Chain.
+func (c *Chain) Build(r io.Reader) error {
+	return c.BuildFrom("", r)
+}
+
+// BuildFrom is Build for text said by who, which Forget can later remove
+// and Prune can expire.
+func (c *Chain) BuildFrom(who string, r io.Reader) error {
+	_, err := c.importfrom(who, r, DefaultBatch, nil)
+	return err
+}
+
+// Import is Build for large amounts of text. It commits what it has
+// learned every batchsize sentences, and calls progress, if not nil,
+// after each commit.
+func (c *Chain) Import(r io.Reader, batchsize int, progress func(Progress)) (Progress, error) {
+	return c.importfrom("", r, batchsize, progress)
+}
+
+// Message is a line of chat: who said it, when, and what.
+type Message struct {
+	Who  string
+	Time time.Time
+	Text string
+}
+
+// ImportChat is Import for chat, like irc logs. Each message is learned as
+// said by its Who at its Time, so Forget and Prune apply to it as to what
+// BuildFrom learns. Messages from those who opted out are skipped.
+func (c *Chain) ImportChat(msgs []Message, batchsize int, progress func(Progress)) (Progress, error) {
+	return c.importsents(batchsize, progress, func(emit func(source, []string) error) error {
+		for _, msg := range msgs {
+			if msg.Who != "" && c.OptedOut(msg.Who) {
+				continue
+			}
+
+			s := source{Who: msg.Who}
+			if !msg.Time.IsZero() {
+				s.Time = msg.Time.Unix()
+			}
+
+			for _, sent := range Tokenize(msg.Text) {
+				if err := emit(s, sent); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (c *Chain) importfrom(who string, r io.Reader, batchsize int, progress func(Progress)) (Progress, error) {
+	return c.importsents(batchsize, progress, func(emit func(source, []string) error) error {
+		return scanTokens(r, func(sent []string) error {
+			return emit(source{Who: who}, sent)
+		})
+	})
 }
 
-func (c *Chain) Dump() {
-	log.Printf("%d prefixes", len(c.prefixes))
-	for k, _ := range c.prefixes {
-		log.Printf("- %+v", k)
+// importsents learns the sentences scan emits, each with the speaker and
+// time of its source, or the time it was learned if that has none.
+func (c *Chain) importsents(batchsize int, progress func(Progress), scan func(emit func(source, []string) error) error) (Progress, error) {
+	if batchsize <= 0 {
+		batchsize = DefaultBatch
+	}
+
+	type sentence struct {
+		src  source
+		toks []string
 	}
+
+	var (
+		pr    Progress
+		sents []sentence
+	)
+
+	start := time.Now()
+
+	commit := func() error {
+		if len(sents) == 0 {
+			return nil
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		b := newbatch()
+		now := time.Now().Unix()
+
+		for _, sent := range sents {
+			src := sent.src
+			if src.Time == 0 {
+				src.Time = now
+			}
+
+			src.Text, src.V = strings.Join(sent.toks, " "), sourceTokens
+			b.source = append(b.source, src)
+			c.learntokens(b, sent.toks)
+		}
+
+		if err := c.flush(b); err != nil {
+			return err
+		}
+
+		pr.Sentences += len(sents)
+		pr.Words += b.words
+		pr.Elapsed = time.Since(start)
+
+		sents = nil
+
+		if progress != nil {
+			progress(pr)
+		}
+
+		return nil
+	}
+
+	err := scan(func(src source, toks []string) error {
+		sents = append(sents, sentence{src, toks})
+
+		if len(sents) >= batchsize {
+			return commit()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return pr, err
+	}
+
+	return pr, commit()
+}
+
+// ImportOnce is Import for text that should only be learned once, like a
+// corpus read at boot. id identifies the text, say by a hash of it, and
+// name is kept for reference. Importing an id a second time does nothing
+// and returns ErrImported.
+func (c *Chain) ImportOnce(id []byte, name string, r io.Reader, batchsize int, progress func(Progress)) (Progress, error) {
+	return c.once(id, name, func() (Progress, error) {
+		return c.Import(r, batchsize, progress)
+	})
+}
+
+// ImportChatOnce is ImportOnce for chat, learned as ImportChat does.
+func (c *Chain) ImportChatOnce(id []byte, name string, msgs []Message, batchsize int, progress func(Progress)) (Progress, error) {
+	return c.once(id, name, func() (Progress, error) {
+		return c.ImportChat(msgs, batchsize, progress)
+	})
+}
+
+// once runs an import of the text id unless it has been imported before.
+func (c *Chain) once(id []byte, name string, imp func() (Progress, error)) (Progress, error) {
+	var seen bool
+
+	err := c.db.View(func(tx Tx) error {
+		seen = c.bkt(tx, importedBucket).Get(id) != nil
+		return nil
+	})
+
+	if err != nil {
+		return Progress{}, err
+	}
+
+	if seen {
+		return Progress{}, ErrImported
+	}
+
+	pr, err := imp()
+	if err != nil {
+		return pr, err
+	}
+
+	err = c.db.Update(func(tx Tx) error {
+		return c.bkt(tx, importedBucket).Put(id, []byte(name))
+	})
+
+	return pr, err
+}
+
+// learn adds the n-grams of some source text to a batch; c.mu is held.
+func (c *Chain) learn(b *batch, text string) {
+	for _, sent := range Tokenize(text) {
+		c.learntokens(b, sent)
+	}
+}
+
+// learntokens adds the n-grams of one sentence to a batch. N-grams are
+// keyed by their folded form, and the words following them kept as they
+// were written; c.mu is held.
+func (c *Chain) learntokens(b *batch, toks []string) {
+	for _, tok := range toks {
+		if IsPunct(tok) {
+			continue
+		}
+
+		b.words++
+
+		w := fold(tok)
+		b.counts[w]++
+
+		form := ""
+		if hasupper(tok) {
+			form = tok
+		}
+
+		if b.forms[w] == nil {
+			b.forms[w] = make(map[string]uint64)
+		}
+
+		b.forms[w][form]++
+	}
+
+	if len(toks) <= c.order {
+		return
+	}
+
+	b.starts[Prefix(toks[:c.order]).String()] = true
+
+	rev := reversed(toks)
+
+	for i := c.order; i < len(toks); i++ {
+		b.grams.insert(string(Prefix(toks[i-c.order:i]).Key()), toks[i])
+		b.back.insert(string(Prefix(rev[i-c.order:i]).Key()), rev[i])
+	}
+}
+
+// flush writes a batch in one transaction; c.mu is held.
+func (c *Chain) flush(b *batch) error {
+	// in order, so a seeded chain picks the same starts
+	var starts []string
+	for k := range b.starts {
+		starts = append(starts, k)
+	}
+
+	sort.Strings(starts)
+
+	err := c.update(func(tx Tx, d *dicttx) error {
+		if err := b.grams.merge(d, c.bkt(tx, gramsBucket)); err != nil {
+			return err
+		}
+
+		if err := b.back.merge(d, c.bkt(tx, reverseBucket)); err != nil {
+			return err
+		}
+
+		words := c.bkt(tx, wordsBucket)
+		for w, n := range b.counts {
+			wi := getword(words, w)
+			wi.count += n
+
+			for form, n := range b.forms[w] {
+				wi.vote(form, n)
+			}
+
+			if err := putword(words, w, wi); err != nil {
+				return err
+			}
+		}
+
+		pre := c.bkt(tx, prefixBucket)
+		for _, k := range starts {
+			if c.prefixes[k] {
+				continue
+			}
+
+			if _, err := putseq(pre, []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		src, idx := c.bkt(tx, sourceBucket), c.bkt(tx, timeBucket)
+		for _, sent := range b.source {
+			k, err := putseq(src, sent.value())
+			if err != nil {
+				return err
+			}
+
+			if sent.expires() {
+				if err := idx.Put(timekey(sent.Time, k), []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range starts {
+		c.addstart(k)
+	}
+
+	return nil
+}
+
+// wordinfo is what's kept about a word: how often it was seen, and the
+// casing most of those were in, if it isn't lower case.
+type wordinfo struct {
+	count uint64
+	// the leading form, and its lead over the others
+	form  string
+	nform uint64
+}
+
+// vote counts n more sightings of a word in a form, "" being lower case.
+func (wi *wordinfo) vote(form string, n uint64) {
+	switch {
+	case form == wi.form:
+		wi.nform += n
+	case n > wi.nform:
+		wi.form, wi.nform = form, n-wi.nform
+	default:
+		wi.nform -= n
+	}
+}
+
+func getword(bu Bucket, word string) wordinfo {
+	return parseword(bu.Get([]byte(word)))
+}
+
+// parseword reads a word's info, kept as "count" or "count nform form".
+func parseword(v []byte) wordinfo {
+	var wi wordinfo
+
+	f := strings.SplitN(string(v), " ", 3)
+
+	wi.count, _ = strconv.ParseUint(f[0], 10, 64)
+
+	if len(f) == 3 {
+		wi.nform, _ = strconv.ParseUint(f[1], 10, 64)
+		wi.form = f[2]
+	}
+
+	return wi
+}
+
+func putword(bu Bucket, word string, wi wordinfo) error {
+	if wi.count == 0 {
+		return bu.Delete([]byte(word))
+	}
+
+	v := strconv.FormatUint(wi.count, 10)
+	if wi.form != "" && wi.nform > 0 {
+		v += " " + strconv.FormatUint(wi.nform, 10) + " " + wi.form
+	}
+
+	return bu.Put([]byte(word), []byte(v))
+}
+
+func getcount(bu Bucket, word string) uint64 {
+	return getword(bu, word).count
+}
+
+// putseq appends v to a bucket keyed by sequence number, returning its
+// key.
+func putseq(bu Bucket, v []byte) ([]byte, error) {
+	seq, err := bu.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	k := seqkey(seq)
+	return k, bu.Put(k, v)
+}
+
+// seqkey encodes a sequence number as a key which sorts in numeric order.
+func seqkey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// reseq rekeys a bucket written by putseq when its keys were decimal,
+// which sort as strings, so it reads back in the order it was written.
+// Decimal keys start with a digit, and numeric ones with a zero byte.
+func reseq(bu Bucket) error {
+	if k, _ := bu.Cursor().Seek([]byte("0")); k == nil {
+		return nil
+	}
+
+	type kv struct {
+		seq uint64
+		k   []byte
+		v   []byte
+	}
+
+	var old []kv
+
+	err := bu.ForEach(func(k, v []byte) error {
+		if seq, err := strconv.ParseUint(string(k), 10, 64); err == nil {
+			old = append(old, kv{seq, append([]byte{}, k...), append([]byte{}, v...)})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, e := range old {
+		if err := bu.Delete(e.k); err != nil {
+			return err
+		}
+
+		if err := bu.Put(seqkey(e.seq), e.v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuild re-derives the chain, and every other chain in its database, at
+// a different order from the text they learned. Chains made before their
+// source text was kept can't be rebuilt.
+func (c *Chain) Rebuild(order int) error {
+	if order < 1 {
+		return fmt.Errorf("markov: bad order %d", order)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chains, err := c.all()
+	if err != nil {
+		return err
+	}
+
+	sources := make([][]source, len(chains))
+	total := 0
+
+	err = c.db.View(func(tx Tx) error {
+		for i, nc := range chains {
+			err := nc.bkt(tx, sourceBucket).ForEach(func(k, v []byte) error {
+				sources[i] = append(sources[i], decodesource(v))
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			total += len(sources[i])
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if total == 0 {
+		return fmt.Errorf("markov: no source text to rebuild from")
+	}
+
+	err = c.db.Update(func(tx Tx) error {
+		for _, nc := range chains {
+			var parent Bucket
+			if nc.ns != nil {
+				parent = tx.Bucket(nsBucket).Bucket(nc.ns)
+			}
+
+			for _, name := range [][]byte{gramsBucket, prefixBucket, reverseBucket, wordsBucket} {
+				if err := rebucket(tx, parent, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Bucket(metaBucket).Put(orderKey, []byte(strconv.Itoa(order)))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	c.order = order
+
+	for i, nc := range chains {
+		nc.prefixes = make(map[string]bool)
+		nc.starts = nil
+
+		source := sources[i]
+
+		for len(source) > 0 {
+			n := DefaultBatch
+			if n > len(source) {
+				n = len(source)
+			}
+
+			b := newbatch()
+			for _, sent := range source[:n] {
+				nc.relearn(b, sent)
+			}
+
+			if err := nc.flush(b); err != nil {
+				return err
+			}
+
+			source = source[n:]
+		}
+	}
+
+	return nil
+}
+
+// rebucket empties a bucket of tx, or of parent if it isn't nil.
+func rebucket(tx Tx, parent Bucket, name []byte) error {
+	if parent == nil {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists(name)
+		return err
+	}
+
+	if err := parent.DeleteBucket(name); err != nil {
+		return err
+	}
+
+	_, err := parent.CreateBucketIfNotExists(name)
+	return err
+}
+
+// Migrate rewrites the n-grams of the chain, and every other chain in its
+// database, that are still in the JSON encoding in the binary one, and
+// returns how many it rewrote. Either encoding can be read, so this only
+// saves space and time.
+func (c *Chain) Migrate() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chains, err := c.all()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+
+	for _, nc := range chains {
+		for _, name := range [][]byte{gramsBucket, reverseBucket} {
+			n, err := nc.migrate(name)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// migrate rewrites a bucket of JSON suffixes a transaction of
+// DefaultBatch keys at a time; c.mu is held.
+func (c *Chain) migrate(name []byte) (int, error) {
+	var (
+		after []byte
+		done  bool
+		total int
+	)
+
+	for !done {
+		err := c.update(func(tx Tx, d *dicttx) error {
+			bu := c.bkt(tx, name)
+			cur := bu.Cursor()
+
+			k, v := cur.First()
+			if after != nil {
+				if k, v = cur.Seek(after); bytes.Equal(k, after) {
+					k, v = cur.Next()
+				}
+			}
+
+			var (
+				keys [][]byte
+				sufs []*Suffix
+			)
+
+			for i := 0; k != nil && i < DefaultBatch; k, v = cur.Next() {
+				i++
+				after = append(after[:0], k...)
+
+				if len(v) == 0 || v[0] != suffixJSON {
+					continue
+				}
+
+				suf := NewSuffix()
+				if err := suf.decode(d, v); err != nil {
+					return fmt.Errorf("%q: %s", k, err)
+				}
+
+				keys = append(keys, append([]byte(nil), k...))
+				sufs = append(sufs, suf)
+			}
+
+			done = k == nil
+
+			for i, k := range keys {
+				if err := putsuffix(d, bu, k, sufs[i]); err != nil {
+					return err
+				}
+			}
+
+			total += len(keys)
+			return nil
+		})
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// Forget removes everything learned from who from the chain, and every
+// other chain in its database, and returns the number of sentences
+// forgotten.
+func (c *Chain) Forget(who string) (int, error) {
+	if who == "" {
+		return 0, fmt.Errorf("markov: forget whom?")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names, err := c.Namespaces()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.remove(append([]string{""}, names...), func(tx Tx, nc *Chain, fn func(k []byte, s source) error) error {
+		return nc.bkt(tx, sourceBucket).ForEach(func(k, v []byte) error {
+			if s := decodesource(v); s.Who == who {
+				return fn(k, s)
+			}
+			return nil
+		})
+	})
+}
+
+// Prune forgets what was said before t, in the chain and every other
+// chain in its database, and returns the number of sentences forgotten.
+// Text learned from no one in particular, like a corpus, or before the
+// time was kept, is never pruned.
+func (c *Chain) Prune(t time.Time) (int, error) {
+	before := seqkey(uint64(t.Unix()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names, err := c.Namespaces()
+	if err != nil {
+		return 0, err
+	}
+
+	// only write to chains with something to prune, or no time index yet
+	var due []string
+
+	err = c.db.View(func(tx Tx) error {
+		for _, name := range append([]string{""}, names...) {
+			nc := &Chain{store: c.store}
+			if name != "" {
+				nc.ns = []byte(name)
+			}
+
+			idx := nc.holder(tx).Bucket(timeBucket)
+			if idx == nil {
+				due = append(due, name)
+			} else if k, _ := idx.Cursor().First(); k != nil && bytes.Compare(k, before) < 0 {
+				due = append(due, name)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return c.remove(due, func(tx Tx, nc *Chain, fn func(k []byte, s source) error) error {
+		src := nc.bkt(tx, sourceBucket)
+		cur := nc.bkt(tx, timeBucket).Cursor()
+
+		// the oldest come first, so stop at the first that's new enough
+		for k, _ := cur.First(); k != nil && bytes.Compare(k, before) < 0; k, _ = cur.Next() {
+			if v := src.Get(k[8:]); v != nil {
+				if err := fn(k[8:], decodesource(v)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// picker calls fn with the key and source of each of nc's sources it
+// picks.
+type picker func(tx Tx, nc *Chain, fn func(k []byte, s source) error) error
+
+// remove unlearns the sources pick picks in the chains named, and drops
+// the words no chain uses any more. Chains that aren't open are changed in
+// the db without opening them; c.mu is held.
+func (c *Chain) remove(names []string, pick picker) (int, error) {
+	total := 0
+	words := make(map[string]bool)
+
+	for _, name := range names {
+		nc, ok := c.chains[name]
+		if !ok {
+			nc = &Chain{store: c.store, ns: []byte(name)}
+		}
+
+		n, err := nc.unlearn(pick, words)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, c.sweep(words)
+}
+
+// unlearn takes the counts of the sources pick picks out of the chain,
+// adding the words it took to words; c.mu is held.
+func (c *Chain) unlearn(pick picker, words map[string]bool) (int, error) {
+	var (
+		keys  [][]byte
+		stale []string
+	)
+
+	b := newbatch()
+
+	err := c.update(func(tx Tx, d *dicttx) error {
+		if err := initchain(c.holder(tx)); err != nil {
+			return err
+		}
+
+		var picked []source
+
+		err := pick(tx, c, func(k []byte, s source) error {
+			keys = append(keys, append([]byte(nil), k...))
+			picked = append(picked, s)
+			c.relearn(b, s)
+			return nil
+		})
+
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+
+		src, idx := c.bkt(tx, sourceBucket), c.bkt(tx, timeBucket)
+
+		for i, k := range keys {
+			if err := src.Delete(k); err != nil {
+				return err
+			}
+
+			if s := picked[i]; s.expires() {
+				if err := idx.Delete(timekey(s.Time, k)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, g := range []grams{b.grams, b.back} {
+			for _, suf := range g {
+				for w := range suf.M {
+					words[w] = true
+				}
+			}
+		}
+
+		gr := c.bkt(tx, gramsBucket)
+
+		if err := b.grams.subtract(d, gr); err != nil {
+			return err
+		}
+
+		if err := b.back.subtract(d, c.bkt(tx, reverseBucket)); err != nil {
+			return err
+		}
+
+		counts := c.bkt(tx, wordsBucket)
+		for w, n := range b.counts {
+			wi := getword(counts, w)
+			if wi.count <= n {
+				wi.count = 0
+			} else {
+				wi.count -= n
+			}
+
+			if err := putword(counts, w, wi); err != nil {
+				return err
+			}
+		}
+
+		// a sentence start with nothing left to follow it is gone; one
+		// that's still in the middle of a sentence can stay
+		pre := c.bkt(tx, prefixBucket)
+
+		var del [][]byte
+		err = pre.ForEach(func(k, v []byte) error {
+			if b.starts[string(v)] && gr.Get(Prefix(strings.Split(string(v), " ")).Key()) == nil {
+				del = append(del, append([]byte(nil), k...))
+				stale = append(stale, string(v))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range del {
+			if err := pre.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(stale) > 0 {
+		for _, k := range stale {
+			delete(c.prefixes, k)
+		}
+
+		starts := c.starts[:0]
+		for _, k := range c.starts {
+			if c.prefixes[k] {
+				starts = append(starts, k)
+			}
+		}
+		c.starts = starts
+	}
+
+	return len(keys), nil
+}
+
+// sweep drops the ids of those of words which no suffix in the database
+// uses any more, so nothing of what was forgotten is left; c.mu is held.
+func (c *Chain) sweep(words map[string]bool) error {
+	unused := make(map[uint64]string)
+	for w := range words {
+		if id, ok := c.dict.ids[w]; ok {
+			unused[id] = w
+		}
+	}
+
+	if len(unused) == 0 {
+		return nil
+	}
+
+	err := c.db.Update(func(tx Tx) error {
+		d := c.dict.in(tx)
+
+		buckets := []Bucket{tx.Bucket(gramsBucket), tx.Bucket(reverseBucket)}
+
+		ns := tx.Bucket(nsBucket)
+		err := ns.ForEach(func(k, v []byte) error {
+			for _, name := range [][]byte{gramsBucket, reverseBucket} {
+				if bu := ns.Bucket(k).Bucket(name); bu != nil {
+					buckets = append(buckets, bu)
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, bu := range buckets {
+			cur := bu.Cursor()
+			for k, v := cur.First(); k != nil && len(unused) > 0; k, v = cur.Next() {
+				suf := NewSuffix()
+				if err := suf.decode(d, v); err != nil {
+					return fmt.Errorf("%q: %s", k, err)
+				}
+
+				for w := range suf.M {
+					delete(unused, c.dict.ids[w])
+				}
+			}
+		}
+
+		for id, w := range unused {
+			if err := tx.Bucket(wordidBucket).Delete([]byte(w)); err != nil {
+				return err
+			}
+
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, id)
+
+			if err := tx.Bucket(idwordBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for id, w := range unused {
+		delete(c.dict.ids, w)
+		delete(c.dict.words, id)
+	}
+
+	return nil
+}
+
+// OptOut records that who doesn't want to be learned from, or if out is
+// false, that they don't mind again. The chain doesn't enforce it; callers
+// check OptedOut before learning.
+func (c *Chain) OptOut(who string, out bool) error {
+	return c.db.Update(func(tx Tx) error {
+		bu := tx.Bucket(optoutBucket)
+
+		if !out {
+			return bu.Delete([]byte(who))
+		}
+
+		return bu.Put([]byte(who), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+}
+
+// OptedOut reports whether who has opted out of being learned from.
+func (c *Chain) OptedOut(who string) bool {
+	var out bool
+
+	c.db.View(func(tx Tx) error {
+		out = tx.Bucket(optoutBucket).Get([]byte(who)) != nil
+		return nil
+	})
+
+	return out
+}
+
+// Generate returns a string of at most n words generated from Chain, or
+// at most the chain's NWord if n is 0.
+func (c *Chain) Generate(n int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if n <= 0 {
+		n = c.nword
+	}
+
+	if len(c.starts) == 0 || n < c.order {
+		return ""
+	}
+
+	p := Prefix(strings.Split(c.starts[c.intn(len(c.starts))], " "))
+
+	var words []string
+
+	words = append(words, p...)
+
+	for len(words) < n {
+		suf := c.getgram(p)
+		if len(suf.M) == 0 {
+			break
+		}
+
+		word := suf.pick(c.intn)
+
+		words = append(words, word)
+
+		if IsEnd(word) {
+			break
+		}
+		p.Shift(word)
+	}
+
+	return Join(words)
+}
+
+// words too common to be worth replying about
+var stopwords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`a about all also am an and any are as at be
+		been but by can could did do does for from get got had has have he her
+		him his how i if in into is it its just like me my no not now of on
+		one or our out she so some than that the their them then there these
+		they this to too up us was we were what when where which who why will
+		with would you your`) {
+		stopwords[w] = true
+	}
+}
+
+// most n-grams considered when looking for one containing a seed word
+const maxSeedGrams = 100
+
+// GenerateFrom returns a sentence of at most n words, or the chain's NWord
+// if n is 0, built around whichever of words the chain has seen least. It
+// walks backward from the word as well as forward. If the chain knows none
+// of the words, it returns "".
+func (c *Chain) GenerateFrom(words []string, n int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if n <= 0 {
+		n = c.nword
+	}
+
+	if n < c.order {
+		return ""
+	}
+
+	var out []string
+
+	c.db.View(func(tx Tx) error {
+		fwd, back := c.bkt(tx, gramsBucket), c.bkt(tx, reverseBucket)
+		counts := c.bkt(tx, wordsBucket)
+		d := c.dict.in(tx)
+
+		for _, seed := range c.seeds(tx, words) {
+			var p Prefix
+
+			if keys := seedgrams(fwd, seed); len(keys) > 0 {
+				p = Prefix(strings.Split(keys[c.intn(len(keys))], " "))
+			} else if keys := seedgrams(back, seed); len(keys) > 0 {
+				// the seed only ends sentences
+				p = reversed(strings.Split(keys[c.intn(len(keys))], " "))
+			} else {
+				continue
+			}
+
+			// the n-gram's words are folded; write them as they're
+			// usually written
+			out = nil
+			for _, w := range p {
+				if wi := getword(counts, w); wi.form != "" {
+					w = wi.form
+				}
+				out = append(out, w)
+			}
+
+			// up to half the sentence before the seed
+			rp := reversed(p)
+
+			for len(out) < (n+c.order)/2 {
+				suf := NewSuffix()
+				if getsuffix(d, back, rp.Key(), suf) != nil || len(suf.M) == 0 {
+					break
+				}
+
+				word := suf.pick(c.intn)
+				out = append([]string{word}, out...)
+				rp.Shift(word)
+			}
+
+			for len(out) < n {
+				suf := NewSuffix()
+				if getsuffix(d, fwd, p.Key(), suf) != nil || len(suf.M) == 0 {
+					break
+				}
+
+				word := suf.pick(c.intn)
+				out = append(out, word)
+
+				if IsEnd(word) {
+					break
+				}
+				p.Shift(word)
+			}
+
+			break
+		}
+
+		return nil
+	})
+
+	return Join(out)
+}
+
+// WordCount is a word and how often it was seen.
+type WordCount struct {
+	Word  string
+	Count uint64
+}
+
+type byCount []WordCount
+
+func (b byCount) Len() int           { return len(b) }
+func (b byCount) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool { return b[i].Count < b[j].Count }
+
+// seeds picks the words worth building a sentence around, rarest first.
+// Words the chain has no count for, from before counts were kept, come
+// last.
+func (c *Chain) seeds(tx Tx, words []string) []string {
+	counts := c.bkt(tx, wordsBucket)
+
+	var seeds byCount
+	seen := make(map[string]bool)
+
+	var toks []string
+	for _, sent := range Tokenize(strings.Join(words, " ")) {
+		toks = append(toks, sent...)
+	}
+
+	for _, w := range toks {
+		w = fold(w)
+
+		if IsPunct(w) || utf8.RuneCountInString(w) < 2 || stopwords[w] || seen[w] {
+			continue
+		}
+
+		seen[w] = true
+
+		n := getcount(counts, w)
+		if n == 0 {
+			n = math.MaxUint64
+		}
+
+		seeds = append(seeds, WordCount{w, n})
+	}
+
+	sort.Stable(seeds)
+
+	var r []string
+	for _, s := range seeds {
+		r = append(r, s.Word)
+	}
+
+	return r
+}
+
+func reversed(words []string) Prefix {
+	r := make(Prefix, len(words))
+	for i, w := range words {
+		r[len(words)-1-i] = w
+	}
+	return r
+}
+
+// seedgrams returns the keys of a bucket of n-grams that start with word.
+func seedgrams(bu Bucket, word string) []string {
+	var keys []string
+
+	if bu.Get([]byte(word)) != nil {
+		keys = append(keys, word)
+	}
+
+	pre := []byte(word + " ")
+
+	cur := bu.Cursor()
+	for k, _ := cur.Seek(pre); k != nil && bytes.HasPrefix(k, pre) && len(keys) < maxSeedGrams; k, _ = cur.Next() {
+		keys = append(keys, string(k))
+	}
+
+	return keys
 }
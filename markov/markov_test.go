@@ -0,0 +1,1009 @@
+package markov
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempchain makes a chain in memory, which done closes.
+func tempchain(t *testing.T, opts Options) (*Chain, func()) {
+	opts.Storage = NewMemStorage()
+
+	c, err := NewChain(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+	}
+}
+
+// boltchain makes a chain in a bolt database in a temporary directory,
+// for tests of what persists, which done removes.
+func boltchain(t *testing.T, opts Options) (*Chain, func()) {
+	dir, err := ioutil.TempDir("", "markov")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Path = filepath.Join(dir, "markov")
+
+	c, err := NewChain(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	c, done := boltchain(t, Options{Order: 2})
+	defer done()
+
+	if c.Order() != 2 {
+		t.Fatalf("expected order 2 got %d", c.Order())
+	}
+
+	path := c.path
+	c.Close()
+
+	// the order sticks with the database
+	c, err := NewChain(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Order() != 2 {
+		t.Errorf("expected stored order 2 got %d", c.Order())
+	}
+
+	c.Close()
+
+	_, err = NewChain(Options{Path: path, Order: 3})
+	if oe, ok := err.(*OrderError); !ok || oe.Order != 2 || oe.Want != 3 || oe.Text {
+		t.Errorf("opening an order 2 chain as order 3 gave %#v", err)
+	}
+
+	c, err = NewChain(Options{Path: path, Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Build(strings.NewReader("the quick brown fox")); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	// now it can be rebuilt
+	_, err = NewChain(Options{Path: path, Order: 3})
+	if oe, ok := err.(*OrderError); !ok || !oe.Text {
+		t.Errorf("opening an order 2 chain with text as order 3 gave %#v", err)
+	}
+}
+
+func TestChainLegacyOrder(t *testing.T) {
+	c, done := boltchain(t, Options{})
+	defer done()
+
+	// a chain from before the order was recorded
+	err := c.db.Update(func(tx Tx) error {
+		if err := tx.Bucket(gramsBucket).Put([]byte("a b c"), NewSuffix().Value()); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(metaBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := c.path
+	c.Close()
+
+	_, err = NewChain(Options{Path: path, Order: 1})
+	if oe, ok := err.(*OrderError); !ok || oe.Order != DefaultOrder || oe.Text {
+		t.Errorf("opening a legacy order 3 chain as order 1 gave %#v", err)
+	}
+
+	c, err = NewChain(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if c.Order() != DefaultOrder {
+		t.Errorf("expected legacy order %d got %d", DefaultOrder, c.Order())
+	}
+}
+
+func TestChainRebuild(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 3})
+	defer done()
+
+	if err := c.Rebuild(1); err == nil {
+		t.Errorf("rebuilt a chain with no source text")
+	}
+
+	if err := c.Build(strings.NewReader("the quick brown fox jumps. the lazy dog sleeps")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.prefixes) != 2 || !c.prefixes["the quick brown"] {
+		t.Fatalf("unexpected order 3 prefixes %v", c.prefixes)
+	}
+
+	if err := c.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Order() != 1 {
+		t.Errorf("expected order 1 after rebuild got %d", c.Order())
+	}
+
+	if len(c.prefixes) != 1 || !c.prefixes["the"] {
+		t.Errorf("unexpected order 1 prefixes %v", c.prefixes)
+	}
+
+	suf := c.getgram(Prefix{"the"})
+	if suf.M["quick"] != 1 || suf.M["lazy"] != 1 || len(suf.M) != 2 {
+		t.Errorf("unexpected suffixes of \"the\": %v", suf.M)
+	}
+
+	if c.getgram(Prefix{"the", "quick", "brown"}).M["fox"] != 0 {
+		t.Errorf("order 3 n-grams survived the rebuild")
+	}
+}
+
+func TestChainGenerateLimit(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 1, NWord: 4})
+	defer done()
+
+	if err := c.Build(strings.NewReader("a b c d e f g h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Generate(0); s != "a b c d" {
+		t.Errorf("expected 4 words got %q", s)
+	}
+
+	if s := c.Generate(6); s != "a b c d e f" {
+		t.Errorf("expected 6 words got %q", s)
+	}
+}
+
+func TestChainImport(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 1})
+	defer done()
+
+	var calls []Progress
+
+	pr, err := c.Import(strings.NewReader("a b. a c. a b. b c d"), 2, func(p Progress) {
+		calls = append(calls, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pr.Sentences != 4 || pr.Words != 9 {
+		t.Errorf("expected 4 sentences and 9 words got %+v", pr)
+	}
+
+	if len(calls) != 2 || calls[0].Sentences != 2 || calls[1].Sentences != 4 {
+		t.Errorf("unexpected progress %+v", calls)
+	}
+
+	// counts from separate batches are merged
+	if suf := c.getgram(Prefix{"a"}); suf.M["b"] != 2 || suf.M["c"] != 1 {
+		t.Errorf("unexpected suffixes of \"a\": %v", suf.M)
+	}
+
+	if len(c.prefixes) != 2 || !c.prefixes["a"] || !c.prefixes["b"] {
+		t.Errorf("unexpected prefixes %v", c.prefixes)
+	}
+}
+
+// benchcorpus makes n sentences of made up words.
+func benchcorpus(n int) string {
+	rnd := rand.New(rand.NewSource(1))
+
+	var vocab []string
+	for i := 0; i < 500; i++ {
+		vocab = append(vocab, fmt.Sprintf("w%d", i))
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		for j := 4 + rnd.Intn(12); j > 0; j-- {
+			buf.WriteString(vocab[rnd.Intn(len(vocab))])
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(". ")
+	}
+
+	return buf.String()
+}
+
+// BenchmarkImport compares committing every sentence, which is about what
+// Build used to cost, with batched commits.
+func BenchmarkImport(b *testing.B) {
+	corpus := benchcorpus(200)
+
+	for _, size := range []int{1, 10, 100, DefaultBatch} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir, err := ioutil.TempDir("", "markov")
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				c, err := NewChain(Options{Path: filepath.Join(dir, "markov")})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				if _, err := c.Import(strings.NewReader(corpus), size, nil); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				c.Close()
+				os.RemoveAll(dir)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestChainImportOnce(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 1})
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		_, err := c.ImportOnce([]byte("id"), "corpus", strings.NewReader("a b"), 0, nil)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && err != ErrImported {
+			t.Errorf("expected ErrImported got %v", err)
+		}
+	}
+
+	if suf := c.getgram(Prefix{"a"}); suf.M["b"] != 1 {
+		t.Errorf("expected one a b got %d", suf.M["b"])
+	}
+}
+
+func TestChainImportChat(t *testing.T) {
+	c := memchain(t, Options{Order: 1}, 1)
+
+	if err := c.OptOut("carol", true); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+
+	msgs := []Message{
+		{Who: "alice", Time: old, Text: "alice likes tea."},
+		{Who: "bob", Time: time.Now(), Text: "bob likes coffee."},
+		{Who: "carol", Time: time.Now(), Text: "carol likes cocoa."},
+	}
+
+	pr, err := c.ImportChatOnce([]byte("id"), "log", msgs, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pr.Sentences != 2 {
+		t.Errorf("expected 2 sentences, without the opted out one, got %d", pr.Sentences)
+	}
+
+	if _, err := c.ImportChatOnce([]byte("id"), "log", msgs, 0, nil); err != ErrImported {
+		t.Errorf("expected ErrImported got %v", err)
+	}
+
+	// what's imported is pruned by when it was said
+	if n, err := c.Prune(time.Now().Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("expected to prune 1 sentence got %d, %v", n, err)
+	}
+
+	if c.getgram(Prefix{"likes"}).M["tea"] != 0 {
+		t.Errorf("alice's old tea survived the prune")
+	}
+
+	// and forgotten by who said it
+	if n, err := c.Forget("bob"); err != nil || n != 1 {
+		t.Errorf("expected to forget 1 sentence got %d, %v", n, err)
+	}
+
+	if !c.Empty() {
+		t.Errorf("expected nothing left, have %v", c.prefixes)
+	}
+}
+
+func TestChainGenerateFrom(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 2})
+	defer done()
+
+	text := "the cat sat on the mat. the dog sat on the log. a zebra ate the grass"
+	if err := c.Build(strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+
+	// zebra is rarer than the, and only one sentence contains it
+	if s := c.GenerateFrom([]string{"the", "Zebra!"}, 0); s != "a zebra ate the grass" {
+		t.Errorf("expected the zebra sentence got %q", s)
+	}
+
+	// walking backward from a word at the end of a sentence, which may
+	// take either path back from "sat"
+	if s := c.GenerateFrom([]string{"log"}, 0); s != "the dog sat on the log." && s != "the cat sat on the log." {
+		t.Errorf("expected a sentence ending in log got %q", s)
+	}
+
+	if s := c.GenerateFrom([]string{"the", "unicorn"}, 0); s != "" {
+		t.Errorf("expected nothing for unknown and stop words got %q", s)
+	}
+
+	if s := c.GenerateFrom([]string{"zebra"}, 3); len(strings.Fields(s)) > 3 {
+		t.Errorf("expected at most 3 words got %q", s)
+	}
+}
+
+func TestChainNamespace(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 1})
+	defer done()
+
+	if _, err := c.Namespace("#chan", false); err != ErrNoChain {
+		t.Errorf("expected ErrNoChain got %v", err)
+	}
+
+	ch, err := c.Namespace("#chan", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.Build(strings.NewReader("only in the channel")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Build(strings.NewReader("only in the default")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := ch.GenerateFrom([]string{"channel"}, 0); s != "only in the channel" {
+		t.Errorf("expected the channel's sentence got %q", s)
+	}
+
+	if s := c.GenerateFrom([]string{"channel"}, 0); s != "" {
+		t.Errorf("the default chain learned from the channel: %q", s)
+	}
+
+	names, err := c.Namespaces()
+	if err != nil || len(names) != 1 || names[0] != "#chan" {
+		t.Errorf("expected namespaces [#chan] got %v %v", names, err)
+	}
+
+	// rebuilding covers every namespace
+	if err := c.Rebuild(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ch.prefixes["only in"] || len(ch.prefixes) != 1 {
+		t.Errorf("unexpected prefixes after rebuild %v", ch.prefixes)
+	}
+
+	if s := ch.GenerateFrom([]string{"channel"}, 0); s != "only in the channel" {
+		t.Errorf("expected the channel's sentence after rebuild got %q", s)
+	}
+}
+
+func TestChainForget(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 1})
+	defer done()
+
+	ch, err := c.Namespace("#chan", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nc := range []*Chain{c, ch} {
+		if err := nc.BuildFrom("alice", strings.NewReader("a b. secret c")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := nc.BuildFrom("bob", strings.NewReader("a b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := c.Forget("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 4 {
+		t.Errorf("expected 4 sentences forgotten got %d", n)
+	}
+
+	for _, nc := range []*Chain{c, ch} {
+		if suf := nc.getgram(Prefix{"a"}); suf.M["b"] != 1 {
+			t.Errorf("expected bob's a b to remain in %q got %v", nc.Name(), suf.M)
+		}
+
+		if suf := nc.getgram(Prefix{"secret"}); len(suf.M) != 0 {
+			t.Errorf("alice's secret survived in %q: %v", nc.Name(), suf.M)
+		}
+
+		if nc.prefixes["secret"] || !nc.prefixes["a"] {
+			t.Errorf("unexpected prefixes in %q: %v", nc.Name(), nc.prefixes)
+		}
+
+		if s := nc.GenerateFrom([]string{"secret"}, 0); s != "" {
+			t.Errorf("generated from a forgotten word in %q: %q", nc.Name(), s)
+		}
+	}
+
+	// forgetting is kept through a rebuild
+	if err := c.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if suf := c.getgram(Prefix{"a"}); suf.M["b"] != 1 || c.prefixes["secret"] {
+		t.Errorf("unexpected chain after rebuild %v %v", suf.M, c.prefixes)
+	}
+
+	if n, err := c.Forget("alice"); n != 0 || err != nil {
+		t.Errorf("forgot alice twice: %d %v", n, err)
+	}
+}
+
+func TestChainForgetWords(t *testing.T) {
+	c := memchain(t, Options{Order: 1}, 1)
+	defer c.Close()
+
+	ch, err := c.Namespace("#chan", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.BuildFrom("alice", strings.NewReader("my password is hunter2secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.BuildFrom("alice", strings.NewReader("my cat is fluffy")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.BuildFrom("bob", strings.NewReader("my password is secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	interned := func(word string) bool {
+		var in bool
+		c.db.View(func(tx Tx) error {
+			in = tx.Bucket(wordidBucket).Get([]byte(word)) != nil
+			return nil
+		})
+		return in
+	}
+
+	for _, w := range []string{"hunter2secret", "cat", "fluffy"} {
+		if _, ok := c.dict.ids[w]; ok || interned(w) {
+			t.Errorf("forgotten word %q is still interned", w)
+		}
+	}
+
+	// bob still uses these, in another chain
+	for _, w := range []string{"password", "is", "secret"} {
+		if _, ok := c.dict.ids[w]; !ok || !interned(w) {
+			t.Errorf("word %q bob said was dropped", w)
+		}
+	}
+
+	var left int
+	c.db.View(func(tx Tx) error {
+		return tx.Bucket(idwordBucket).ForEach(func(k, v []byte) error {
+			left++
+			return nil
+		})
+	})
+
+	if left != len(c.dict.words) {
+		t.Errorf("%d words in the db but %d in memory", left, len(c.dict.words))
+	}
+}
+
+func TestChainForgetPunct(t *testing.T) {
+	c := memchain(t, Options{Order: 1}, 1)
+	defer c.Close()
+
+	// each splits differently if its tokens are joined and split again
+	for _, text := range []string{"hi.) there", `wow!" she said`, "yes!) ok"} {
+		if err := c.BuildFrom("bob", strings.NewReader(text)); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := c.Forget("bob"); n == 0 || err != nil {
+			t.Fatalf("%q: forgot %d sentences: %v", text, n, err)
+		}
+
+		st, err := c.Stats(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st.Prefixes != 0 || st.NGrams != 0 || st.Words != 0 || st.Starts != 0 {
+			t.Errorf("%q: left after forgetting: %+v", text, st)
+		}
+	}
+}
+
+func TestChainPrune(t *testing.T) {
+	c, done := tempchain(t, Options{Order: 1})
+	defer done()
+
+	if err := c.Build(strings.NewReader("corpus text")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.BuildFrom("alice", strings.NewReader("chat text")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Prune(time.Now().Add(-time.Hour)); n != 0 || err != nil {
+		t.Errorf("pruned recent text: %d %v", n, err)
+	}
+
+	if n, err := c.Prune(time.Now().Add(time.Hour)); n != 1 || err != nil {
+		t.Errorf("expected 1 sentence pruned got %d %v", n, err)
+	}
+
+	if suf := c.getgram(Prefix{"chat"}); len(suf.M) != 0 {
+		t.Errorf("pruned text survived: %v", suf.M)
+	}
+
+	if suf := c.getgram(Prefix{"corpus"}); suf.M["text"] != 1 {
+		t.Errorf("the corpus was pruned: %v", suf.M)
+	}
+}
+
+func TestChainPruneUnopened(t *testing.T) {
+	db := NewMemStorage()
+
+	c, err := NewChain(Options{Order: 1, Storage: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := c.Namespace("@bob", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// out of time order, as a load might leave them
+	b := newbatch()
+	for _, s := range []source{{Who: "bob", Time: 100, Text: "old text"}, {Who: "bob", Time: 300, Text: "new text"}, {Who: "bob", Time: 200, Text: "mid text"}} {
+		nc.learn(b, s.Text)
+		b.source = append(b.source, s)
+	}
+
+	if err := nc.flush(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// as kept before there was a time index
+	err = db.Update(func(tx Tx) error {
+		return tx.Bucket(nsBucket).Bucket([]byte("@bob")).DeleteBucket(timeBucket)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewChain(Options{Order: 1, Storage: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Prune(time.Unix(250, 0)); n != 2 || err != nil {
+		t.Errorf("expected 2 sentences pruned got %d %v", n, err)
+	}
+
+	if _, ok := c.chains["@bob"]; ok {
+		t.Errorf("pruning opened @bob")
+	}
+
+	if n, err := c.Prune(time.Unix(250, 0)); n != 0 || err != nil {
+		t.Errorf("pruned again: %d %v", n, err)
+	}
+
+	nc, err = c.Namespace("@bob", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for w, want := range map[string]uint32{"old": 0, "mid": 0, "new": 1} {
+		if got := nc.getgram(Prefix{w}).M["text"]; got != want {
+			t.Errorf("%s text seen %d times, want %d", w, got, want)
+		}
+	}
+}
+
+func TestChainOptOut(t *testing.T) {
+	c, done := tempchain(t, Options{})
+	defer done()
+
+	if c.OptedOut("alice") {
+		t.Errorf("opted out by default")
+	}
+
+	if err := c.OptOut("alice", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.OptedOut("alice") || c.OptedOut("bob") {
+		t.Errorf("expected only alice opted out")
+	}
+
+	if err := c.OptOut("alice", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.OptedOut("alice") {
+		t.Errorf("alice is still opted out")
+	}
+}
+
+func TestChainMigrate(t *testing.T) {
+	c, done := boltchain(t, Options{Order: 1})
+	defer done()
+
+	ch, err := c.Namespace("#chan", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// n-grams as they were written before the binary encoding
+	old := NewSuffix()
+	old.M["b"] = 2
+	old.M["c"] = 1
+
+	err = c.db.Update(func(tx Tx) error {
+		for _, nc := range []*Chain{c, ch} {
+			if err := nc.bkt(tx, gramsBucket).Put([]byte("a"), old.Value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// old values are read, and merged into new ones
+	if err := c.Build(strings.NewReader("a b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if suf := c.getgram(Prefix{"a"}); suf.M["b"] != 3 || suf.M["c"] != 1 {
+		t.Errorf("unexpected merged suffix %v", suf.M)
+	}
+
+	n, err := c.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 n-gram migrated got %d", n)
+	}
+
+	if suf := ch.getgram(Prefix{"a"}); suf.M["b"] != 2 || suf.M["c"] != 1 {
+		t.Errorf("unexpected migrated suffix %v", suf.M)
+	}
+
+	c.db.View(func(tx Tx) error {
+		for _, nc := range []*Chain{c, ch} {
+			if v := nc.bkt(tx, gramsBucket).Get([]byte("a")); v[0] != suffixBinary {
+				t.Errorf("%q still has %q", nc.Name(), v)
+			}
+		}
+		return nil
+	})
+
+	// the word ids outlive the chain
+	path := c.path
+	c.Close()
+
+	c, err = NewChain(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if suf := c.getgram(Prefix{"a"}); suf.M["b"] != 3 || suf.M["c"] != 1 {
+		t.Errorf("unexpected suffix after reopening %v", suf.M)
+	}
+
+	if n, err := c.Migrate(); n != 0 || err != nil {
+		t.Errorf("migrated twice: %d %v", n, err)
+	}
+}
+
+// memchain makes a chain in memory whose choices are seeded with seed.
+func memchain(t *testing.T, opts Options, seed int64) *Chain {
+	opts.Storage = NewMemStorage()
+	opts.Rand = rand.NewSource(seed)
+
+	c, err := NewChain(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+const seedtext = `the cat sat on the mat. the cat ate the rat. the dog sat on the cat.
+a dog ate the mat. the rat sat on a dog. the mat ate a cat.`
+
+func TestChainSeeded(t *testing.T) {
+	gen := func(c *Chain) []string {
+		if err := c.Build(strings.NewReader(seedtext)); err != nil {
+			t.Fatal(err)
+		}
+
+		var out []string
+		for i := 0; i < 20; i++ {
+			out = append(out, c.Generate(8), c.GenerateFrom([]string{"dog"}, 8))
+		}
+		return out
+	}
+
+	// the same seed makes the same text, whatever the storage
+	mem := memchain(t, Options{Order: 1}, 42)
+	defer mem.Close()
+
+	disk, done := boltchain(t, Options{Order: 1, Rand: rand.NewSource(42)})
+	defer done()
+
+	a, b := gen(mem), gen(disk)
+
+	distinct := make(map[string]bool)
+
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("generation %d differs: %q and %q", i, a[i], b[i])
+		}
+
+		distinct[a[i]] = true
+
+		if len(strings.Fields(a[i])) > 8 {
+			t.Errorf("generated more than 8 words: %q", a[i])
+		}
+	}
+
+	if len(distinct) < 2 {
+		t.Errorf("seeded chain always says %v", distinct)
+	}
+
+	other := memchain(t, Options{Order: 1}, 43)
+	defer other.Close()
+
+	if c := gen(other); strings.Join(c, "\n") == strings.Join(a, "\n") {
+		t.Errorf("different seeds made the same text")
+	}
+}
+
+func TestChainMemory(t *testing.T) {
+	c := memchain(t, Options{Order: 2}, 1)
+	defer c.Close()
+
+	if s := c.Generate(0); s != "" {
+		t.Errorf("empty chain said %q", s)
+	}
+
+	if err := c.BuildFrom("alice", strings.NewReader("a zebra ate the grass")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Build(strings.NewReader("the cat sat on the mat")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.GenerateFrom([]string{"zebra"}, 0); s != "a zebra ate the grass" {
+		t.Errorf("expected the zebra sentence got %q", s)
+	}
+
+	if _, err := c.Forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.GenerateFrom([]string{"zebra"}, 0); s != "" {
+		t.Errorf("generated from a forgotten word: %q", s)
+	}
+
+	if err := c.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Generate(0); !strings.HasPrefix(s, "the ") {
+		t.Errorf("unexpected text after rebuild %q", s)
+	}
+
+	// nothing can be done with a closed chain
+	c.Close()
+
+	if err := c.Build(strings.NewReader("a b c")); err == nil {
+		t.Errorf("learned after closing")
+	}
+}
+
+func TestChainSeqKeys(t *testing.T) {
+	db := NewMemStorage()
+
+	c, err := NewChain(Options{Order: 1, Storage: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+
+	// starts as they were kept before their keys sorted numerically
+	err = db.Update(func(tx Tx) error {
+		bu := tx.Bucket(prefixBucket)
+
+		for i := 1; i <= 12; i++ {
+			seq, err := bu.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			w := fmt.Sprintf("w%d", i)
+			want = append(want, w)
+
+			if err := bu.Put([]byte(fmt.Sprintf("%d", seq)), []byte(w)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewChain(Options{Order: 1, Storage: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Build(strings.NewReader("w13 x")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewChain(Options{Order: 1, Storage: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = append(want, "w13")
+
+	if fmt.Sprint(c.starts) != fmt.Sprint(want) {
+		t.Errorf("starts %v want %v", c.starts, want)
+	}
+}
+
+func TestMemStorage(t *testing.T) {
+	s := NewMemStorage()
+	defer s.Close()
+
+	err := s.Update(func(tx Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte("b"))
+		if err != nil {
+			return err
+		}
+
+		for _, k := range []string{"b", "c", "a", "ab"} {
+			if err := bu.Put([]byte(k), []byte("v"+k)); err != nil {
+				return err
+			}
+		}
+
+		if _, err := bu.CreateBucketIfNotExists([]byte("sub")); err != nil {
+			return err
+		}
+
+		if seq, err := bu.NextSequence(); seq != 1 || err != nil {
+			t.Errorf("expected sequence 1 got %d %v", seq, err)
+		}
+
+		return bu.Delete([]byte("c"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed update changes nothing
+	err = s.Update(func(tx Tx) error {
+		bu := tx.Bucket([]byte("b"))
+		bu.Put([]byte("a"), []byte("changed"))
+		bu.Put([]byte("new"), []byte("new"))
+		bu.Delete([]byte("b"))
+		bu.DeleteBucket([]byte("sub"))
+		bu.NextSequence()
+		tx.CreateBucketIfNotExists([]byte("other"))
+		return fmt.Errorf("oops")
+	})
+	if err == nil || err.Error() != "oops" {
+		t.Errorf("expected oops got %v", err)
+	}
+
+	s.View(func(tx Tx) error {
+		if tx.Bucket([]byte("other")) != nil || tx.Bucket([]byte("missing")) != nil {
+			t.Errorf("found a bucket that isn't there")
+		}
+
+		bu := tx.Bucket([]byte("b"))
+
+		var keys []string
+		bu.ForEach(func(k, v []byte) error {
+			keys = append(keys, fmt.Sprintf("%s=%s", k, v))
+			return nil
+		})
+
+		if strings.Join(keys, " ") != "a=va ab=vab b=vb sub=" {
+			t.Errorf("unexpected keys %v", keys)
+		}
+
+		if bu.Bucket([]byte("sub")) == nil {
+			t.Errorf("sub bucket is gone")
+		}
+
+		cur := bu.Cursor()
+		if k, _ := cur.Seek([]byte("aa")); string(k) != "ab" {
+			t.Errorf("expected to seek to ab got %q", k)
+		}
+
+		if k, _ := cur.Next(); string(k) != "b" {
+			t.Errorf("expected b next got %q", k)
+		}
+
+		if k, _ := cur.Seek([]byte("z")); k != nil {
+			t.Errorf("expected nothing after z got %q", k)
+		}
+
+		if err := bu.Put([]byte("x"), nil); err == nil {
+			t.Errorf("wrote in a read only transaction")
+		}
+
+		return nil
+	})
+
+	s.Update(func(tx Tx) error {
+		if seq, _ := tx.Bucket([]byte("b")).NextSequence(); seq != 2 {
+			t.Errorf("expected sequence 2 got %d", seq)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,341 @@
+package markov
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errNotWritable   = errors.New("markov: transaction not writable")
+	errBucketMissing = errors.New("markov: bucket not found")
+	errIncompatible  = errors.New("markov: key is a value, not a bucket")
+	errClosed        = errors.New("markov: storage closed")
+)
+
+// memStorage is a Storage kept in memory.
+type memStorage struct {
+	mu     sync.RWMutex
+	root   *memBucket
+	closed bool
+}
+
+// NewMemStorage returns a Storage which is kept in memory, for chains
+// that needn't outlive the program, like those in tests.
+func NewMemStorage() Storage {
+	return &memStorage{root: newmembucket()}
+}
+
+func (s *memStorage) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return errClosed
+	}
+
+	return fn(&memTx{root: s.root})
+}
+
+func (s *memStorage) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errClosed
+	}
+
+	tx := &memTx{root: s.root, writable: true}
+
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (s *memStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// memTx is a transaction of a memStorage. A writable one applies changes
+// as they're made, and keeps a log to undo them with.
+type memTx struct {
+	root     *memBucket
+	writable bool
+	undo     []func()
+}
+
+func (t *memTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+
+	t.undo = nil
+}
+
+func (t *memTx) Bucket(name []byte) Bucket {
+	return t.bucket(t.root).Bucket(name)
+}
+
+func (t *memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.bucket(t.root).CreateBucketIfNotExists(name)
+}
+
+func (t *memTx) DeleteBucket(name []byte) error {
+	return t.bucket(t.root).DeleteBucket(name)
+}
+
+func (t *memTx) Writable() bool {
+	return t.writable
+}
+
+// Size returns about the memory the keys and values take.
+func (t *memTx) Size() int64 {
+	return t.root.size()
+}
+
+func (t *memTx) bucket(b *memBucket) *memBucketTx {
+	return &memBucketTx{b: b, tx: t}
+}
+
+// memBucket holds sorted keys, each with a value or a bucket.
+type memBucket struct {
+	keys    []string
+	values  map[string][]byte
+	buckets map[string]*memBucket
+	seq     uint64
+}
+
+func newmembucket() *memBucket {
+	return &memBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memBucket),
+	}
+}
+
+func (b *memBucket) size() int64 {
+	var n int64
+
+	for _, k := range b.keys {
+		n += int64(len(k) + len(b.values[k]))
+
+		if nb, ok := b.buckets[k]; ok {
+			n += nb.size()
+		}
+	}
+
+	return n
+}
+
+// index returns where k is, or would be, in b.keys.
+func (b *memBucket) index(k string) int {
+	return sort.SearchStrings(b.keys, k)
+}
+
+func (b *memBucket) insert(k string) {
+	i := b.index(k)
+	if i < len(b.keys) && b.keys[i] == k {
+		return
+	}
+
+	b.keys = append(b.keys, "")
+	copy(b.keys[i+1:], b.keys[i:])
+	b.keys[i] = k
+}
+
+func (b *memBucket) remove(k string) {
+	i := b.index(k)
+	if i < len(b.keys) && b.keys[i] == k {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	}
+}
+
+// memBucketTx is a memBucket in a transaction.
+type memBucketTx struct {
+	b  *memBucket
+	tx *memTx
+}
+
+func (b *memBucketTx) Bucket(name []byte) Bucket {
+	if nb, ok := b.b.buckets[string(name)]; ok {
+		return b.tx.bucket(nb)
+	}
+
+	return nil
+}
+
+func (b *memBucketTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !b.tx.writable {
+		return nil, errNotWritable
+	}
+
+	k := string(name)
+
+	if nb, ok := b.b.buckets[k]; ok {
+		return b.tx.bucket(nb), nil
+	}
+
+	if _, ok := b.b.values[k]; ok {
+		return nil, errIncompatible
+	}
+
+	nb := newmembucket()
+	b.b.buckets[k] = nb
+	b.b.insert(k)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		delete(b.b.buckets, k)
+		b.b.remove(k)
+	})
+
+	return b.tx.bucket(nb), nil
+}
+
+func (b *memBucketTx) DeleteBucket(name []byte) error {
+	if !b.tx.writable {
+		return errNotWritable
+	}
+
+	k := string(name)
+
+	nb, ok := b.b.buckets[k]
+	if !ok {
+		return errBucketMissing
+	}
+
+	delete(b.b.buckets, k)
+	b.b.remove(k)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.buckets[k] = nb
+		b.b.insert(k)
+	})
+
+	return nil
+}
+
+func (b *memBucketTx) Get(k []byte) []byte {
+	return b.b.values[string(k)]
+}
+
+func (b *memBucketTx) Put(k, v []byte) error {
+	if !b.tx.writable {
+		return errNotWritable
+	}
+
+	key := string(k)
+
+	if _, ok := b.b.buckets[key]; ok {
+		return errIncompatible
+	}
+
+	old, had := b.b.values[key]
+
+	b.b.values[key] = append([]byte{}, v...)
+	b.b.insert(key)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		if had {
+			b.b.values[key] = old
+			return
+		}
+
+		delete(b.b.values, key)
+		b.b.remove(key)
+	})
+
+	return nil
+}
+
+func (b *memBucketTx) Delete(k []byte) error {
+	if !b.tx.writable {
+		return errNotWritable
+	}
+
+	key := string(k)
+
+	if _, ok := b.b.buckets[key]; ok {
+		return errIncompatible
+	}
+
+	old, had := b.b.values[key]
+	if !had {
+		return nil
+	}
+
+	delete(b.b.values, key)
+	b.b.remove(key)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.values[key] = old
+		b.b.insert(key)
+	})
+
+	return nil
+}
+
+func (b *memBucketTx) ForEach(fn func(k, v []byte) error) error {
+	for _, k := range b.b.keys {
+		if err := fn([]byte(k), b.b.values[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *memBucketTx) NextSequence() (uint64, error) {
+	if !b.tx.writable {
+		return 0, errNotWritable
+	}
+
+	b.b.seq++
+
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.seq--
+	})
+
+	return b.b.seq, nil
+}
+
+func (b *memBucketTx) Cursor() Cursor {
+	return &memCursor{b: b.b, i: -1}
+}
+
+// memCursor walks a memBucket's keys.
+type memCursor struct {
+	b *memBucket
+	i int
+}
+
+func (c *memCursor) at() ([]byte, []byte) {
+	if c.i < 0 || c.i >= len(c.b.keys) {
+		return nil, nil
+	}
+
+	k := c.b.keys[c.i]
+	return []byte(k), c.b.values[k]
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	c.i = 0
+	return c.at()
+}
+
+func (c *memCursor) Seek(k []byte) ([]byte, []byte) {
+	c.i = c.b.index(string(k))
+	return c.at()
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	if c.i < len(c.b.keys) {
+		c.i++
+	}
+	return c.at()
+}
@@ -23,7 +23,8 @@ func (p Prefix) Shift(word string) {
 	p[len(p)-1] = word
 }
 
-// convert prefix into a byte array for db
+// convert prefix into a byte array for db. Keys are folded to lower case,
+// so they match however the words were written.
 func (p Prefix) Key() []byte {
-	return []byte(p.String())
+	return []byte(fold(p.String()))
 }
@@ -0,0 +1,127 @@
+package markov
+
+import (
+	"sort"
+)
+
+// Stats describes what a chain has learned.
+type Stats struct {
+	// Order is the number of words in a prefix.
+	Order int
+	// Starts is the number of prefixes sentences start with.
+	Starts int
+	// Prefixes is the number of prefixes, and NGrams the number of
+	// times a word was seen following one.
+	Prefixes int
+	NGrams   uint64
+	// Words is the number of distinct words.
+	Words int
+	// Sentences is the number of sentences kept to rebuild from.
+	Sentences int
+	// Size is the size of the whole database, in bytes.
+	Size int64
+	// Top are the most common words, most common first, without
+	// stop words.
+	Top []WordCount
+}
+
+// Stats counts what the chain has learned, with its top most common
+// words.
+func (c *Chain) Stats(top int) (Stats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	st := Stats{
+		Order:  c.order,
+		Starts: len(c.starts),
+	}
+
+	err := c.db.View(func(tx Tx) error {
+		st.Size = tx.Size()
+		d := c.dict.in(tx)
+
+		err := c.bkt(tx, gramsBucket).ForEach(func(k, v []byte) error {
+			suf := NewSuffix()
+			if err := suf.decode(d, v); err != nil {
+				return err
+			}
+
+			st.Prefixes++
+			for _, n := range suf.M {
+				st.NGrams += uint64(n)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		var words byCount
+
+		err = c.bkt(tx, wordsBucket).ForEach(func(k, v []byte) error {
+			st.Words++
+
+			if w := string(k); !stopwords[w] {
+				words = append(words, WordCount{w, parseword(v).count})
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		sort.Stable(sort.Reverse(words))
+
+		if len(words) > top {
+			words = words[:top]
+		}
+
+		st.Top = words
+
+		return c.bkt(tx, sourceBucket).ForEach(func(k, v []byte) error {
+			st.Sentences++
+			return nil
+		})
+	})
+
+	return st, err
+}
+
+// Next returns the words that have followed the last Order words of text,
+// most likely first, and the prefix they were looked up by.
+func (c *Chain) Next(text string) ([]WordCount, Prefix) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var toks []string
+	for _, sent := range Tokenize(text) {
+		toks = append(toks, sent...)
+	}
+
+	if len(toks) < c.order {
+		return nil, nil
+	}
+
+	p := Prefix(toks[len(toks)-c.order:])
+
+	var next byCount
+	for w, n := range c.getgram(p).M {
+		next = append(next, WordCount{w, uint64(n)})
+	}
+
+	// most likely first, then in order, so the same text says the same
+	sort.Sort(byWord(next))
+	sort.Stable(sort.Reverse(next))
+
+	return next, p
+}
+
+type byWord []WordCount
+
+func (b byWord) Len() int           { return len(b) }
+func (b byWord) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byWord) Less(i, j int) bool { return b[i].Word < b[j].Word }
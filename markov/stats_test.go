@@ -0,0 +1,60 @@
+package markov
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChainStats(t *testing.T) {
+	c := memchain(t, Options{Order: 1}, 1)
+	defer c.Close()
+
+	if err := c.Build(strings.NewReader(seedtext)); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := c.Stats(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Order != 1 || st.Starts != 2 || st.Prefixes != 9 || st.NGrams != 33 || st.Words != 9 || st.Sentences != 6 {
+		t.Errorf("stats %+v", st)
+	}
+
+	if st.Size == 0 {
+		t.Error("no size")
+	}
+
+	if want := []WordCount{{"cat", 4}}; !reflect.DeepEqual(st.Top, want) {
+		t.Errorf("top %v want %v", st.Top, want)
+	}
+}
+
+func TestChainNext(t *testing.T) {
+	c := memchain(t, Options{Order: 1}, 1)
+	defer c.Close()
+
+	if err := c.Build(strings.NewReader(seedtext)); err != nil {
+		t.Fatal(err)
+	}
+
+	next, p := c.Next("sat on The")
+	if p.String() != "The" {
+		t.Errorf("prefix %q", p.String())
+	}
+
+	want := []WordCount{{"cat", 3}, {"mat", 3}, {"rat", 2}, {"dog", 1}}
+	if !reflect.DeepEqual(next, want) {
+		t.Errorf("next %v want %v", next, want)
+	}
+
+	if next, _ := c.Next("zebra"); len(next) != 0 {
+		t.Errorf("next after unknown word %v", next)
+	}
+
+	if next, _ := c.Next(""); next != nil {
+		t.Errorf("next after nothing %v", next)
+	}
+}
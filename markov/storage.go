@@ -0,0 +1,172 @@
+package markov
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Storage is a database of nested buckets of sorted keys, like bolt, in
+// which a chain keeps what it has learned. Bolt is the default; see
+// NewMemStorage for one that is kept in memory.
+type Storage interface {
+	// View runs fn in a read only transaction.
+	View(fn func(Tx) error) error
+
+	// Update runs fn in a read-write transaction, which is undone if fn
+	// returns an error.
+	Update(fn func(Tx) error) error
+
+	Close() error
+}
+
+// Tx is a transaction of a Storage.
+type Tx interface {
+	// Bucket returns the top level bucket called name, or nil if there is
+	// none.
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	Writable() bool
+
+	// Size returns the size of the database, in bytes.
+	Size() int64
+}
+
+// Bucket is a set of sorted keys, each with a value or a bucket of its own.
+// Keys and values are only valid during the transaction.
+type Bucket interface {
+	// Bucket returns the bucket in this one called name, or nil if there
+	// is none.
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+
+	// Get returns the value of k, or nil if there is none.
+	Get(k []byte) []byte
+	Put(k, v []byte) error
+	Delete(k []byte) error
+
+	// ForEach calls fn with each key in order, and its value, which is nil
+	// for a bucket. fn mustn't change the bucket.
+	ForEach(fn func(k, v []byte) error) error
+
+	// NextSequence returns a number which increases with each call.
+	NextSequence() (uint64, error)
+
+	Cursor() Cursor
+}
+
+// Cursor walks the keys of a bucket in order. Each method returns a nil
+// key at the end of the bucket.
+type Cursor interface {
+	First() (k, v []byte)
+	// Seek moves to k, or the key after where it would be.
+	Seek(k []byte) (key, v []byte)
+	Next() (k, v []byte)
+}
+
+// boltStorage is a Storage in a bolt database.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func openbolt(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStorage{db}, nil
+}
+
+func (s *boltStorage) View(fn func(Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStorage) Update(fn func(Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return boltbucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bu, err := t.tx.CreateBucketIfNotExists(name)
+	return boltbucket(bu), err
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+func (t boltTx) Writable() bool {
+	return t.tx.Writable()
+}
+
+func (t boltTx) Size() int64 {
+	return t.tx.Size()
+}
+
+type boltBucket struct {
+	bu *bolt.Bucket
+}
+
+// boltbucket wraps bu, keeping a missing bucket nil.
+func boltbucket(bu *bolt.Bucket) Bucket {
+	if bu == nil {
+		return nil
+	}
+
+	return boltBucket{bu}
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	return boltbucket(b.bu.Bucket(name))
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bu, err := b.bu.CreateBucketIfNotExists(name)
+	return boltbucket(bu), err
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.bu.DeleteBucket(name)
+}
+
+func (b boltBucket) Get(k []byte) []byte {
+	return b.bu.Get(k)
+}
+
+func (b boltBucket) Put(k, v []byte) error {
+	return b.bu.Put(k, v)
+}
+
+func (b boltBucket) Delete(k []byte) error {
+	return b.bu.Delete(k)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.bu.ForEach(fn)
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.bu.NextSequence()
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.bu.Cursor()
+}
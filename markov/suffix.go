@@ -2,9 +2,11 @@ package markov
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
-
-	"github.com/jmcvetta/randutil"
+	"fmt"
+	"math/rand"
+	"sort"
 )
 
 type Suffix struct {
@@ -28,18 +30,35 @@ func (s *Suffix) Insert(word string) {
 }
 
 func (s *Suffix) Pick() string {
-	var c []randutil.Choice
+	return s.pick(rand.Intn)
+}
+
+// pick chooses a word weighted by its count, using intn, which returns a
+// number in [0,n), for the randomness. Words are taken in order, so the
+// same intn picks the same word.
+func (s *Suffix) pick(intn func(n int) int) string {
+	words := make([]string, 0, len(s.M))
+	total := 0
 
-	for k, v := range s.M {
-		c = append(c, randutil.Choice{int(v), k})
+	for w, n := range s.M {
+		words = append(words, w)
+		total += int(n)
 	}
 
-	choice, err := randutil.WeightedChoice(c)
-	if err != nil {
-		panic(err)
+	if total <= 0 {
+		panic("markov: picking from an empty suffix")
 	}
 
-	return choice.Item.(string)
+	sort.Strings(words)
+
+	r := intn(total)
+	for _, w := range words {
+		if r -= int(s.M[w]); r < 0 {
+			return w
+		}
+	}
+
+	panic("unreachable")
 }
 
 func (s *Suffix) Merge(other *Suffix) {
@@ -48,7 +67,21 @@ func (s *Suffix) Merge(other *Suffix) {
 	}
 }
 
+// Subtract takes away the counts in other, dropping words which reach 0.
+func (s *Suffix) Subtract(other *Suffix) {
+	for k, v := range other.M {
+		if s.M[k] <= v {
+			delete(s.M, k)
+			continue
+		}
+		s.M[k] -= v
+	}
+}
+
 // convert suffix into json encoded value for db
+//
+// This is the original encoding, still read by decode; the db is written
+// with encode.
 func (s *Suffix) Value() []byte {
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(s); err != nil {
@@ -56,3 +89,99 @@ func (s *Suffix) Value() []byte {
 	}
 	return buf.Bytes()
 }
+
+// suffix encodings. The first byte of a value says which it is; JSON
+// values from Value always start with '{'.
+const (
+	suffixJSON   = '{'
+	suffixBinary = 1
+)
+
+// interner maps words to ids and back for the binary encoding.
+type interner interface {
+	id(word string) (uint64, error)
+	word(id uint64) (string, bool)
+}
+
+type byID []uint64
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool { return b[i] < b[j] }
+
+// encode converts the suffix to its binary value for the db: the version
+// byte, then for each word in order of id, the difference from the last
+// id and the word's count, both uvarints.
+func (s *Suffix) encode(in interner) ([]byte, error) {
+	counts := make(map[uint64]uint32, len(s.M))
+	ids := make(byID, 0, len(s.M))
+
+	for w, n := range s.M {
+		id, err := in.id(w)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[id] = n
+		ids = append(ids, id)
+	}
+
+	sort.Sort(ids)
+
+	v := make([]byte, 1, 1+len(ids)*2*binary.MaxVarintLen32)
+	v[0] = suffixBinary
+
+	var tmp [binary.MaxVarintLen64]byte
+	last := uint64(0)
+
+	for _, id := range ids {
+		v = append(v, tmp[:binary.PutUvarint(tmp[:], id-last)]...)
+		v = append(v, tmp[:binary.PutUvarint(tmp[:], uint64(counts[id]))]...)
+		last = id
+	}
+
+	return v, nil
+}
+
+// decode reads a value from the db in either encoding into the suffix.
+func (s *Suffix) decode(in interner, v []byte) error {
+	if len(v) == 0 {
+		return fmt.Errorf("markov: empty suffix")
+	}
+
+	switch v[0] {
+	case suffixJSON:
+		return json.Unmarshal(v, s)
+	case suffixBinary:
+	default:
+		return fmt.Errorf("markov: unknown suffix encoding %d", v[0])
+	}
+
+	v = v[1:]
+	id := uint64(0)
+
+	for len(v) > 0 {
+		delta, n := binary.Uvarint(v)
+		if n <= 0 {
+			return fmt.Errorf("markov: bad suffix")
+		}
+		v = v[n:]
+
+		count, n := binary.Uvarint(v)
+		if n <= 0 {
+			return fmt.Errorf("markov: bad suffix")
+		}
+		v = v[n:]
+
+		id += delta
+
+		w, ok := in.word(id)
+		if !ok {
+			return fmt.Errorf("markov: suffix has unknown word %d", id)
+		}
+
+		s.M[w] += uint32(count)
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package markov
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -83,3 +84,119 @@ func TestSuffixValue(t *testing.T) {
 	}
 
 }
+
+// mapinterner interns words in memory.
+type mapinterner map[string]uint64
+
+func (m mapinterner) id(word string) (uint64, error) {
+	if id, ok := m[word]; ok {
+		return id, nil
+	}
+
+	m[word] = uint64(len(m) + 1)
+	return m[word], nil
+}
+
+func (m mapinterner) word(id uint64) (string, bool) {
+	for w, i := range m {
+		if i == id {
+			return w, true
+		}
+	}
+
+	return "", false
+}
+
+func TestSuffixEncode(t *testing.T) {
+	in := make(mapinterner)
+
+	s := NewSuffix()
+	s.M["foo"] = 1
+	s.M["bar"] = 300
+	s.M["baz"] = 70000
+
+	v, err := s.encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v[0] != suffixBinary {
+		t.Errorf("expected version %d got %d", suffixBinary, v[0])
+	}
+
+	if len(v) >= len(s.Value()) {
+		t.Errorf("binary value (%d) is no smaller than json (%d)", len(v), len(s.Value()))
+	}
+
+	for _, val := range [][]byte{v, s.Value()} {
+		s2 := NewSuffix()
+		if err := s2.decode(in, val); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s2.M) != 3 || s2.M["foo"] != 1 || s2.M["bar"] != 300 || s2.M["baz"] != 70000 {
+			t.Errorf("decoding %q got %v", val, s2.M)
+		}
+	}
+
+	for _, bad := range [][]byte{{}, {2}, {suffixBinary, 0x80}, {suffixBinary, 99, 1}} {
+		if err := NewSuffix().decode(in, bad); err == nil {
+			t.Errorf("decoded bad value %q", bad)
+		}
+	}
+}
+
+// benchsuffix makes a suffix of n words with made up counts.
+func benchsuffix(n int) *Suffix {
+	s := NewSuffix()
+	for i := 0; i < n; i++ {
+		s.M[fmt.Sprintf("word%d", i)] = uint32(i*7 + 1)
+	}
+	return s
+}
+
+// BenchmarkSuffix compares a decode and encode in the JSON and binary
+// encodings, and logs the size of each.
+func BenchmarkSuffix(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		s := benchsuffix(n)
+
+		in := make(mapinterner)
+		for w := range s.M {
+			in.id(w)
+		}
+
+		// the interner's reverse lookup is a scan, where the db's is a map
+		words := make(map[uint64]string)
+		for w, id := range in {
+			words[id] = w
+		}
+		din := &dicttx{dict: &dict{ids: in, words: words}}
+
+		bin, _ := s.encode(din)
+		b.Logf("words=%d: json %d bytes, binary %d bytes", n, len(s.Value()), len(bin))
+
+		b.Run(fmt.Sprintf("json/words=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s2 := NewSuffix()
+				if err := s2.decode(din, s.Value()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("binary/words=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				v, err := s.encode(din)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				s2 := NewSuffix()
+				if err := s2.decode(din, v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package markov
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// punctuation split off the front and back of words
+const (
+	openPunct  = "(\"“«"
+	closePunct = ".,;:!?)\"”»…"
+	// runs of these make one token
+	endPunct = ".?!"
+)
+
+var (
+	// :) ;-) :D :P :'( <3 \o/ ^_^ -_- o_O and the like
+	emoticonRe = regexp.MustCompile(`^(?:[:;=8xX][-o^']?[\]\[)(dDpPsS/\\|oO3*@$]+|[\]\[)(dDpP/\\|]+[-o^']?[:;=]|<[/\\]?3+|\\o/|\\o|o/|\^[_.-]*\^|-_+-|[oO0]_+[oO0]|[tT]_+[tT])$`)
+
+	// u.s. e.g.
+	initialsRe = regexp.MustCompile(`^(?:\pL\.){2,}$`)
+
+	// abbreviations whose full stop doesn't end a sentence
+	abbreviations = map[string]bool{
+		"mr.": true, "mrs.": true, "ms.": true, "dr.": true, "st.": true,
+		"jr.": true, "sr.": true, "vs.": true, "etc.": true, "prof.": true,
+		"approx.": true,
+	}
+
+	// abbreviations only when a number follows, as in "no. 5"
+	numbered = map[string]bool{"no.": true}
+)
+
+// tokenizer splits text into sentences of tokens. Words, numbers, nicks,
+// urls and emoticons are tokens as they are; punctuation around them is
+// split off into tokens of its own.
+type tokenizer struct {
+	sent []string
+	// a numbered abbreviation, until the next word says whether it is one
+	held string
+}
+
+// word adds a whitespace separated word to the sentence, returning the
+// sentences it ends.
+func (t *tokenizer) word(w string) [][]string {
+	var sents [][]string
+
+	if h := t.held; h != "" {
+		t.held = ""
+
+		if r, _ := utf8.DecodeRuneInString(w); unicode.IsDigit(r) {
+			t.sent = append(t.sent, h)
+		} else if s := t.add(h); s != nil {
+			sents = append(sents, s)
+		}
+	}
+
+	if numbered[strings.ToLower(w)] {
+		t.held = w
+		return sents
+	}
+
+	if s := t.add(w); s != nil {
+		sents = append(sents, s)
+	}
+
+	return sents
+}
+
+// add adds a word to the sentence, returning the sentence if the word
+// ends it.
+func (t *tokenizer) add(w string) []string {
+	if emoticonRe.MatchString(w) {
+		t.sent = append(t.sent, w)
+		return nil
+	}
+
+	for w != "" {
+		r, n := utf8.DecodeRuneInString(w)
+		if !strings.ContainsRune(openPunct, r) {
+			break
+		}
+
+		t.sent = append(t.sent, w[:n])
+		w = w[n:]
+	}
+
+	lw := strings.ToLower(w)
+	if abbreviations[lw] || initialsRe.MatchString(lw) || isurl(lw) && !strings.ContainsAny(lw[len(lw)-1:], closePunct) {
+		t.sent = append(t.sent, w)
+		return nil
+	}
+
+	// find where the trailing punctuation starts
+	i := len(w)
+	for i > 0 {
+		r, n := utf8.DecodeLastRuneInString(w[:i])
+		if !strings.ContainsRune(closePunct, r) {
+			break
+		}
+		i -= n
+	}
+
+	// the full stop of an abbreviation in brackets or before a comma
+	if i < len(w) && w[i] == '.' {
+		if a := strings.ToLower(w[:i+1]); abbreviations[a] || initialsRe.MatchString(a) {
+			i++
+		}
+	}
+
+	if i > 0 {
+		t.sent = append(t.sent, w[:i])
+	}
+
+	end := false
+
+	for rest := w[i:]; rest != ""; {
+		n := strings.IndexFunc(rest, func(r rune) bool {
+			return !strings.ContainsRune(endPunct, r)
+		})
+
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(rest)
+		} else if n < 0 {
+			n = len(rest)
+		}
+
+		tok := rest[:n]
+		rest = rest[n:]
+
+		t.sent = append(t.sent, tok)
+		end = end || IsEnd(tok)
+	}
+
+	if end {
+		return t.flush()
+	}
+
+	return nil
+}
+
+// flush returns the sentence so far, if any, and starts another.
+func (t *tokenizer) flush() []string {
+	if h := t.held; h != "" {
+		t.held = ""
+
+		if s := t.add(h); s != nil {
+			return s
+		}
+	}
+
+	s := t.sent
+	t.sent = nil
+	return s
+}
+
+func isurl(w string) bool {
+	return strings.Contains(w, "://") || strings.HasPrefix(w, "www.")
+}
+
+// IsEnd reports whether a token ends a sentence, like "." or "?!".
+// An ellipsis doesn't.
+func IsEnd(tok string) bool {
+	if tok == "" || strings.Trim(tok, endPunct) != "" {
+		return false
+	}
+
+	return !(len(tok) > 1 && strings.Trim(tok, ".") == "")
+}
+
+// IsPunct reports whether a token is punctuation, rather than a word.
+func IsPunct(tok string) bool {
+	return tok != "" && strings.Trim(tok, openPunct+closePunct) == ""
+}
+
+// Tokenize splits text into sentences of tokens.
+func Tokenize(text string) [][]string {
+	var (
+		t     tokenizer
+		sents [][]string
+	)
+
+	for _, w := range strings.Fields(text) {
+		sents = append(sents, t.word(w)...)
+	}
+
+	if s := t.flush(); s != nil {
+		sents = append(sents, s)
+	}
+
+	return sents
+}
+
+// scanTokens reads r a sentence at a time, calling fn with each.
+func scanTokens(r io.Reader, fn func(sent []string) error) error {
+	var t tokenizer
+
+	scans := bufio.NewScanner(r)
+	scans.Buffer(nil, 1024*1024)
+	scans.Split(bufio.ScanWords)
+
+	for scans.Scan() {
+		for _, s := range t.word(scans.Text()) {
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := scans.Err(); err != nil {
+		return err
+	}
+
+	if s := t.flush(); s != nil {
+		return fn(s)
+	}
+
+	return nil
+}
+
+// Join joins tokens into text, spacing punctuation as it would be written.
+func Join(toks []string) string {
+	var (
+		buf    []byte
+		quoted bool
+		// no space before the next token
+		glue = true
+	)
+
+	for _, tok := range toks {
+		r, _ := utf8.DecodeRuneInString(tok)
+
+		switch {
+		case tok == `"`:
+			// opening or closing quote
+			if quoted {
+				glue = true
+			}
+		case len(tok) == utf8.RuneLen(r) && strings.ContainsRune(closePunct, r) && r != '"':
+			glue = true
+		case IsEnd(tok) || strings.Trim(tok, ".…") == "":
+			glue = true
+		}
+
+		if !glue {
+			buf = append(buf, ' ')
+		}
+
+		buf = append(buf, tok...)
+
+		glue = false
+
+		switch {
+		case tok == `"`:
+			glue = !quoted
+			quoted = !quoted
+		case len(tok) == utf8.RuneLen(r) && strings.ContainsRune(openPunct, r):
+			glue = true
+		}
+	}
+
+	return string(buf)
+}
+
+// fold returns the form of a token chains are keyed by.
+func fold(tok string) string {
+	return strings.ToLower(tok)
+}
+
+// hasupper reports whether a token has any upper case letters.
+func hasupper(tok string) bool {
+	return strings.IndexFunc(tok, unicode.IsUpper) >= 0
+}
@@ -0,0 +1,116 @@
+package markov
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want [][]string
+	}{
+		{"Hello, world! How are you?", [][]string{
+			{"Hello", ",", "world", "!"},
+			{"How", "are", "you", "?"},
+		}},
+		{"see http://example.com/a.b?c=1. then www.example.org", [][]string{
+			{"see", "http://example.com/a.b?c=1", "."},
+			{"then", "www.example.org"},
+		}},
+		{"pi is 3.14, e.g. roughly; Mr. Smith said so (approx.) ok", [][]string{
+			{"pi", "is", "3.14", ",", "e.g.", "roughly", ";", "Mr.", "Smith", "said", "so", "(", "approx.", ")", "ok"},
+		}},
+		{"mischief: lol :) :D <3 \\o/ ^_^ ;-)", [][]string{
+			{"mischief", ":", "lol", ":)", ":D", "<3", "\\o/", "^_^", ";-)"},
+		}},
+		{`[bot] foo|away said "wait..." and left?! the U.S. is big.`, [][]string{
+			{"[bot]", "foo|away", "said", `"`, "wait", "...", `"`, "and", "left", "?!"},
+			{"the", "U.S.", "is", "big", "."},
+		}},
+		{"(really.) no", [][]string{
+			{"(", "really", ".", ")"},
+			{"no"},
+		}},
+		{"I said no. You said yes. see no. 5, then No. 6 or no.", [][]string{
+			{"I", "said", "no", "."},
+			{"You", "said", "yes", "."},
+			{"see", "no.", "5", ",", "then", "No.", "6", "or", "no", "."},
+		}},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		if got := Tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q)\n got %q\nwant %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	for _, s := range []string{
+		"Hello, world!",
+		"see http://example.com/a.b?c=1.",
+		"Mr. Smith said so (approx.) ok",
+		`he said "wait..." and left?!`,
+		"mischief: lol :) <3",
+		"(really.)",
+	} {
+		var toks []string
+		for _, sent := range Tokenize(s) {
+			toks = append(toks, sent...)
+		}
+
+		if got := Join(toks); got != s {
+			t.Errorf("Join(%q) = %q, want %q", toks, got, s)
+		}
+	}
+}
+
+func TestIsEnd(t *testing.T) {
+	for tok, want := range map[string]bool{
+		".": true, "?": true, "!": true, "?!": true, "!!!": true,
+		"...": false, "…": false, ",": false, "e.g.": false, "": false,
+	} {
+		if IsEnd(tok) != want {
+			t.Errorf("IsEnd(%q) = %v, want %v", tok, !want, want)
+		}
+	}
+}
+
+func TestChainTokens(t *testing.T) {
+	c := memchain(t, Options{Order: 1}, 1)
+	defer c.Close()
+
+	text := "I like Go. go is fun! We like http://golang.org, you know. Go, Go, Go! ask Bob about Bob."
+	if err := c.Build(strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are folded, and the words after them kept as written
+	if suf := c.getgram(Prefix{"GO"}); suf.M["."] != 1 || suf.M["is"] != 1 || suf.M[","] != 2 || suf.M["!"] != 1 {
+		t.Errorf("unexpected suffixes of go: %v", suf.M)
+	}
+
+	if suf := c.getgram(Prefix{"like"}); suf.M["Go"] != 1 || suf.M["http://golang.org"] != 1 {
+		t.Errorf("unexpected suffixes of like: %v", suf.M)
+	}
+
+	// generation stops at the end of a sentence, and is written properly
+	for i := 0; i < 20; i++ {
+		s := c.Generate(100)
+		if !strings.HasSuffix(s, ".") && !strings.HasSuffix(s, "!") {
+			t.Errorf("generated an unfinished sentence %q", s)
+		}
+
+		if strings.Contains(s, " ,") || strings.Contains(s, " .") || strings.Contains(s, " !") {
+			t.Errorf("badly joined sentence %q", s)
+		}
+	}
+
+	// seed words are written as they mostly were
+	if s := c.GenerateFrom([]string{"BOB"}, 0); !strings.Contains(s, "Bob") || strings.Contains(s, "bob") {
+		t.Errorf("expected a sentence about Bob, got %q", s)
+	}
+}
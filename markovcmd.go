@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mischief/glenda/markov"
+
+	"github.com/spf13/cobra"
+)
+
+var markovCmd = &cobra.Command{
+	Use:   "markov",
+	Short: "maintain the markov module's chain",
+}
+
+var markovRebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "rebuild the markov chain at another order from the text it learned",
+	Long: `Rebuild throws away the markov chain's n-grams and learns them again, with
+prefixes of --order words, from the text the chain has kept. Without --order
+the chain is rebuilt at the order in the config. The bot must not be running.`,
+	RunE: runMarkovRebuild,
+}
+
+var markovImportCmd = &cobra.Command{
+	Use:   "import path...",
+	Short: "teach the markov chain text files, directories of them, or irc logs",
+	Long: `Import trains the markov chain from files, or directories of files. Plain text
+is learned as it is. Irc logs (.log, as written by chanlog, irssi, weechat, znc
+and the like) and chanlog's json logs (.jsonl) are learned a message at a time,
+each as said by its nick when it was said, so .markov forget and retention=
+apply to it. Joins, parts, commands to the bot, what the bot said and what
+nicks and channels in ignore= said are left out. Either may be gzipped.
+--format overrides the guess made from each file's name.
+
+Files already imported are skipped, even if they have since been moved or
+gzipped. --chain imports into a channel's chain (#chan), or a nick's chain in
+a channel (#chan@nick), rather than the default one. The bot must not be
+running.`,
+	RunE: runMarkovImport,
+}
+
+var markovMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "rewrite the markov chain's n-grams in the compact encoding",
+	Long: `Migrate rewrites n-grams the markov chain stored as JSON, before it had a
+binary encoding, in the binary one. The bot reads and updates either, so this
+is only needed once, to save space and time. The bot must not be running.`,
+	RunE: runMarkovMigrate,
+}
+
+var markovExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "write the markov chains as json lines",
+	Long: `Export writes the default markov chain, every channel's and nick's, and who
+opted out, to file, or standard output, one json object per line. Load reads
+them into another bot's chains. The bot must not be running.`,
+	RunE: runMarkovExport,
+}
+
+var markovLoadCmd = &cobra.Command{
+	Use:   "load file",
+	Short: "add markov chains written by export to this bot's",
+	Long: `Load adds what chains written by export learned to this bot's chains, making
+any it doesn't have. Chains exported at the same order are merged; otherwise
+they're learned again from the text they kept. "-" reads standard input. The
+bot must not be running.`,
+	RunE: runMarkovLoad,
+}
+
+var (
+	markovOrder  int
+	markovFormat string
+	markovBatch  int
+	markovChain  string
+)
+
+func init() {
+	markovRebuildCmd.Flags().IntVar(&markovOrder, "order", 0, "words per prefix (default: order= in the config)")
+
+	f := markovImportCmd.Flags()
+	f.StringVar(&markovFormat, "format", "", "format of the files: text, log or json (default: guess from the file name)")
+	f.IntVar(&markovBatch, "batch", markov.DefaultBatch, "sentences learned per transaction")
+	f.StringVar(&markovChain, "chain", "", "chain to import into, like #chan or #chan@nick (default: the default chain)")
+
+	markovCmd.AddCommand(markovRebuildCmd)
+	markovCmd.AddCommand(markovImportCmd)
+	markovCmd.AddCommand(markovMigrateCmd)
+	markovCmd.AddCommand(markovExportCmd)
+	markovCmd.AddCommand(markovLoadCmd)
+	root.AddCommand(markovCmd)
+}
+
+func runMarkovRebuild(cmd *cobra.Command, args []string) error {
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	opts := markovoptions(bot)
+
+	order := markovOrder
+	if order == 0 {
+		order = opts.Order
+	}
+
+	if order <= 0 {
+		return fmt.Errorf("no order given, and none in the config")
+	}
+
+	// open it whatever its order is now
+	opts.Order = 0
+
+	c, err := markov.NewChain(opts)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	old := c.Order()
+
+	if err := c.Rebuild(order); err != nil {
+		return err
+	}
+
+	fmt.Printf("rebuilt %s from order %d to order %d\n", opts.Path, old, order)
+	return nil
+}
+
+func runMarkovMigrate(cmd *cobra.Command, args []string) error {
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	opts := markovoptions(bot)
+	opts.Order = 0
+
+	c, err := markov.NewChain(opts)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	n, err := c.Migrate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d n-grams in %s\n", n, opts.Path)
+	return nil
+}
+
+func runMarkovExport(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s", cmd.Use)
+	}
+
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	opts := markovoptions(bot)
+	opts.Order = 0
+
+	c, err := markov.NewChain(opts)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	if len(args) == 0 || args[0] == "-" {
+		return c.Export(os.Stdout)
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.Export(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func runMarkovLoad(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", cmd.Use)
+	}
+
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	c, err := markovopen(bot)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		r = f
+	}
+
+	n, err := c.Load(r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[0], err)
+	}
+
+	fmt.Printf("loaded %d lines into %s\n", n, markovoptions(bot).Path)
+	return nil
+}
+
+func runMarkovImport(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", cmd.Use)
+	}
+
+	switch markovFormat {
+	case "", markovText, markovLog, markovJSON:
+	default:
+		return fmt.Errorf("unknown format %q", markovFormat)
+	}
+
+	if i := strings.LastIndex(markovChain, "@"); i >= 0 {
+		if !IsChannel(markovChain[:i]) || i == len(markovChain)-1 {
+			return fmt.Errorf("a nick's chain is in a channel, like #chan@nick")
+		}
+		markovChain = strings.ToLower(markovChain[:i]) + "@" + nickbase(markovChain[i+1:])
+	} else {
+		markovChain = strings.ToLower(markovChain)
+	}
+
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	c, err := markovopen(bot)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	into, err := c.Namespace(markovChain, true)
+	if err != nil {
+		return err
+	}
+
+	report := func(file string, p markov.Progress, err error) {
+		fmt.Println(markovreport(file, p, err))
+	}
+
+	for _, path := range args {
+		if err := markovimport(into, path, markovFormat, bot.Magic, markovskip(bot), markovBatch, report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/kballard/goirc/irc"
+)
+
+// members tracks who is in the channels the bot is in, so modules can
+// keep people from reading channels they aren't in.
+type members struct {
+	mu sync.Mutex
+	// channel -> nicks, both lower case
+	m map[string]map[string]bool
+
+	// called when a nick quits or changes
+	leave []LeaveFn
+}
+
+// LeaveFn is called with a QUIT or NICK line and the channels its nick
+// was in before it.
+type LeaveFn func(l irc.Line, channels []string)
+
+func newmembers() *members {
+	return &members{m: make(map[string]map[string]bool)}
+}
+
+// track keeps the members up to date with what happens on hr.
+func (ms *members) track(hr irc.HandlerRegistry) {
+	hr.AddHandler("JOIN", func(c *irc.Conn, l irc.Line) {
+		ms.join(l.Args[0], l.Src.Nick)
+	})
+
+	hr.AddHandler("PART", func(c *irc.Conn, l irc.Line) {
+		ms.part(c, l.Args[0], l.Src.Nick)
+	})
+
+	hr.AddHandler("KICK", func(c *irc.Conn, l irc.Line) {
+		ms.part(c, l.Args[0], l.Args[1])
+	})
+
+	hr.AddHandler("QUIT", func(c *irc.Conn, l irc.Line) {
+		chans := ms.channelsof(l.Src.Nick)
+		ms.quit(l.Src.Nick)
+		ms.left(l, chans)
+	})
+
+	hr.AddHandler("NICK", func(c *irc.Conn, l irc.Line) {
+		chans := ms.channelsof(l.Src.Nick)
+		ms.quit(l.Src.Nick)
+		for _, ch := range chans {
+			ms.join(ch, l.Args[0])
+		}
+		ms.left(l, chans)
+	})
+
+	// RPL_NAMREPLY: me = #chan :nick @nick +nick
+	hr.AddHandler("353", func(c *irc.Conn, l irc.Line) {
+		if len(l.Args) < 4 {
+			return
+		}
+		for _, n := range strings.Fields(l.Args[3]) {
+			ms.join(l.Args[2], strings.TrimLeft(n, "~&@%+"))
+		}
+	})
+
+	hr.AddHandler(irc.DISCONNECTED, func(*irc.Conn, irc.Line) {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		ms.m = make(map[string]map[string]bool)
+	})
+}
+
+func (ms *members) join(channel, nick string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	channel = strings.ToLower(channel)
+	if ms.m[channel] == nil {
+		ms.m[channel] = make(map[string]bool)
+	}
+
+	ms.m[channel][strings.ToLower(nick)] = true
+}
+
+func (ms *members) part(c *irc.Conn, channel, nick string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// the bot leaving forgets the channel
+	if c != nil && strings.EqualFold(nick, c.Me().Nick) {
+		delete(ms.m, strings.ToLower(channel))
+		return
+	}
+
+	delete(ms.m[strings.ToLower(channel)], strings.ToLower(nick))
+}
+
+func (ms *members) quit(nick string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, nicks := range ms.m {
+		delete(nicks, strings.ToLower(nick))
+	}
+}
+
+func (ms *members) left(l irc.Line, chans []string) {
+	ms.mu.Lock()
+	fns := ms.leave
+	ms.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(l, chans)
+	}
+}
+
+// in reports whether nick is in channel.
+func (ms *members) in(channel, nick string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.m[strings.ToLower(channel)][strings.ToLower(nick)]
+}
+
+// channelsof lists the channels nick is in, in lower case.
+func (ms *members) channelsof(nick string) []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var chans []string
+	for ch, nicks := range ms.m {
+		if nicks[strings.ToLower(nick)] {
+			chans = append(chans, ch)
+		}
+	}
+
+	return chans
+}
+
+// InChannel reports whether nick is in a channel the bot is in.
+func (b *Bot) InChannel(channel, nick string) bool {
+	return b.members.in(channel, nick)
+}
+
+// ChannelsOf lists the channels the bot shares with nick, in lower case.
+func (b *Bot) ChannelsOf(nick string) []string {
+	return b.members.channelsof(nick)
+}
+
+// OnLeave registers a function to be called when a nick quits or changes,
+// with the channels it was in, since by then they are forgotten.
+func (b *Bot) OnLeave(fn LeaveFn) {
+	b.members.mu.Lock()
+	defer b.members.mu.Unlock()
+
+	b.members.leave = append(b.members.leave, fn)
+}
+
+// CanRead reports whether u may read what is said in channel: admins
+// may read any channel, and others only those they are in.
+func (b *Bot) CanRead(u irc.User, channel string) bool {
+	return b.IsAdmin(u) || b.InChannel(channel, u.Nick)
+}
@@ -27,7 +27,7 @@ type NotifyMod struct {
 	notes map[string][]Note
 }
 
-func (m *NotifyMod) NotifyIfQueued(conn *irc.Conn, line irc.Line) {
+func (m *NotifyMod) NotifyIfQueued(conn irc.SafeConn, line irc.Line) {
 	to := line.Src.String()
 
 	if notes, ok := m.notes[to]; ok {
@@ -53,7 +53,7 @@ func (m *NotifyMod) Init(b *Bot, conn irc.SafeConn) error {
 			note := Note{
 				from:    line.Src.String(),
 				message: args[2],
-				sent:    time.Now(),
+				sent:    b.Now(),
 			}
 
 			m.notes[args[1]] = append(m.notes[args[1]], note)
@@ -62,8 +62,8 @@ func (m *NotifyMod) Init(b *Bot, conn irc.SafeConn) error {
 		}
 	})
 
-	notify := func(conn *irc.Conn, line irc.Line) {
-		m.NotifyIfQueued(conn, line)
+	notify := func(c *irc.Conn, line irc.Line) {
+		m.NotifyIfQueued(b.Conn, line)
 	}
 
 	conn.AddHandler("PRIVMSG", notify)
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/kballard/goirc/irc"
+	"github.com/robfig/cron"
+)
+
+func init() {
+	RegisterModule("poll", func() Module {
+		return &PollMod{}
+	})
+}
+
+const pollUsage = `usage: poll "question" "option" "option"... [--duration=10m] | poll | poll close`
+
+// most options a poll can have
+const pollOptions = 10
+
+var pollBucket = []byte("polls")
+
+// Poll is a question put to a channel. There is at most one open poll per
+// channel.
+type Poll struct {
+	ID       uint64
+	Channel  string
+	Question string
+	Options  []string
+	// who opened it, as nick!user@host
+	Owner  string
+	Opened time.Time
+	Closes time.Time
+	// option index chosen by each user@host
+	Votes map[string]int
+}
+
+func (p *Poll) tally() []int {
+	n := make([]int, len(p.Options))
+	for _, v := range p.Votes {
+		n[v]++
+	}
+	return n
+}
+
+// results summarises the votes, final once the poll has closed.
+func (p *Poll) results(final bool) string {
+	n := p.tally()
+	total := len(p.Votes)
+
+	var parts []string
+	best := -1
+	tie := false
+
+	for i, o := range p.Options {
+		pct := 0
+		if total > 0 {
+			pct = n[i] * 100 / total
+		}
+
+		parts = append(parts, fmt.Sprintf("%d) %s: %d (%d%%)", i+1, o, n[i], pct))
+
+		switch {
+		case best < 0 || n[i] > n[best]:
+			best, tie = i, false
+		case n[i] == n[best]:
+			tie = true
+		}
+	}
+
+	s := fmt.Sprintf("%s — %s", p.Question, strings.Join(parts, ", "))
+
+	switch {
+	case total == 0:
+		s += "; nobody voted"
+	case tie:
+		s += "; it's a tie"
+	case final:
+		s += fmt.Sprintf("; %s wins", p.Options[best])
+	default:
+		s += fmt.Sprintf("; %s leads", p.Options[best])
+	}
+
+	return s
+}
+
+type PollMod struct {
+	b  *Bot
+	db *bolt.DB
+
+	mu    sync.Mutex
+	polls map[string]*Poll
+
+	// how long polls stay open by default, and at most
+	duration, maxduration time.Duration
+
+	cron *cron.Cron
+}
+
+func (m *PollMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "poll")
+	m.b = b
+	m.polls = make(map[string]*Poll)
+
+	m.duration = 10 * time.Minute
+	if s := conf.Search("duration"); s != "" {
+		if m.duration, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("poll: duration: %s", err)
+		}
+	}
+
+	m.maxduration = 7 * 24 * time.Hour
+	if s := conf.Search("maxduration"); s != "" {
+		if m.maxduration, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("poll: maxduration: %s", err)
+		}
+	}
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "poll.db")
+	}
+
+	if m.db, err = bolt.Open(path, 0600, nil); err != nil {
+		return fmt.Errorf("poll: error opening db: %s", err)
+	}
+
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists(pollBucket)
+		if err != nil {
+			return err
+		}
+
+		return bu.ForEach(func(k, v []byte) error {
+			p := &Poll{}
+			if err := json.Unmarshal(v, p); err != nil {
+				return err
+			}
+			m.polls[strings.ToLower(p.Channel)] = p
+			return nil
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("poll: error loading polls: %s", err)
+	}
+
+	b.HookLine("poll", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if !IsChannel(sender) {
+			return fmt.Errorf("poll only works in a channel")
+		}
+
+		// args are split on spaces; we want quoted strings
+		rest := strings.SplitN(l.Args[1], " ", 2)
+		if len(rest) < 2 {
+			rest = append(rest, "")
+		}
+
+		words, err := SplitQuoted(rest[1])
+		if err != nil {
+			return fmt.Errorf("poll: %s", err)
+		}
+
+		for _, s := range m.command(l, sender, words) {
+			b.Conn.Privmsg(sender, s)
+		}
+
+		return nil
+	})
+
+	b.HookLine("vote", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if !IsChannel(sender) {
+			return fmt.Errorf("vote only works in a channel")
+		}
+
+		if len(args) != 1 {
+			return fmt.Errorf("usage: vote N")
+		}
+
+		b.Conn.Privmsg(sender, m.vote(l, sender, args[0]))
+		return nil
+	})
+
+	m.cron = cron.New()
+	m.cron.AddFunc("@every 10s", m.expire)
+	m.cron.Start()
+
+	log.Printf("poll module initialized with %d open polls", len(m.polls))
+	return nil
+}
+
+func (m *PollMod) Reload() error {
+	return nil
+}
+
+func (m *PollMod) Call(args ...string) error {
+	return nil
+}
+
+func (m *PollMod) save(p *Poll) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		bu := tx.Bucket(pollBucket)
+
+		if p.ID == 0 {
+			seq, err := bu.NextSequence()
+			if err != nil {
+				return err
+			}
+			p.ID = seq
+		}
+
+		v, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+
+		return bu.Put(idkey(p.ID), v)
+	})
+}
+
+func (m *PollMod) remove(id uint64) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pollBucket).Delete(idkey(id))
+	})
+}
+
+func (m *PollMod) command(l irc.Line, channel string, args []string) []string {
+	now := m.b.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.polls[strings.ToLower(channel)]
+
+	if len(args) == 0 {
+		if p == nil {
+			return []string{"there's no poll open here. " + pollUsage}
+		}
+
+		return []string{
+			fmt.Sprintf("poll #%d: %s", p.ID, p.results(false)),
+			fmt.Sprintf("%d votes so far, closes in %s; use %svote N", len(p.Votes), Ago(p.Closes.Sub(now)), m.b.Magic),
+		}
+	}
+
+	if args[0] == "close" && len(args) == 1 {
+		if p == nil {
+			return []string{"there's no poll open here"}
+		}
+
+		if p.Owner != l.Src.String() && !m.b.IsAdmin(l.Src) {
+			return []string{fmt.Sprintf("only admins or whoever opened poll #%d can close it", p.ID)}
+		}
+
+		return m.close(p)
+	}
+
+	if p != nil {
+		return []string{fmt.Sprintf("poll #%d is still open here: %s", p.ID, p.Question)}
+	}
+
+	d := m.duration
+	var words []string
+
+	for _, a := range args {
+		if strings.HasPrefix(a, "--duration=") {
+			var err error
+			if d, err = ParseDuration(strings.TrimPrefix(a, "--duration=")); err != nil {
+				return []string{fmt.Sprintf("poll: %s", err)}
+			}
+			continue
+		}
+		words = append(words, a)
+	}
+
+	if d <= 0 || d > m.maxduration {
+		return []string{fmt.Sprintf("poll: duration must be between 0 and %s", Ago(m.maxduration))}
+	}
+
+	if len(words) < 3 {
+		return []string{pollUsage}
+	}
+
+	if len(words)-1 > pollOptions {
+		return []string{fmt.Sprintf("poll: at most %d options", pollOptions)}
+	}
+
+	p = &Poll{
+		Channel:  channel,
+		Question: words[0],
+		Options:  words[1:],
+		Owner:    l.Src.String(),
+		Opened:   now,
+		Closes:   now.Add(d),
+		Votes:    make(map[string]int),
+	}
+
+	if err := m.save(p); err != nil {
+		return []string{fmt.Sprintf("poll: %s", err)}
+	}
+
+	m.polls[strings.ToLower(channel)] = p
+
+	var opts []string
+	for i, o := range p.Options {
+		opts = append(opts, fmt.Sprintf("%d) %s", i+1, o))
+	}
+
+	return []string{
+		fmt.Sprintf("poll #%d: %s — %s", p.ID, p.Question, strings.Join(opts, ", ")),
+		fmt.Sprintf("use %svote N; the poll closes in %s", m.b.Magic, Ago(d)),
+	}
+}
+
+func (m *PollMod) vote(l irc.Line, channel, choice string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.polls[strings.ToLower(channel)]
+	if p == nil {
+		return "there's no poll open here"
+	}
+
+	n, err := strconv.Atoi(choice)
+	if err != nil || n < 1 || n > len(p.Options) {
+		return fmt.Sprintf("%s: pick an option from 1 to %d", l.Src.Nick, len(p.Options))
+	}
+
+	voter := strings.ToLower(l.Src.User + "@" + l.Src.Host)
+
+	old, changed := p.Votes[voter]
+	p.Votes[voter] = n - 1
+
+	if err := m.save(p); err != nil {
+		if changed {
+			p.Votes[voter] = old
+		} else {
+			delete(p.Votes, voter)
+		}
+		return fmt.Sprintf("vote: %s", err)
+	}
+
+	if changed {
+		return fmt.Sprintf("%s: changed your vote to %s", l.Src.Nick, p.Options[n-1])
+	}
+
+	return fmt.Sprintf("%s: voted for %s", l.Src.Nick, p.Options[n-1])
+}
+
+// close removes p and returns its results. m.mu must be held.
+func (m *PollMod) close(p *Poll) []string {
+	if err := m.remove(p.ID); err != nil {
+		log.Printf("poll: failed to remove poll #%d: %s", p.ID, err)
+	}
+
+	delete(m.polls, strings.ToLower(p.Channel))
+
+	return []string{fmt.Sprintf("poll #%d closed: %s", p.ID, p.results(true))}
+}
+
+// expire announces the results of polls whose time is up.
+func (m *PollMod) expire() {
+	if !m.b.Connected() {
+		return
+	}
+
+	now := m.b.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.polls {
+		if now.Before(p.Closes) {
+			continue
+		}
+
+		for _, s := range m.close(p) {
+			m.b.Conn.Privmsg(p.Channel, s)
+		}
+	}
+}
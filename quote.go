@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kballard/goirc/irc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterModule("quote", func() Module {
+		return &QuoteMod{}
+	})
+}
+
+var (
+	quotetables = []string{
+		`CREATE TABLE IF NOT EXISTS
+			Quote (
+				id INTEGER PRIMARY KEY autoincrement,
+				nick    TEXT,
+				text    TEXT,
+				action  INTEGER DEFAULT 0,
+				channel TEXT,
+				addedby TEXT,
+				mask    TEXT,
+				time    INTEGER
+			)`,
+
+		`CREATE TABLE IF NOT EXISTS
+			QuoteVote (
+				quote INTEGER,
+				mask  TEXT,
+				vote  INTEGER,
+				PRIMARY KEY (quote, mask)
+			)`,
+
+		`CREATE TRIGGER IF NOT EXISTS
+			QuoteDelete
+		AFTER DELETE ON
+			Quote
+		BEGIN
+			DELETE FROM
+				QuoteVote
+			WHERE
+				quote = old.id;
+		END`,
+	}
+)
+
+// how many lines per channel .addquote can pick from
+const quoteRecent = 100
+
+type QuoteMod struct {
+	db *sql.DB
+	b  *Bot
+
+	// fortune file to export quotes to
+	export string
+
+	mu     sync.Mutex
+	recent map[string][]quoteline
+}
+
+type quoteline struct {
+	nick   string
+	text   string
+	action bool
+}
+
+func (q quoteline) String() string {
+	if q.action {
+		return fmt.Sprintf("* %s %s", q.nick, q.text)
+	}
+
+	return fmt.Sprintf("<%s> %s", q.nick, q.text)
+}
+
+type quote struct {
+	quoteline
+	id    int64
+	score int
+}
+
+func (q quote) String() string {
+	return fmt.Sprintf("[#%d %+d] %s", q.id, q.score, q.quoteline)
+}
+
+func (m *QuoteMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "quote")
+	m.b = b
+	m.recent = make(map[string][]quoteline)
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "quote.db")
+	}
+
+	m.export = conf.Search("fortune")
+	if m.export == "" {
+		m.export = filepath.Join(b.DataDir, "quotes")
+	}
+
+	m.db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("quote module failed to open %q: %s\n", path, err)
+		return
+	}
+
+	for _, t := range quotetables {
+		if _, err = m.db.Exec(t); err != nil {
+			log.Printf("quote module failed to create table: %s\n%q\n", err, t)
+			return
+		}
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		if !IsChannel(l.Args[0]) || strings.HasPrefix(l.Args[1], b.Magic) {
+			return
+		}
+		m.remember(l.Args[0], quoteline{nick: l.Src.Nick, text: l.Args[1]})
+	})
+
+	conn.AddHandler(irc.ACTION, func(c *irc.Conn, l irc.Line) {
+		if !IsChannel(l.Dst) {
+			return
+		}
+		m.remember(l.Dst, quoteline{nick: l.Src.Nick, text: l.Args[0], action: true})
+	})
+
+	b.HookLine("addquote", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if len(args) < 1 || args[0] == "" {
+			return fmt.Errorf("usage: addquote nick [words from the line]")
+		}
+
+		if !IsChannel(sender) {
+			return fmt.Errorf("addquote only works in a channel")
+		}
+
+		ql, ok := m.find(sender, args[0], strings.Join(args[1:], " "))
+		if !ok {
+			return fmt.Errorf("addquote: can't find that line from %s", args[0])
+		}
+
+		id, err := m.add(ql, sender, l.Src)
+		if err != nil {
+			return fmt.Errorf("addquote failed: %s", err)
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("added quote #%d", id))
+		return nil
+	})
+
+	b.Hook("quote", func(b *Bot, sender, cmd string, args ...string) error {
+		var (
+			q   *quote
+			n   int
+			err error
+		)
+
+		query := strings.TrimSpace(strings.Join(args, " "))
+
+		switch {
+		case query == "" || query == "random":
+			q, n, err = m.search(nil)
+		default:
+			if id, perr := strconv.ParseInt(strings.TrimPrefix(query, "#"), 10, 64); perr == nil {
+				q, err = m.get(id)
+				n = 1
+			} else {
+				q, n, err = m.search(strings.Fields(query))
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("quote failed: %s", err)
+		}
+
+		if q == nil {
+			b.Conn.Privmsg(sender, "no such quote")
+			return nil
+		}
+
+		if n > 1 {
+			b.Conn.Privmsg(sender, fmt.Sprintf("%s (1 of %d)", q, n))
+		} else {
+			b.Conn.Privmsg(sender, q.String())
+		}
+
+		return nil
+	})
+
+	b.HookLine("delquote", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: delquote id")
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("usage: delquote id")
+		}
+
+		if err := m.del(id, l.Src); err != nil {
+			return fmt.Errorf("delquote: %s", err)
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("deleted quote #%d", id))
+		return nil
+	})
+
+	b.HookLine("ratequote", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		usage := fmt.Errorf("usage: ratequote id +|-")
+
+		if len(args) != 2 {
+			return usage
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+		if err != nil {
+			return usage
+		}
+
+		var vote int
+		switch args[1] {
+		case "+", "++", "+1", "up":
+			vote = 1
+		case "-", "--", "-1", "down":
+			vote = -1
+		default:
+			return usage
+		}
+
+		q, err := m.rate(id, l.Src, vote)
+		if err != nil {
+			return fmt.Errorf("ratequote failed: %s", err)
+		}
+
+		if q == nil {
+			b.Conn.Privmsg(sender, "no such quote")
+			return nil
+		}
+
+		b.Conn.Privmsg(sender, fmt.Sprintf("quote #%d now has a score of %d", q.id, q.score))
+		return nil
+	})
+
+	log.Printf("quote module initialized with db %s", path)
+	return nil
+}
+
+func (m *QuoteMod) Reload() error {
+	return nil
+}
+
+func (m *QuoteMod) Call(args ...string) error {
+	return nil
+}
+
+func (m *QuoteMod) remember(channel string, ql quoteline) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines := append(m.recent[channel], ql)
+	if len(lines) > quoteRecent {
+		lines = lines[len(lines)-quoteRecent:]
+	}
+
+	m.recent[channel] = lines
+}
+
+// find returns the newest line said by nick in channel containing words.
+func (m *QuoteMod) find(channel, nick, words string) (quoteline, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines := m.recent[channel]
+	words = strings.ToLower(words)
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.EqualFold(lines[i].nick, nick) && strings.Contains(strings.ToLower(lines[i].text), words) {
+			return lines[i], true
+		}
+	}
+
+	return quoteline{}, false
+}
+
+func (m *QuoteMod) add(ql quoteline, channel string, by irc.User) (int64, error) {
+	res, err := m.db.Exec(`
+		INSERT INTO
+			Quote (nick, text, action, channel, addedby, mask, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ql.nick, ql.text, ql.action, channel, by.Nick, by.User+"@"+by.Host, m.b.Now().Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	m.writefortune()
+	return res.LastInsertId()
+}
+
+func (m *QuoteMod) del(id int64, by irc.User) error {
+	var mask string
+
+	err := m.db.QueryRow(`
+		SELECT
+			mask
+		FROM
+			Quote
+		WHERE
+			id = ?`,
+		id,
+	).Scan(&mask)
+
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no such quote #%d", id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if mask != by.User+"@"+by.Host && !m.b.IsAdmin(by) {
+		return fmt.Errorf("only admins or whoever added quote #%d can delete it", id)
+	}
+
+	if _, err := m.db.Exec(`DELETE FROM Quote WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	m.writefortune()
+	return nil
+}
+
+func (m *QuoteMod) rate(id int64, by irc.User, vote int) (*quote, error) {
+	q, err := m.get(id)
+	if err != nil || q == nil {
+		return nil, err
+	}
+
+	_, err = m.db.Exec(`
+		INSERT OR REPLACE INTO
+			QuoteVote (quote, mask, vote)
+		VALUES (?, ?, ?)`,
+		id, by.User+"@"+by.Host, vote,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.get(id)
+}
+
+const quoteselect = `
+	SELECT
+		q.id, q.nick, q.text, q.action,
+		IFNULL((SELECT SUM(vote) FROM QuoteVote v WHERE v.quote = q.id), 0)
+	FROM
+		Quote q`
+
+func scanquote(row interface {
+	Scan(...interface{}) error
+}) (*quote, error) {
+	var q quote
+
+	err := row.Scan(&q.id, &q.nick, &q.text, &q.action, &q.score)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &q, nil
+}
+
+func (m *QuoteMod) get(id int64) (*quote, error) {
+	return scanquote(m.db.QueryRow(quoteselect+`
+		WHERE
+			q.id = ?`,
+		id,
+	))
+}
+
+// search returns a random quote containing all of words, and how many
+// quotes matched.
+func (m *QuoteMod) search(words []string) (*quote, int, error) {
+	cond := "1"
+	var args []interface{}
+
+	for _, w := range words {
+		cond += ` AND (q.nick || ' ' || q.text) LIKE ? ESCAPE '\'`
+		args = append(args, "%"+strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(w)+"%")
+	}
+
+	var n int
+
+	err := m.db.QueryRow(`
+		SELECT
+			COUNT(*)
+		FROM
+			Quote q
+		WHERE
+			`+cond,
+		args...,
+	).Scan(&n)
+
+	if err != nil || n == 0 {
+		return nil, 0, err
+	}
+
+	q, err := scanquote(m.db.QueryRow(quoteselect+`
+		WHERE
+			`+cond+`
+		ORDER BY
+			RANDOM()
+		LIMIT 1`,
+		args...,
+	))
+
+	return q, n, err
+}
+
+// writefortune exports every quote, one per line, to a file fortune(1)
+// can read.
+func (m *QuoteMod) writefortune() {
+	rows, err := m.db.Query(quoteselect + `
+		ORDER BY
+			q.id`)
+	if err != nil {
+		log.Printf("quote: export failed: %s", err)
+		return
+	}
+
+	defer rows.Close()
+
+	var buf bytes.Buffer
+
+	for rows.Next() {
+		q, err := scanquote(rows)
+		if err != nil {
+			log.Printf("quote: export failed: %s", err)
+			return
+		}
+
+		fmt.Fprintln(&buf, strings.Replace(q.quoteline.String(), "\n", " ", -1))
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("quote: export failed: %s", err)
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.%d", m.export, time.Now().UnixNano())
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Printf("quote: export failed: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmp, m.export); err != nil {
+		os.Remove(tmp)
+		log.Printf("quote: export failed: %s", err)
+	}
+}
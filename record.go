@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordings hold one irc line per line of text:
+//
+//	<RFC3339 timestamp> <direction> <raw line>
+//
+// where direction is < for lines from the server and > for lines from the bot.
+const (
+	recordIn  = "<"
+	recordOut = ">"
+)
+
+type recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	now func() time.Time
+}
+
+func newrecorder(path string, now func() time.Time) (*recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{f: f, w: bufio.NewWriter(f), now: now}, nil
+}
+
+func (r *recorder) record(dir, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintf(r.w, "%s %s %s\n", r.now().Format(time.RFC3339Nano), dir, redact(line))
+	r.w.Flush()
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.w.Flush()
+	return r.f.Close()
+}
+
+// redact hides passwords the bot sends so they don't end up in recordings.
+func redact(line string) string {
+	m := parseircmsg(line)
+
+	switch m.cmd {
+	case "PASS", "OPER":
+		return m.cmd + " *"
+	case "PRIVMSG":
+		if strings.EqualFold(m.param(0), "nickserv") {
+			if f := strings.Fields(m.param(1)); len(f) > 0 && strings.EqualFold(f[0], "identify") {
+				return fmt.Sprintf("PRIVMSG %s :%s *", m.param(0), f[0])
+			}
+		}
+	}
+
+	return line
+}
+
+// record makes the bot connect through a local proxy which copies traffic to
+// and from the real server, recording each line as it passes.
+func (b *Bot) record(rec *recorder) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(b.IrcConfig.Host, strconv.Itoa(int(b.IrcConfig.Port)))
+	ssl, sslconf := b.IrcConfig.SSL, b.IrcConfig.SSLConfig
+
+	go func() {
+		defer rec.Close()
+
+		c, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			log.Printf("record: accept failed: %s", err)
+			return
+		}
+
+		defer c.Close()
+
+		var up net.Conn
+		if ssl {
+			up, err = tls.Dial("tcp", addr, sslconf)
+		} else {
+			up, err = net.Dial("tcp", addr)
+		}
+
+		if err != nil {
+			log.Printf("record: dial %s failed: %s", addr, err)
+			return
+		}
+
+		defer up.Close()
+
+		done := make(chan bool, 2)
+		go recordpipe(rec, recordIn, c, up, done)
+		go recordpipe(rec, recordOut, up, c, done)
+		<-done
+	}()
+
+	return redirect(&b.IrcConfig, ln.Addr())
+}
+
+func recordpipe(rec *recorder, dir string, dst io.Writer, src io.Reader, done chan bool) {
+	scan := bufio.NewScanner(src)
+	for scan.Scan() {
+		line := strings.TrimRight(scan.Text(), "\r")
+		rec.record(dir, line)
+		if _, err := fmt.Fprintf(dst, "%s\r\n", line); err != nil {
+			break
+		}
+	}
+
+	done <- true
+}
+
+// a recorded line
+type recording struct {
+	time time.Time
+	dir  string
+	line string
+}
+
+func readrecording(r io.Reader) ([]recording, error) {
+	var recs []recording
+
+	scan := bufio.NewScanner(r)
+	for n := 1; scan.Scan(); n++ {
+		f := strings.SplitN(scan.Text(), " ", 3)
+		if len(f) != 3 || (f[1] != recordIn && f[1] != recordOut) {
+			return nil, fmt.Errorf("line %d: malformed recording", n)
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, f[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		recs = append(recs, recording{time: t, dir: f[1], line: f[2]})
+	}
+
+	return recs, scan.Err()
+}
+
+// fakeclock is a settable clock for replaying recordings.
+type fakeclock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeclock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeclock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/kballard/goirc/irc"
+	"github.com/robfig/cron"
+)
+
+func init() {
+	RegisterModule("remind", func() Module {
+		return &RemindMod{}
+	})
+}
+
+const remindUsage = `usage: remind [nick|me] in 2h30m text | remind [nick|me] at 2006-01-02 15:04 text | ` +
+	`remind [nick|me] every "0 9 * * 1-5"|@daily|1d text | remind list | remind cancel id | remind tz [zone]`
+
+var (
+	remindBucket = []byte("reminders")
+	remindTZ     = []byte("tz")
+)
+
+// Reminder is a message to deliver at a later time, possibly repeatedly.
+type Reminder struct {
+	ID uint64
+	// who asked for it
+	From string
+	// who to remind
+	To string
+	// channel or nick to deliver to
+	Target string
+	Text   string
+	// when it is next due
+	Next time.Time
+	// cron schedule for recurring reminders
+	Cron string
+	// time zone for Cron
+	TZ      string
+	Created time.Time
+}
+
+func (r *Reminder) String() string {
+	var who string
+	if !strings.EqualFold(r.From, r.To) {
+		who = " from " + r.From
+	}
+
+	return fmt.Sprintf("%s: reminder%s: %s", r.To, who, r.Text)
+}
+
+// schedule parses a cron spec, with or without a seconds field.
+func schedule(spec string) (cron.Schedule, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	// robfig/cron wants seconds first; people don't.
+	if spec[0] != '@' && len(strings.Fields(spec)) == 5 {
+		spec = "0 " + spec
+	}
+
+	return cron.Parse(spec)
+}
+
+type RemindMod struct {
+	b  *Bot
+	db *bolt.DB
+
+	mu        sync.Mutex
+	reminders map[uint64]*Reminder
+	tz        *time.Location
+	// most pending reminders per nick
+	max int
+	// shortest interval between recurring reminders
+	minperiod time.Duration
+
+	cron *cron.Cron
+}
+
+func (m *RemindMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "remind")
+	m.b = b
+	m.reminders = make(map[uint64]*Reminder)
+	m.max = confint(conf, "max", 20)
+
+	m.tz = time.Local
+	if tz := conf.Search("tz"); tz != "" {
+		if m.tz, err = time.LoadLocation(tz); err != nil {
+			return fmt.Errorf("remind: %s", err)
+		}
+	}
+
+	m.minperiod = 10 * time.Minute
+	if s := conf.Search("minperiod"); s != "" {
+		if m.minperiod, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("remind: minperiod: %s", err)
+		}
+	}
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "remind.db")
+	}
+
+	if m.db, err = bolt.Open(path, 0600, nil); err != nil {
+		return fmt.Errorf("remind: error opening db: %s", err)
+	}
+
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists(remindBucket)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(remindTZ); err != nil {
+			return err
+		}
+
+		return bu.ForEach(func(k, v []byte) error {
+			r := &Reminder{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			m.reminders[r.ID] = r
+			return nil
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("remind: error loading reminders: %s", err)
+	}
+
+	b.HookLine("remind", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		for _, s := range m.command(l, sender, args) {
+			b.Conn.Privmsg(sender, s)
+		}
+		return nil
+	})
+
+	m.cron = cron.New()
+	m.cron.AddFunc("@every 10s", m.deliver)
+	m.cron.Start()
+
+	log.Printf("remind module initialized with %d reminders", len(m.reminders))
+	return nil
+}
+
+func (m *RemindMod) Reload() error {
+	return nil
+}
+
+func (m *RemindMod) Call(args ...string) error {
+	return nil
+}
+
+// save writes r to the db, assigning it an id if it has none.
+func (m *RemindMod) save(r *Reminder) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		bu := tx.Bucket(remindBucket)
+
+		if r.ID == 0 {
+			seq, err := bu.NextSequence()
+			if err != nil {
+				return err
+			}
+			r.ID = seq
+		}
+
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		return bu.Put(idkey(r.ID), v)
+	})
+}
+
+func (m *RemindMod) remove(id uint64) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(remindBucket).Delete(idkey(id))
+	})
+}
+
+// location returns the time zone nick has chosen, or the default.
+func (m *RemindMod) location(nick string) *time.Location {
+	var name string
+
+	m.db.View(func(tx *bolt.Tx) error {
+		name = string(tx.Bucket(remindTZ).Get([]byte(strings.ToLower(nick))))
+		return nil
+	})
+
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+
+	return m.tz
+}
+
+func (m *RemindMod) command(l irc.Line, sender string, args []string) []string {
+	nick := l.Src.Nick
+	now := m.b.Now()
+
+	if len(args) == 0 {
+		return []string{remindUsage}
+	}
+
+	switch args[0] {
+	case "list":
+		return m.list(nick, sender, now)
+	case "cancel":
+		if len(args) != 2 {
+			return []string{"usage: remind cancel id"}
+		}
+		return []string{m.cancel(nick, args[1])}
+	case "tz":
+		if len(args) == 1 {
+			return []string{fmt.Sprintf("%s: your time zone is %s", nick, m.location(nick))}
+		}
+		loc, err := time.LoadLocation(args[1])
+		if err != nil {
+			return []string{fmt.Sprintf("remind: %s", err)}
+		}
+		err = m.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(remindTZ).Put([]byte(strings.ToLower(nick)), []byte(loc.String()))
+		})
+		if err != nil {
+			return []string{fmt.Sprintf("remind: %s", err)}
+		}
+		return []string{fmt.Sprintf("%s: time zone set to %s", nick, loc)}
+	}
+
+	r, err := m.parse(nick, now, args)
+	if err != nil {
+		return []string{fmt.Sprintf("remind: %s", err)}
+	}
+
+	// reminders set in private are delivered in private
+	r.Target = sender
+	if !IsChannel(sender) {
+		r.Target = r.To
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := 0
+	for _, o := range m.reminders {
+		if strings.EqualFold(o.From, nick) {
+			pending++
+		}
+	}
+
+	if pending >= m.max {
+		return []string{fmt.Sprintf("remind: %s already has %d reminders pending", nick, pending)}
+	}
+
+	if err := m.save(r); err != nil {
+		return []string{fmt.Sprintf("remind: %s", err)}
+	}
+
+	m.reminders[r.ID] = r
+
+	loc := m.location(nick)
+	when := fmt.Sprintf("at %s (in %s)", r.Next.In(loc).Format("2006-01-02 15:04 MST"), Ago(r.Next.Sub(now)))
+	if r.Cron != "" {
+		when = fmt.Sprintf("every %q, next %s", r.Cron, when)
+	}
+
+	return []string{fmt.Sprintf("%s: reminder #%d set for %s %s", nick, r.ID, r.To, when)}
+}
+
+// parse a new reminder from the arguments to .remind
+func (m *RemindMod) parse(nick string, now time.Time, args []string) (*Reminder, error) {
+	r := &Reminder{
+		From:    nick,
+		To:      nick,
+		Created: now,
+	}
+
+	switch args[0] {
+	case "in", "at", "every":
+	case "me":
+		args = args[1:]
+	default:
+		r.To = args[0]
+		args = args[1:]
+	}
+
+	if len(args) < 2 {
+		return nil, fmt.Errorf(remindUsage)
+	}
+
+	loc := m.location(nick)
+	r.TZ = loc.String()
+
+	when, args := args[0], args[1:]
+
+	switch when {
+	case "in":
+		d, err := ParseDuration(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("that's not in the future")
+		}
+		r.Next, args = now.Add(d), args[1:]
+	case "at":
+		t, rest, err := parsewhen(now.In(loc), args)
+		if err != nil {
+			return nil, err
+		}
+		if !t.After(now) {
+			return nil, fmt.Errorf("%s is in the past", t.Format("2006-01-02 15:04 MST"))
+		}
+		r.Next, args = t, rest
+	case "every":
+		spec, rest, err := parsespec(args)
+		if err != nil {
+			return nil, err
+		}
+
+		sched, err := schedule(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		next := sched.Next(now.In(loc))
+		if next.IsZero() {
+			return nil, fmt.Errorf("%q never happens", spec)
+		}
+
+		if sched.Next(next).Sub(next) < m.minperiod {
+			return nil, fmt.Errorf("reminders can't repeat more often than every %s", m.minperiod)
+		}
+
+		r.Cron, r.Next, args = spec, next, rest
+	default:
+		return nil, fmt.Errorf(remindUsage)
+	}
+
+	r.Text = strings.TrimSpace(strings.Join(args, " "))
+	if r.Text == "" {
+		return nil, fmt.Errorf("remind you of what?")
+	}
+
+	return r, nil
+}
+
+// parsewhen reads a date and/or time from the start of args, returning the
+// time and the remaining args. a time alone means its next occurrence.
+func parsewhen(now time.Time, args []string) (time.Time, []string, error) {
+	loc := now.Location()
+
+	if len(args) >= 2 {
+		if t, err := time.ParseInLocation("2006-01-02 15:04", args[0]+" "+args[1], loc); err == nil {
+			return t, args[2:], nil
+		}
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", args[0], loc); err == nil {
+		return t, args[1:], nil
+	}
+
+	if t, err := time.ParseInLocation("15:04", args[0], loc); err == nil {
+		t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, args[1:], nil
+	}
+
+	return time.Time{}, nil, fmt.Errorf("can't parse time %q, try 2006-01-02 15:04", args[0])
+}
+
+// parsespec reads a schedule from the start of args: a quoted cron spec, a
+// descriptor like @daily, or a duration.
+func parsespec(args []string) (string, []string, error) {
+	if strings.HasPrefix(args[0], `"`) {
+		for i := range args {
+			if (i > 0 || len(args[0]) > 1) && strings.HasSuffix(args[i], `"`) {
+				spec := strings.Join(args[:i+1], " ")
+				return strings.Trim(spec, `"`), args[i+1:], nil
+			}
+		}
+		return "", nil, fmt.Errorf("unterminated schedule")
+	}
+
+	if strings.HasPrefix(args[0], "@") {
+		return args[0], args[1:], nil
+	}
+
+	d, err := ParseDuration(args[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("can't parse schedule %q", args[0])
+	}
+
+	return "@every " + d.String(), args[1:], nil
+}
+
+type remindersByTime []*Reminder
+
+func (s remindersByTime) Len() int           { return len(s) }
+func (s remindersByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s remindersByTime) Less(i, j int) bool { return s[i].Next.Before(s[j].Next) }
+
+// list the reminders from or for nick. In a channel only those delivered
+// there are listed, so private ones stay private.
+func (m *RemindMod) list(nick, sender string, now time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rs []*Reminder
+	for _, r := range m.reminders {
+		if !strings.EqualFold(r.From, nick) && !strings.EqualFold(r.To, nick) {
+			continue
+		}
+
+		if IsChannel(sender) && !strings.EqualFold(r.Target, sender) {
+			continue
+		}
+
+		rs = append(rs, r)
+	}
+
+	if len(rs) == 0 {
+		if IsChannel(sender) {
+			return []string{fmt.Sprintf("%s: no reminders in %s", nick, sender)}
+		}
+		return []string{fmt.Sprintf("%s: no reminders", nick)}
+	}
+
+	sort.Sort(remindersByTime(rs))
+
+	loc := m.location(nick)
+
+	var out []string
+	for _, r := range rs {
+		every := ""
+		if r.Cron != "" {
+			every = fmt.Sprintf(" every %q", r.Cron)
+		}
+		out = append(out, fmt.Sprintf("#%d for %s at %s (in %s)%s: %s",
+			r.ID, r.To, r.Next.In(loc).Format("2006-01-02 15:04 MST"), Ago(r.Next.Sub(now)), every, r.Text))
+	}
+
+	return out
+}
+
+func (m *RemindMod) cancel(nick, ids string) string {
+	id, err := strconv.ParseUint(strings.TrimPrefix(ids, "#"), 10, 64)
+	if err != nil {
+		return fmt.Sprintf("remind: bad id %q", ids)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.reminders[id]
+	if !ok || !(strings.EqualFold(r.From, nick) || strings.EqualFold(r.To, nick)) {
+		return fmt.Sprintf("remind: no reminder #%d for %s", id, nick)
+	}
+
+	if err := m.remove(id); err != nil {
+		return fmt.Sprintf("remind: %s", err)
+	}
+
+	delete(m.reminders, id)
+
+	return fmt.Sprintf("%s: cancelled reminder #%d", nick, id)
+}
+
+// deliver sends reminders that are due, and schedules the next occurrence of
+// recurring ones.
+func (m *RemindMod) deliver() {
+	now := m.b.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, r := range m.reminders {
+		if r.Next.After(now) {
+			continue
+		}
+
+		m.b.Conn.Privmsg(r.Target, r.String())
+
+		if r.Cron != "" {
+			loc, err := time.LoadLocation(r.TZ)
+			if err != nil {
+				loc = m.tz
+			}
+
+			if sched, err := schedule(r.Cron); err == nil {
+				if r.Next = sched.Next(now.In(loc)); !r.Next.IsZero() {
+					if err := m.save(r); err != nil {
+						log.Printf("remind: saving #%d failed: %s", id, err)
+					}
+					continue
+				}
+			}
+		}
+
+		if err := m.remove(id); err != nil {
+			log.Printf("remind: removing #%d failed: %s", id, err)
+		}
+
+		delete(m.reminders, id)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay recording",
+	Short: "replay a recorded irc session and diff the bot's output",
+	Long: `Replay feeds the server side of a recording (see record= in the irc config)
+through the bot with the clock set to the recorded times, and compares what the
+bot says after each line with what it said when the recording was made.
+
+Differences are printed as - (recorded) and + (replayed) lines, and the command
+fails if there were any.`,
+	RunE: runReplay,
+}
+
+var (
+	replaySettle time.Duration
+	replaySeed   int64
+)
+
+func init() {
+	f := replayCmd.Flags()
+	f.DurationVar(&replaySettle, "settle", 250*time.Millisecond, "how long to wait for the bot to reply to each line")
+	f.Int64Var(&replaySeed, "seed", 1, "random seed for the bot")
+
+	root.AddCommand(replayCmd)
+}
+
+// lines the bot sends which depend on the connection rather than on modules
+var replayIgnore = map[string]bool{
+	"PASS": true, "NICK": true, "USER": true, "CAP": true,
+	"PING": true, "PONG": true, "QUIT": true,
+}
+
+func replayable(line string) bool {
+	return !replayIgnore[parseircmsg(line).cmd]
+}
+
+func runReplay(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", cmd.Use)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	recs, err := readrecording(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[0], err)
+	}
+
+	if len(recs) == 0 {
+		return fmt.Errorf("%s: empty recording", args[0])
+	}
+
+	rand.Seed(replaySeed)
+
+	bot, err := NewBot(*configfile)
+	if err != nil {
+		return err
+	}
+
+	clock := &fakeclock{t: recs[0].time}
+	bot.Clock = clock.Now
+	bot.Record = ""
+
+	srv, err := newircserver("replay.glenda")
+	if err != nil {
+		return err
+	}
+
+	defer srv.Close()
+
+	if err := srv.redirect(&bot.IrcConfig); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bot.Run()
+	}()
+
+	if err := srv.accept(); err != nil {
+		return err
+	}
+
+	// wait for the bot to register before playing anything back
+	registered := map[string]bool{}
+	for !registered["NICK"] || !registered["USER"] {
+		select {
+		case line, ok := <-srv.lines:
+			if !ok {
+				return fmt.Errorf("bot disconnected during registration")
+			}
+			registered[parseircmsg(line).cmd] = true
+		case err := <-done:
+			return fmt.Errorf("bot exited during registration: %v", err)
+		case <-time.After(30 * time.Second):
+			return fmt.Errorf("timed out waiting for the bot to register")
+		}
+	}
+
+	// collect what the bot says until it goes quiet
+	settle := func() []string {
+		var out []string
+		for {
+			select {
+			case line, ok := <-srv.lines:
+				if !ok {
+					return out
+				}
+				if replayable(line) {
+					out = append(out, redact(line))
+				}
+			case <-time.After(replaySettle):
+				return out
+			}
+		}
+	}
+
+	ndiff, nin := 0, 0
+
+	for i := 0; i < len(recs); i++ {
+		in := recs[i]
+		if in.dir != recordIn {
+			continue
+		}
+
+		nin++
+
+		var want []string
+		for ; i+1 < len(recs) && recs[i+1].dir == recordOut; i++ {
+			if replayable(recs[i+1].line) {
+				want = append(want, recs[i+1].line)
+			}
+		}
+
+		clock.Set(in.time)
+		srv.Send(in.line)
+		got := settle()
+
+		if d := linediff(want, got); d != nil {
+			fmt.Printf("@ %s %s\n", in.time.Format(time.RFC3339), in.line)
+			for _, l := range d {
+				fmt.Println(l)
+				if l[0] != ' ' {
+					ndiff++
+				}
+			}
+		}
+	}
+
+	srv.Close()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+
+	fmt.Printf("replayed %d lines, %d differences\n", nin, ndiff)
+
+	if ndiff > 0 {
+		return fmt.Errorf("replay of %s differs", args[0])
+	}
+
+	return nil
+}
+
+// linediff compares two lists of lines, returning nil if they are equal or
+// else the lines of both marked with '-' (only in a), '+' (only in b) or ' '.
+func linediff(a, b []string) []string {
+	// longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	if lcs[0][0] == len(a) && len(a) == len(b) {
+		return nil
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+
+	return out
+}
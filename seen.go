@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kballard/goirc/irc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterModule("seen", func() Module {
+		return &SeenMod{}
+	})
+}
+
+var (
+	seentables = []string{
+		`CREATE TABLE IF NOT EXISTS
+			Seen (
+				nick    TEXT PRIMARY KEY COLLATE NOCASE,
+				user    TEXT,
+				host    TEXT,
+				time    INTEGER,
+				type    TEXT,
+				channel TEXT,
+				text    TEXT,
+				other   TEXT
+			)`,
+
+		`CREATE INDEX IF NOT EXISTS
+			SeenHost
+		ON
+			Seen (host, time)`,
+	}
+)
+
+// longest message excerpt shown by .seen
+const seenExcerpt = 120
+
+// how many nick changes .seen will follow
+const seenHops = 5
+
+type SeenMod struct {
+	db *sql.DB
+	b  *Bot
+}
+
+// Seen is the last thing a nick did.
+type Seen struct {
+	Nick, User, Host string
+	Time             time.Time
+	// message, action, join, part, quit, nick or kick
+	Type    string
+	Channel string
+	Text    string
+	// new nick for a nick change, or who did the kicking
+	Other string
+}
+
+// doing describes what s was. Unless full, it leaves out the channel and
+// what was said there.
+func (s Seen) doing(full bool) string {
+	if !full {
+		switch s.Type {
+		case "message", "action":
+			return "saying something in a channel"
+		case "join":
+			return "joining a channel"
+		case "part":
+			return "leaving a channel"
+		case "kick":
+			return "being kicked from a channel"
+		}
+	}
+
+	switch s.Type {
+	case "message":
+		return fmt.Sprintf("in %s, saying: %s", s.Channel, excerpt(s.Text, seenExcerpt))
+	case "action":
+		return fmt.Sprintf("in %s, saying: * %s %s", s.Channel, s.Nick, excerpt(s.Text, seenExcerpt))
+	case "join":
+		return fmt.Sprintf("joining %s", s.Channel)
+	case "part":
+		if s.Text != "" {
+			return fmt.Sprintf("leaving %s (%s)", s.Channel, s.Text)
+		}
+		return fmt.Sprintf("leaving %s", s.Channel)
+	case "quit":
+		return fmt.Sprintf("quitting (%s)", s.Text)
+	case "nick":
+		return fmt.Sprintf("changing nick to %s", s.Other)
+	case "renamed":
+		return fmt.Sprintf("changing nick from %s", s.Other)
+	case "kick":
+		return fmt.Sprintf("being kicked from %s by %s (%s)", s.Channel, s.Other, s.Text)
+	}
+
+	return s.Type
+}
+
+func excerpt(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	r := []rune(s)
+	return string(r[:n]) + "…"
+}
+
+func (m *SeenMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "seen")
+	m.b = b
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "seen.db")
+	}
+
+	m.db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("seen module failed to open %q: %s\n", path, err)
+		return
+	}
+
+	for _, t := range seentables {
+		if _, err = m.db.Exec(t); err != nil {
+			log.Printf("seen module failed to create table: %s\n%q\n", err, t)
+			return
+		}
+	}
+
+	seen := func(l irc.Line, typ, channel string) Seen {
+		return Seen{
+			Nick:    l.Src.Nick,
+			User:    l.Src.User,
+			Host:    l.Src.Host,
+			Time:    b.Now(),
+			Type:    typ,
+			Channel: channel,
+		}
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		if !IsChannel(l.Args[0]) {
+			return
+		}
+		s := seen(l, "message", l.Args[0])
+		s.Text = l.Args[1]
+		m.update(s)
+	})
+
+	conn.AddHandler(irc.ACTION, func(c *irc.Conn, l irc.Line) {
+		if !IsChannel(l.Dst) {
+			return
+		}
+		s := seen(l, "action", l.Dst)
+		s.Text = l.Args[0]
+		m.update(s)
+	})
+
+	conn.AddHandler("JOIN", func(c *irc.Conn, l irc.Line) {
+		m.update(seen(l, "join", l.Args[0]))
+	})
+
+	conn.AddHandler("PART", func(c *irc.Conn, l irc.Line) {
+		s := seen(l, "part", l.Args[0])
+		if len(l.Args) > 1 {
+			s.Text = l.Args[1]
+		}
+		m.update(s)
+	})
+
+	conn.AddHandler("QUIT", func(c *irc.Conn, l irc.Line) {
+		s := seen(l, "quit", "")
+		if len(l.Args) > 0 {
+			s.Text = l.Args[0]
+		}
+		m.update(s)
+	})
+
+	conn.AddHandler("NICK", func(c *irc.Conn, l irc.Line) {
+		s := seen(l, "nick", "")
+		s.Other = l.Args[0]
+		m.update(s)
+
+		s = seen(l, "renamed", "")
+		s.Nick, s.Other = l.Args[0], l.Src.Nick
+		m.update(s)
+	})
+
+	conn.AddHandler("KICK", func(c *irc.Conn, l irc.Line) {
+		s := Seen{
+			Nick:    l.Args[1],
+			Time:    b.Now(),
+			Type:    "kick",
+			Channel: l.Args[0],
+			Other:   l.Src.Nick,
+		}
+		if len(l.Args) > 2 {
+			s.Text = l.Args[2]
+		}
+
+		// keep the user and host we already know about
+		if old, err := m.seen(s.Nick); err == nil && old != nil {
+			s.User, s.Host = old.User, old.Host
+		}
+
+		m.update(s)
+	})
+
+	b.HookLine("seen", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if len(args) != 1 || args[0] == "" {
+			return fmt.Errorf("usage: seen nick")
+		}
+
+		reply, err := m.report(l.Src, args[0])
+		if err != nil {
+			return fmt.Errorf("seen failed for %q: %s", args[0], err)
+		}
+
+		b.Conn.Privmsg(sender, reply)
+		return nil
+	})
+
+	log.Printf("seen module initialized with db %s", path)
+	return nil
+}
+
+func (m *SeenMod) Reload() error {
+	return nil
+}
+
+func (m *SeenMod) Call(args ...string) error {
+	return nil
+}
+
+func (m *SeenMod) update(s Seen) {
+	_, err := m.db.Exec(`
+		INSERT OR REPLACE INTO
+			Seen (nick, user, host, time, type, channel, text, other)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Nick, s.User, s.Host, s.Time.Unix(), s.Type, s.Channel, s.Text, s.Other,
+	)
+
+	if err != nil {
+		log.Printf("seen update failed for %q: %s", s.Nick, err)
+	}
+}
+
+func scanseen(row interface {
+	Scan(...interface{}) error
+}) (*Seen, error) {
+	var (
+		s Seen
+		t int64
+	)
+
+	err := row.Scan(&s.Nick, &s.User, &s.Host, &t, &s.Type, &s.Channel, &s.Text, &s.Other)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	s.Time = time.Unix(t, 0)
+	return &s, nil
+}
+
+func (m *SeenMod) seen(nick string) (*Seen, error) {
+	return scanseen(m.db.QueryRow(`
+		SELECT
+			nick, user, host, time, type, channel, text, other
+		FROM
+			Seen
+		WHERE
+			nick = ?`,
+		nick,
+	))
+}
+
+// the most recent activity from the same user@host under another nick
+func (m *SeenMod) samehost(s *Seen) (*Seen, error) {
+	if s.Host == "" {
+		return nil, nil
+	}
+
+	return scanseen(m.db.QueryRow(`
+		SELECT
+			nick, user, host, time, type, channel, text, other
+		FROM
+			Seen
+		WHERE
+			host = ? AND user = ? AND nick != ? AND time > ?
+		ORDER BY
+			time DESC
+		LIMIT 1`,
+		s.Host, s.User, s.Nick, s.Time.Unix(),
+	))
+}
+
+// nickbase strips the usual decorations people add to their nick when
+// away or reconnecting, so that bob_, bob|away and bob2 all match bob.
+func nickbase(nick string) string {
+	nick = strings.ToLower(nick)
+	if i := strings.IndexAny(nick, "|["); i > 0 {
+		nick = nick[:i]
+	}
+
+	if base := strings.TrimRight(nick, "_^`-0123456789"); base != "" {
+		return base
+	}
+
+	return nick
+}
+
+// the most recent activity of a nick that looks like nick
+func (m *SeenMod) similar(nick string) (*Seen, error) {
+	base := nickbase(nick)
+
+	rows, err := m.db.Query(`
+		SELECT
+			nick, user, host, time, type, channel, text, other
+		FROM
+			Seen
+		WHERE
+			nick LIKE ? ESCAPE '\'
+		ORDER BY
+			time DESC`,
+		strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(base)+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanseen(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if nickbase(s.Nick) == base {
+			return s, nil
+		}
+	}
+
+	return nil, rows.Err()
+}
+
+// report says when nick was last seen. Where and what they said is only
+// told to those who can read the channel it was in.
+func (m *SeenMod) report(u irc.User, nick string) (string, error) {
+	now := m.b.Now()
+
+	s, err := m.seen(nick)
+	if err != nil {
+		return "", err
+	}
+
+	if s == nil {
+		if s, err = m.similar(nick); err != nil {
+			return "", err
+		}
+
+		if s == nil {
+			return fmt.Sprintf("i haven't seen %s", nick), nil
+		}
+	}
+
+	var parts []string
+
+	doing := func(s *Seen) string {
+		return s.doing(s.Channel == "" || m.b.CanRead(u, s.Channel))
+	}
+
+	parts = append(parts, fmt.Sprintf("%s was last seen %s ago %s",
+		s.Nick, Ago(now.Sub(s.Time)), doing(s)))
+
+	// follow nick changes to wherever they ended up
+	for i := 0; i < seenHops && s.Type == "nick"; i++ {
+		next, err := m.seen(s.Other)
+		if err != nil {
+			return "", err
+		}
+
+		if next == nil || next.Type == "renamed" {
+			break
+		}
+
+		s = next
+		parts = append(parts, fmt.Sprintf("%s was last seen %s ago %s",
+			s.Nick, Ago(now.Sub(s.Time)), doing(s)))
+	}
+
+	if other, err := m.samehost(s); err == nil && other != nil {
+		parts = append(parts, fmt.Sprintf("%s@%s was seen more recently as %s, %s ago",
+			other.User, other.Host, other.Nick, Ago(now.Sub(other.Time))))
+	}
+
+	return strings.Join(parts, "; "), nil
+}
@@ -0,0 +1,12 @@
+//go:build !plan9
+// +build !plan9
+
+package main
+
+import (
+	"syscall"
+)
+
+func init() {
+	reloadSignals = append(reloadSignals, syscall.SIGHUP)
+}
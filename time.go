@@ -18,7 +18,7 @@ type TimeMod struct {
 
 func (t *TimeMod) Init(b *Bot, conn irc.SafeConn) (err error) {
 	b.Hook("time", func(b *Bot, sender, cmd string, args ...string) error {
-		t := time.Now()
+		t := b.Now()
 		if len(args) == 1 {
 			tz := args[0]
 			loc, err := time.LoadLocation(tz)
@@ -0,0 +1,895 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kballard/goirc/irc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterModule("trivia", func() Module {
+		return &TriviaMod{}
+	})
+}
+
+var triviatables = []string{
+	`CREATE TABLE IF NOT EXISTS
+		TriviaGame (
+			id INTEGER PRIMARY KEY autoincrement,
+			channel   TEXT COLLATE NOCASE,
+			pack      TEXT,
+			owner     TEXT,
+			questions INTEGER,
+			started   INTEGER,
+			ended     INTEGER
+		)`,
+
+	`CREATE TABLE IF NOT EXISTS
+		TriviaScore (
+			id INTEGER PRIMARY KEY autoincrement,
+			game    INTEGER REFERENCES TriviaGame(id),
+			nick    TEXT COLLATE NOCASE,
+			mask    TEXT,
+			channel TEXT COLLATE NOCASE,
+			points  INTEGER,
+			time    INTEGER
+		)`,
+
+	`CREATE INDEX IF NOT EXISTS
+		TriviaScoreChannel
+	ON
+		TriviaScore (channel, nick)`,
+
+	`CREATE INDEX IF NOT EXISTS
+		TriviaScoreGame
+	ON
+		TriviaScore (game)`,
+}
+
+const triviaUsage = "usage: trivia start [pack] [questions] | stop | skip | scores | top [n] | packs"
+
+// most questions in one game
+const triviaMaxQuestions = 100
+
+// leading words ignored when comparing answers
+var triviaArticles = map[string]bool{"a": true, "an": true, "the": true}
+
+type triviaq struct {
+	pack     string
+	question string
+	// the first is shown in hints and when nobody gets it
+	answers []string
+}
+
+type triviascore struct {
+	nick   string
+	points int
+}
+
+type triviaanswer struct {
+	nick, mask string
+	points     int
+}
+
+type triviagame struct {
+	id      int64
+	channel string
+	pack    string
+	// who started it, as nick!user@host
+	owner     string
+	questions []*triviaq
+
+	mu sync.Mutex
+	// the question being asked, nil between questions
+	cur *triviaq
+	// hints given for cur
+	hint int
+	// by lowercased nick
+	scores map[string]*triviascore
+
+	answered chan triviaanswer
+	skip     chan bool
+	stop     chan bool
+}
+
+// guess checks a line of chat against the current question, and hands
+// the first right answer to the game loop.
+func (g *triviagame) guess(l irc.Line, text string, hints int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cur == nil || !triviamatch(text, g.cur.answers) {
+		return
+	}
+
+	g.cur = nil
+
+	a := triviaanswer{
+		nick:   l.Src.Nick,
+		mask:   l.Src.User + "@" + l.Src.Host,
+		points: hints - g.hint + 1,
+	}
+
+	s, ok := g.scores[strings.ToLower(a.nick)]
+	if !ok {
+		s = &triviascore{nick: a.nick}
+		g.scores[strings.ToLower(a.nick)] = s
+	}
+	s.points += a.points
+
+	g.answered <- a
+}
+
+func (g *triviagame) scoreboard() []*triviascore {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var board []*triviascore
+	for _, s := range g.scores {
+		board = append(board, s)
+	}
+
+	sort.Sort(triviaboard(board))
+	return board
+}
+
+type triviaboard []*triviascore
+
+func (t triviaboard) Len() int      { return len(t) }
+func (t triviaboard) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t triviaboard) Less(i, j int) bool {
+	if t[i].points != t[j].points {
+		return t[i].points > t[j].points
+	}
+	return strings.ToLower(t[i].nick) < strings.ToLower(t[j].nick)
+}
+
+func (t triviaboard) String() string {
+	var s []string
+	for _, sc := range t {
+		s = append(s, fmt.Sprintf("%s (%d)", sc.nick, sc.points))
+	}
+	return strings.Join(s, ", ")
+}
+
+// TriviaMod runs trivia games from question packs in its packs directory.
+// Each pack is a text file of question*answer[*answer...] lines.
+type TriviaMod struct {
+	b  *Bot
+	db *sql.DB
+
+	dir string
+
+	// questions per game, and hints per question
+	rounds, hints int
+	// time to answer a question, and between questions
+	timeout, pause time.Duration
+	// unanswered questions in a row before a game stops itself
+	idle int
+
+	mu    sync.Mutex
+	packs map[string][]*triviaq
+	// by lowercased channel
+	games map[string]*triviagame
+}
+
+func (m *TriviaMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	conf := b.Config.Search("mod", "trivia")
+	m.b = b
+	m.games = make(map[string]*triviagame)
+
+	m.dir = conf.Search("packs")
+	if m.dir == "" {
+		m.dir = filepath.Join(b.DataDir, "trivia")
+	}
+
+	m.rounds = confint(conf, "questions", 10)
+	m.hints = confint(conf, "hints", 3)
+	m.idle = confint(conf, "idle", 3)
+
+	m.timeout = time.Minute
+	if s := conf.Search("timeout"); s != "" {
+		if m.timeout, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("trivia: timeout: %s", err)
+		}
+	}
+
+	m.pause = 5 * time.Second
+	if s := conf.Search("pause"); s != "" {
+		if m.pause, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("trivia: pause: %s", err)
+		}
+	}
+
+	if m.rounds < 1 || m.rounds > triviaMaxQuestions {
+		return fmt.Errorf("trivia: questions must be between 1 and %d", triviaMaxQuestions)
+	}
+
+	if m.hints < 0 || m.idle < 1 || m.timeout <= 0 || m.pause < 0 {
+		return fmt.Errorf("trivia: hints, idle, timeout and pause must be positive")
+	}
+
+	if err := m.load(); err != nil {
+		return err
+	}
+
+	path := conf.Search("path")
+	if path == "" {
+		path = filepath.Join(b.DataDir, "trivia.db")
+	}
+
+	m.db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Printf("trivia module failed to open %q: %s\n", path, err)
+		return
+	}
+
+	for _, t := range triviatables {
+		if _, err = m.db.Exec(t); err != nil {
+			log.Printf("trivia module failed to create table: %s\n%q\n", err, t)
+			return
+		}
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		if !IsChannel(l.Args[0]) || strings.HasPrefix(l.Args[1], b.Magic) {
+			return
+		}
+
+		m.mu.Lock()
+		g := m.games[strings.ToLower(l.Args[0])]
+		m.mu.Unlock()
+
+		if g != nil {
+			g.guess(l, l.Args[1], m.hints)
+		}
+	})
+
+	b.HookLine("trivia", func(b *Bot, l irc.Line, sender, cmd string, args ...string) error {
+		if !IsChannel(sender) {
+			return fmt.Errorf("trivia only works in a channel")
+		}
+
+		if len(args) == 0 || args[0] == "" {
+			return fmt.Errorf(triviaUsage)
+		}
+
+		out, err := m.command(l, sender, args)
+		if err != nil {
+			return fmt.Errorf("trivia: %s", err)
+		}
+
+		for _, s := range out {
+			b.Conn.Privmsg(sender, s)
+		}
+
+		return nil
+	})
+
+	log.Printf("trivia module initialized with %d packs from %s", len(m.packs), m.dir)
+	return nil
+}
+
+func (m *TriviaMod) Reload() error {
+	return m.load()
+}
+
+func (m *TriviaMod) Call(args ...string) error {
+	return nil
+}
+
+// load reads every pack in the packs directory. Games already running
+// keep the questions they started with.
+func (m *TriviaMod) load() error {
+	files, err := filepath.Glob(filepath.Join(m.dir, "*.txt"))
+	if err != nil {
+		return fmt.Errorf("trivia: %s", err)
+	}
+
+	packs := make(map[string][]*triviaq)
+
+	for _, f := range files {
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(f), ".txt"))
+
+		qs, err := loadtrivia(f, name)
+		if err != nil {
+			return fmt.Errorf("trivia: %s", err)
+		}
+
+		if len(qs) > 0 {
+			packs[name] = qs
+		}
+	}
+
+	m.mu.Lock()
+	m.packs = packs
+	m.mu.Unlock()
+
+	return nil
+}
+
+// loadtrivia reads a pack of question*answer[*answer...] lines. Blank
+// lines and lines starting with # are skipped.
+func loadtrivia(path, pack string) ([]*triviaq, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var (
+		qs  []*triviaq
+		bad int
+	)
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, "*")
+
+		q := &triviaq{pack: pack, question: strings.TrimSpace(parts[0])}
+		for _, a := range parts[1:] {
+			if a = strings.TrimSpace(a); a != "" && trivianorm(a) != "" {
+				q.answers = append(q.answers, a)
+			}
+		}
+
+		if q.question == "" || len(q.answers) == 0 {
+			bad++
+			continue
+		}
+
+		qs = append(qs, q)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if bad > 0 {
+		log.Printf("trivia: skipped %d malformed lines in %s", bad, path)
+	}
+
+	return qs, nil
+}
+
+func (m *TriviaMod) command(l irc.Line, channel string, args []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g := m.games[strings.ToLower(channel)]
+
+	switch args[0] {
+	case "start":
+		if g != nil {
+			return nil, fmt.Errorf("a game is already running here; %strivia stop ends it", m.b.Magic)
+		}
+		return m.start(l, channel, args[1:])
+
+	case "stop":
+		if g == nil {
+			return nil, fmt.Errorf("no game is running here")
+		}
+
+		if g.owner != l.Src.String() && !m.b.IsAdmin(l.Src) {
+			return nil, fmt.Errorf("only admins or whoever started the game can stop it")
+		}
+
+		delete(m.games, strings.ToLower(channel))
+		close(g.stop)
+		return nil, nil
+
+	case "skip":
+		if g == nil {
+			return nil, fmt.Errorf("no game is running here")
+		}
+
+		select {
+		case g.skip <- true:
+		default:
+		}
+		return nil, nil
+
+	case "scores":
+		if g != nil {
+			board := triviaboard(g.scoreboard())
+			if len(board) == 0 {
+				return []string{"nobody has scored yet"}, nil
+			}
+			return []string{"this game: " + board.String()}, nil
+		}
+		return m.lastgame(channel)
+
+	case "top":
+		n := 5
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 || n > 20 {
+				return nil, fmt.Errorf("top wants a number between 1 and 20")
+			}
+		}
+		return m.top(channel, n)
+
+	case "packs":
+		if len(m.packs) == 0 {
+			return []string{fmt.Sprintf("no question packs in %s", m.dir)}, nil
+		}
+
+		var names []string
+		for name := range m.packs {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for i, name := range names {
+			names[i] = fmt.Sprintf("%s (%d)", name, len(m.packs[name]))
+		}
+
+		return []string{"packs: " + strings.Join(names, ", ")}, nil
+	}
+
+	return nil, fmt.Errorf(triviaUsage)
+}
+
+// start begins a game from one pack, or all of them; m.mu is held.
+func (m *TriviaMod) start(l irc.Line, channel string, args []string) ([]string, error) {
+	pack, n := "", m.rounds
+
+	for _, a := range args {
+		if i, err := strconv.Atoi(a); err == nil {
+			if i < 1 || i > triviaMaxQuestions {
+				return nil, fmt.Errorf("a game has between 1 and %d questions", triviaMaxQuestions)
+			}
+			n = i
+			continue
+		}
+		pack = strings.ToLower(a)
+	}
+
+	var pool []*triviaq
+
+	if pack == "" {
+		for _, qs := range m.packs {
+			pool = append(pool, qs...)
+		}
+	} else {
+		var ok bool
+		if pool, ok = m.packs[pack]; !ok {
+			return nil, fmt.Errorf("no pack named %s; %strivia packs lists them", pack, m.b.Magic)
+		}
+	}
+
+	if len(pool) == 0 {
+		return nil, fmt.Errorf("no questions to ask")
+	}
+
+	if n > len(pool) {
+		n = len(pool)
+	}
+
+	g := &triviagame{
+		channel:  channel,
+		pack:     pack,
+		owner:    l.Src.String(),
+		scores:   make(map[string]*triviascore),
+		answered: make(chan triviaanswer, 1),
+		skip:     make(chan bool, 1),
+		stop:     make(chan bool),
+	}
+
+	for _, i := range rand.Perm(len(pool))[:n] {
+		g.questions = append(g.questions, pool[i])
+	}
+
+	res, err := m.db.Exec(`
+		INSERT INTO
+			TriviaGame (channel, pack, owner, questions, started)
+		VALUES (?, ?, ?, ?, ?)`,
+		channel, pack, g.owner, n, m.b.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.id, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	m.games[strings.ToLower(channel)] = g
+
+	go m.run(g)
+
+	if pack == "" {
+		pack = "all packs"
+	}
+
+	return []string{fmt.Sprintf("trivia! %d questions from %s, %s to answer each", n, pack, Ago(m.timeout))}, nil
+}
+
+// run asks a game's questions until they run out, nobody is playing, or
+// it is stopped.
+func (m *TriviaMod) run(g *triviagame) {
+	defer m.end(g)
+
+	idle := 0
+
+	for i, q := range g.questions {
+		if i > 0 && m.pause > 0 {
+			select {
+			case <-g.stop:
+				return
+			case <-time.After(m.pause):
+			}
+		}
+
+		g.mu.Lock()
+		g.cur, g.hint = q, 0
+		g.mu.Unlock()
+
+		// drop a skip meant for the last question
+		select {
+		case <-g.skip:
+		default:
+		}
+
+		m.b.Conn.Privmsg(g.channel, fmt.Sprintf("question %d/%d [%s]: %s", i+1, len(g.questions), q.pack, q.question))
+
+		reveal := rand.Perm(utf8.RuneCountInString(q.answers[0]))
+		tick := time.NewTicker(m.timeout / time.Duration(m.hints+1))
+
+		var (
+			a       triviaanswer
+			got     bool
+			skipped bool
+		)
+
+	wait:
+		for hint := 0; ; {
+			select {
+			case a = <-g.answered:
+				got = true
+				break wait
+			case <-g.skip:
+				skipped = true
+				break wait
+			case <-g.stop:
+				tick.Stop()
+				return
+			case <-tick.C:
+				if hint == m.hints {
+					break wait
+				}
+
+				hint++
+
+				g.mu.Lock()
+				answered := g.cur == nil
+				if !answered {
+					g.hint = hint
+				}
+				g.mu.Unlock()
+
+				// the answer is on its way
+				if answered {
+					continue
+				}
+
+				m.b.Conn.Privmsg(g.channel, "hint: "+triviahint(q.answers[0], reveal, hint, m.hints+1))
+			}
+		}
+
+		tick.Stop()
+
+		if !got {
+			// someone may have got it just as time ran out
+			g.mu.Lock()
+			if g.cur == nil {
+				got = true
+			}
+			g.cur = nil
+			g.mu.Unlock()
+
+			if got {
+				a = <-g.answered
+			}
+		}
+
+		if !got {
+			m.b.Conn.Privmsg(g.channel, fmt.Sprintf("the answer was: %s", q.answers[0]))
+
+			if !skipped {
+				if idle++; idle >= m.idle {
+					m.b.Conn.Privmsg(g.channel, "nobody's playing, so that's the end of trivia")
+					return
+				}
+			}
+			continue
+		}
+
+		idle = 0
+
+		_, err := m.db.Exec(`
+			INSERT INTO
+				TriviaScore (game, nick, mask, channel, points, time)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			g.id, a.nick, a.mask, g.channel, a.points, m.b.Now().Unix(),
+		)
+		if err != nil {
+			log.Printf("trivia: saving score for %s failed: %s", a.nick, err)
+		}
+
+		g.mu.Lock()
+		total := g.scores[strings.ToLower(a.nick)].points
+		g.mu.Unlock()
+
+		pts := "points"
+		if a.points == 1 {
+			pts = "point"
+		}
+
+		m.b.Conn.Privmsg(g.channel, fmt.Sprintf("%s got it: %s (+%d %s, %d this game)", a.nick, q.answers[0], a.points, pts, total))
+	}
+}
+
+// end announces the final scores and forgets the game.
+func (m *TriviaMod) end(g *triviagame) {
+	m.mu.Lock()
+	if m.games[strings.ToLower(g.channel)] == g {
+		delete(m.games, strings.ToLower(g.channel))
+	}
+	m.mu.Unlock()
+
+	_, err := m.db.Exec(`
+		UPDATE
+			TriviaGame
+		SET
+			ended = ?
+		WHERE
+			id = ?`,
+		m.b.Now().Unix(), g.id,
+	)
+	if err != nil {
+		log.Printf("trivia: ending game %d failed: %s", g.id, err)
+	}
+
+	board := triviaboard(g.scoreboard())
+
+	switch {
+	case len(board) == 0:
+		m.b.Conn.Privmsg(g.channel, "game over! nobody scored")
+	case len(board) > 1 && board[0].points == board[1].points:
+		m.b.Conn.Privmsg(g.channel, fmt.Sprintf("game over! it's a tie: %s", board))
+	default:
+		m.b.Conn.Privmsg(g.channel, fmt.Sprintf("game over! %s wins: %s", board[0].nick, board))
+	}
+}
+
+// lastgame reports the scores of the last game played in a channel.
+func (m *TriviaMod) lastgame(channel string) ([]string, error) {
+	var (
+		id      int64
+		started int64
+	)
+
+	err := m.db.QueryRow(`
+		SELECT
+			id, started
+		FROM
+			TriviaGame
+		WHERE
+			channel = ?
+		ORDER BY
+			id DESC
+		LIMIT 1`,
+		channel,
+	).Scan(&id, &started)
+
+	if err == sql.ErrNoRows {
+		return []string{"no trivia has been played here yet"}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	board, err := m.board(`
+		SELECT
+			nick, SUM(points) AS score
+		FROM
+			TriviaScore
+		WHERE
+			game = ?
+		GROUP BY
+			nick
+		ORDER BY
+			score DESC, nick
+		LIMIT 20`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ago := Ago(m.b.Now().Sub(time.Unix(started, 0)))
+
+	if len(board) == 0 {
+		return []string{fmt.Sprintf("nobody scored in the last game, %s ago", ago)}, nil
+	}
+
+	return []string{fmt.Sprintf("last game, %s ago: %s", ago, board)}, nil
+}
+
+// top reports the best players in a channel over all games.
+func (m *TriviaMod) top(channel string, n int) ([]string, error) {
+	board, err := m.board(`
+		SELECT
+			nick, SUM(points) AS score
+		FROM
+			TriviaScore
+		WHERE
+			channel = ?
+		GROUP BY
+			nick
+		ORDER BY
+			score DESC, MAX(time) DESC
+		LIMIT ?`,
+		channel, n,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(board) == 0 {
+		return []string{"nobody has scored here yet"}, nil
+	}
+
+	return []string{"all time: " + board.String()}, nil
+}
+
+func (m *TriviaMod) board(query string, args ...interface{}) (triviaboard, error) {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var board triviaboard
+
+	for rows.Next() {
+		s := &triviascore{}
+		if err := rows.Scan(&s.nick, &s.points); err != nil {
+			return nil, err
+		}
+		board = append(board, s)
+	}
+
+	return board, rows.Err()
+}
+
+// trivianorm lowercases an answer and drops punctuation, extra spaces and
+// a leading article.
+func trivianorm(s string) string {
+	f := strings.Fields(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, s))
+
+	if len(f) > 1 && triviaArticles[f[0]] {
+		f = f[1:]
+	}
+
+	return strings.Join(f, " ")
+}
+
+// triviamatch reports whether guess is close enough to one of the answers.
+// Short and numeric answers must be exact; longer ones allow a typo for
+// every five letters past the first.
+func triviamatch(guess string, answers []string) bool {
+	g := trivianorm(guess)
+	if g == "" {
+		return false
+	}
+
+	for _, a := range answers {
+		a = trivianorm(a)
+		if g == a {
+			return true
+		}
+
+		n := utf8.RuneCountInString(a)
+		if n < 6 || strings.IndexFunc(a, unicode.IsLetter) < 0 {
+			continue
+		}
+
+		if levenshtein(g, a) <= (n-1)/5 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// triviahint masks the letters and digits of an answer, revealing more of
+// them with each hint in the order given by reveal.
+func triviahint(answer string, reveal []int, hint, of int) string {
+	r := []rune(answer)
+
+	var letters []int
+	for _, i := range reveal {
+		if unicode.IsLetter(r[i]) || unicode.IsDigit(r[i]) {
+			letters = append(letters, i)
+		}
+	}
+
+	shown := make(map[int]bool)
+	for _, i := range letters[:len(letters)*hint/of] {
+		shown[i] = true
+	}
+
+	for i, c := range r {
+		if (unicode.IsLetter(c) || unicode.IsDigit(c)) && !shown[i] {
+			r[i] = '_'
+		}
+	}
+
+	return string(r)
+}
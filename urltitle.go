@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kballard/goirc/irc"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+func init() {
+	RegisterModule("urltitle", func() Module {
+		return &URLTitleMod{}
+	})
+}
+
+var (
+	urlre = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+	// addresses we won't fetch from unless allowprivate=true
+	privatenets = parsecidrs(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	)
+
+	errPrivate = errors.New("refusing to fetch from a private address")
+)
+
+const urltitleAgent = "glenda (+https://github.com/mischief/glenda)"
+
+// most urls in one line that get a title
+const urltitleMax = 3
+
+// longest title announced
+const urltitleLen = 200
+
+func parsecidrs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isprivate(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, n := range privatenets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type urltitle struct {
+	title   string
+	fetched time.Time
+}
+
+// URLTitleMod announces the titles of web pages linked in channels.
+type URLTitleMod struct {
+	client *http.Client
+
+	// channels to announce titles in; all of them if empty
+	channels map[string]bool
+	// domains, and their subdomains, not to fetch
+	ignore []string
+
+	maxsize      int64
+	cachetime    time.Duration
+	cachesize    int
+	allowprivate bool
+
+	mu    sync.Mutex
+	cache map[string]urltitle
+
+	// limits concurrent fetches
+	sem chan bool
+}
+
+func (m *URLTitleMod) Init(b *Bot, conn irc.SafeConn) (err error) {
+	m.cache = make(map[string]urltitle)
+	m.sem = make(chan bool, 4)
+
+	if err := m.configure(b); err != nil {
+		return err
+	}
+
+	conn.AddHandler("PRIVMSG", func(c *irc.Conn, l irc.Line) {
+		channel := l.Args[0]
+
+		if !IsChannel(channel) || strings.HasPrefix(l.Args[1], b.Magic) {
+			return
+		}
+
+		if len(m.channels) > 0 && !m.channels[strings.ToLower(channel)] {
+			return
+		}
+
+		urls := urlre.FindAllString(l.Args[1], urltitleMax)
+
+		for _, u := range urls {
+			go func(u string) {
+				m.sem <- true
+				defer func() { <-m.sem }()
+
+				title, err := m.title(trimurl(u))
+				if err != nil {
+					log.Printf("urltitle: %s: %s", u, err)
+					return
+				}
+
+				if title != "" {
+					b.Conn.Privmsg(channel, title)
+				}
+			}(u)
+		}
+	})
+
+	log.Printf("urltitle module initialized")
+	return nil
+}
+
+func (m *URLTitleMod) Reload() error {
+	return nil
+}
+
+func (m *URLTitleMod) Call(args ...string) error {
+	return nil
+}
+
+func (m *URLTitleMod) configure(b *Bot) (err error) {
+	conf := b.Config.Search("mod", "urltitle")
+
+	m.channels = make(map[string]bool)
+	for _, c := range strings.Fields(conf.Search("channels")) {
+		m.channels[strings.ToLower(c)] = true
+	}
+
+	for _, d := range strings.Fields(conf.Search("ignore")) {
+		m.ignore = append(m.ignore, strings.ToLower(strings.TrimPrefix(d, "*.")))
+	}
+
+	m.maxsize = int64(confint(conf, "maxsize", 512*1024))
+	m.cachesize = confint(conf, "cachesize", 500)
+	m.allowprivate = conf.Search("allowprivate") == "true"
+
+	timeout := 5 * time.Second
+	if s := conf.Search("timeout"); s != "" {
+		if timeout, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("urltitle: timeout: %s", err)
+		}
+	}
+
+	m.cachetime = time.Hour
+	if s := conf.Search("cache"); s != "" {
+		if m.cachetime, err = ParseDuration(s); err != nil {
+			return fmt.Errorf("urltitle: cache: %s", err)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	m.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           m.dialer(dialer),
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			if m.ignored(req.URL.Host) {
+				return fmt.Errorf("redirected to ignored domain %s", req.URL.Host)
+			}
+			return nil
+		},
+	}
+
+	return nil
+}
+
+// dialer checks where we are about to connect, so a public name can't
+// point us at something private.
+func (m *URLTitleMod) dialer(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			if !m.allowprivate && isprivate(ip) {
+				continue
+			}
+
+			return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		}
+
+		return nil, errPrivate
+	}
+}
+
+func (m *URLTitleMod) ignored(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	for _, d := range m.ignore {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trimurl removes punctuation that probably ended the sentence rather
+// than the url.
+func trimurl(u string) string {
+	for len(u) > 0 {
+		switch u[len(u)-1] {
+		case '.', ',', ';', ':', '!', '?', '\'':
+			u = u[:len(u)-1]
+			continue
+		case ')':
+			if strings.Count(u, "(") < strings.Count(u, ")") {
+				u = u[:len(u)-1]
+				continue
+			}
+		}
+		break
+	}
+
+	return u
+}
+
+// title returns what to announce for the page at u, from the cache if
+// possible.
+func (m *URLTitleMod) title(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	if m.ignored(pu.Host) {
+		return "", nil
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	c, ok := m.cache[u]
+	m.mu.Unlock()
+
+	if ok && now.Sub(c.fetched) < m.cachetime {
+		return c.title, nil
+	}
+
+	title, err := m.fetch(pu)
+	if err != nil && err != errPrivate {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// forget what's expired, and if that's not enough, everything
+	if len(m.cache) >= m.cachesize {
+		for k, v := range m.cache {
+			if now.Sub(v.fetched) >= m.cachetime {
+				delete(m.cache, k)
+			}
+		}
+
+		if len(m.cache) >= m.cachesize {
+			m.cache = make(map[string]urltitle)
+		}
+	}
+
+	m.cache[u] = urltitle{title, now}
+
+	return title, err
+}
+
+func (m *URLTitleMod) fetch(u *url.URL) (string, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("User-Agent", urltitleAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok && ue.Err == errPrivate {
+			return "", errPrivate
+		}
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err != nil || (mt != "text/html" && mt != "application/xhtml+xml") {
+		return "", nil
+	}
+
+	r, err := charset.NewReader(io.LimitReader(resp.Body, m.maxsize), ct)
+	if err != nil {
+		return "", err
+	}
+
+	title, site := pagetitle(r)
+	if title == "" {
+		return "", nil
+	}
+
+	title = excerpt(title, urltitleLen)
+
+	if site == "" || strings.Contains(strings.ToLower(title), strings.ToLower(site)) {
+		site = resp.Request.URL.Host
+	}
+
+	return fmt.Sprintf("[ %s ] - %s", title, site), nil
+}
+
+// pagetitle finds the title of an html page, preferring OpenGraph's.
+func pagetitle(r io.Reader) (title, site string) {
+	var ogtitle string
+
+	z := html.NewTokenizer(r)
+	intitle := false
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			goto done
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasattr := z.TagName()
+
+			switch string(name) {
+			case "title":
+				intitle = title == ""
+			case "meta":
+				var prop, content string
+				for hasattr {
+					var k, v []byte
+					k, v, hasattr = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						prop = string(v)
+					case "content":
+						content = string(v)
+					}
+				}
+
+				switch prop {
+				case "og:title":
+					ogtitle = content
+				case "og:site_name":
+					site = content
+				}
+			case "body":
+				goto done
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				intitle = false
+			case "head":
+				goto done
+			}
+		case html.TextToken:
+			if intitle {
+				title += string(z.Text())
+			}
+		}
+	}
+
+done:
+	if ogtitle != "" {
+		title = ogtitle
+	}
+
+	return strings.Join(strings.Fields(title), " "), strings.Join(strings.Fields(site), " ")
+}
@@ -1,5 +1,18 @@
 package main
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mischief/ndb"
+)
+
 func Colored(val string, color string) string {
 	// 00 white 01 black 02 blue (navy) 03 green 04 red 05 brown (maroon)
 	// 06 purple 07 orange (olive) 08 yellow 09 light green (lime)
@@ -43,3 +56,241 @@ func Colored(val string, color string) string {
 
 	return "\x03" + c + val + "\x03"
 }
+
+// irc colour number to xterm 256 colour
+var ansicolors = [16]int{15, 0, 4, 2, 9, 1, 5, 3, 11, 10, 6, 14, 12, 13, 8, 7}
+
+// Ansi renders irc formatting codes (bold, colour, italic, underline,
+// reverse and reset) as ANSI escape sequences for display on a terminal.
+func Ansi(s string) string {
+	var (
+		buf                              bytes.Buffer
+		bold, italic, underline, reverse bool
+		fg, bg                           = -1, -1
+		dirty                            bool
+	)
+
+	emit := func() {
+		buf.WriteString("\x1b[0")
+		if bold {
+			buf.WriteString(";1")
+		}
+		if italic {
+			buf.WriteString(";3")
+		}
+		if underline {
+			buf.WriteString(";4")
+		}
+		if reverse {
+			buf.WriteString(";7")
+		}
+		if fg >= 0 {
+			fmt.Fprintf(&buf, ";38;5;%d", ansicolors[fg%16])
+		}
+		if bg >= 0 {
+			fmt.Fprintf(&buf, ";48;5;%d", ansicolors[bg%16])
+		}
+		buf.WriteString("m")
+		dirty = true
+	}
+
+	// read up to two digits of a colour number
+	number := func(i int) (int, int) {
+		n, j := 0, i
+		for ; j < len(s) && j < i+2 && s[j] >= '0' && s[j] <= '9'; j++ {
+			n = n*10 + int(s[j]-'0')
+		}
+		if j == i {
+			return -1, i
+		}
+		return n, j
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02':
+			bold = !bold
+			emit()
+		case '\x1d':
+			italic = !italic
+			emit()
+		case '\x1f':
+			underline = !underline
+			emit()
+		case '\x16':
+			reverse = !reverse
+			emit()
+		case '\x0f':
+			bold, italic, underline, reverse = false, false, false, false
+			fg, bg = -1, -1
+			emit()
+		case '\x03':
+			n, j := number(i + 1)
+			if n < 0 {
+				fg, bg = -1, -1
+			} else {
+				fg = n
+				if j+1 < len(s) && s[j] == ',' {
+					if n, k := number(j + 1); n >= 0 {
+						bg, j = n, k
+					}
+				}
+			}
+			i = j - 1
+			emit()
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+
+	if dirty {
+		buf.WriteString("\x1b[0m")
+	}
+
+	return buf.String()
+}
+
+// ParseDuration is like time.ParseDuration, but also understands days (d)
+// and weeks (w), e.g. "1w2d" or "2d12h".
+func ParseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+
+	orig := s
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q", orig)
+	}
+
+	for s != "" {
+		i := 0
+		for i < len(s) && (s[i] == '.' || (s[i] >= '0' && s[i] <= '9')) {
+			i++
+		}
+
+		j := i
+		for j < len(s) && !(s[j] == '.' || (s[j] >= '0' && s[j] <= '9')) {
+			j++
+		}
+
+		if i == 0 || j == i {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+
+		num, unit := s[:i], s[i:j]
+		s = s[j:]
+
+		switch unit {
+		case "d", "w":
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", orig)
+			}
+			day := 24 * time.Hour
+			if unit == "w" {
+				day *= 7
+			}
+			d += time.Duration(n * float64(day))
+		default:
+			pd, err := time.ParseDuration(num + unit)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", orig)
+			}
+			d += pd
+		}
+	}
+
+	return d, nil
+}
+
+// IsChannel reports whether an irc target is a channel.
+func IsChannel(target string) bool {
+	return target != "" && (target[0] == '#' || target[0] == '&')
+}
+
+// confint reads an integer from a module config, falling back to def.
+func confint(conf ndb.RecordSet, attr string, def int) int {
+	if s := conf.Search(attr); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+		log.Printf("bad value for %s: %q", attr, s)
+	}
+
+	return def
+}
+
+// Ago formats a duration in the past in a short human readable form,
+// like "3d4h" or "25m".
+func Ago(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	}
+
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	mins := int(d/time.Minute) % 60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, mins)
+	}
+
+	return fmt.Sprintf("%dm", mins)
+}
+
+// MaskMatch reports whether the irc mask matches pattern, where * matches
+// any run of characters and ? any single one. Case is ignored.
+func MaskMatch(pattern, mask string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\*`, ".*", -1)
+	re = strings.Replace(re, `\?`, ".", -1)
+
+	ok, _ := regexp.MatchString("(?i)^"+re+"$", mask)
+	return ok
+}
+
+// SplitQuoted splits s into words on spaces, keeping "quoted strings"
+// together, with the quotes removed.
+func SplitQuoted(s string) ([]string, error) {
+	var (
+		words  []string
+		word   bytes.Buffer
+		quoted bool
+		inword bool
+	)
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inword = true
+		case r == ' ' && !quoted:
+			if inword {
+				words = append(words, word.String())
+				word.Reset()
+				inword = false
+			}
+		default:
+			word.WriteRune(r)
+			inword = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+
+	if inword {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// idkey encodes id as a bolt key which sorts in numeric order.
+func idkey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}